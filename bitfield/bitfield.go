@@ -1,8 +1,12 @@
 package bitfield
 
-
 type Bitfield []byte
 
+// New returns an empty bitfield for pieceCount pieces.
+func New(pieceCount int) Bitfield {
+	return make(Bitfield, (pieceCount+7)/8)
+}
+
 func (bf Bitfield) HavePiece(pieceIdx int) bool {
 	byteIdx := pieceIdx / 8
 	offset := pieceIdx % 8
@@ -11,7 +15,18 @@ func (bf Bitfield) HavePiece(pieceIdx int) bool {
 		return false
 	}
 
-	return (bf[byteIdx] >> (7-offset))&1 != 0
+	return (bf[byteIdx]>>(7-offset))&1 != 0
+}
+
+func (bf Bitfield) SetPiece(pieceIdx int) {
+	byteIdx := pieceIdx / 8
+	offset := pieceIdx % 8
+
+	if byteIdx < 0 || byteIdx >= len(bf) {
+		return
+	}
+
+	bf[byteIdx] |= 1 << (7 - offset)
 }
 
 func (bf Bitfield) Len() int {
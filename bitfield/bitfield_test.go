@@ -16,3 +16,16 @@ func TestBitfieldHavePiece(t *testing.T) {
 	require.False(t, bitfield.HavePiece(1))
 	require.True(t, bitfield.HavePiece(9))
 }
+
+func TestBitfieldSetPiece(t *testing.T) {
+	t.Parallel()
+	bitfield := New(10)
+	require.Len(t, bitfield, 2)
+
+	bitfield.SetPiece(9)
+	bitfield.SetPiece(42)
+
+	require.True(t, bitfield.HavePiece(9))
+	require.False(t, bitfield.HavePiece(8))
+	require.Equal(t, Bitfield{0, 1 << 6}, bitfield)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	md "github.com/lksndrttm/torrent/metadata"
+)
+
+// listFlag collects the values of a repeated flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func main() {
+	var announce, webSeeds, include, exclude listFlag
+	flag.Var(&announce, "a", "tracker tier, comma separated URLs; repeat for more tiers")
+	flag.Var(&webSeeds, "w", "web seed URL; repeatable")
+	flag.Var(&include, "include", "add only files matching the pattern; repeatable")
+	flag.Var(&exclude, "exclude", "skip files matching the pattern; repeatable")
+	out := flag.String("o", "", "output file (default <name>.torrent)")
+	name := flag.String("name", "", "torrent name (default base name of the path)")
+	pieceLength := flag.Int("piece-length", 0, "piece length in KiB, a power of two (default automatic)")
+	comment := flag.String("comment", "", "comment")
+	createdBy := flag.String("created-by", "lksndrttm/torrent", "created by")
+	noDate := flag.Bool("no-date", false, "omit the creation date")
+	private := flag.Bool("private", false, "private torrent (BEP 27)")
+	source := flag.String("source", "", "source tag, changes the info hash")
+	pad := flag.Bool("pad", false, "align files to piece boundaries with pad files (BEP 47)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] <file or directory>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	root := flag.Arg(0)
+
+	opts := md.CreateOptions{
+		Name:        *name,
+		PieceLength: *pieceLength * 1024,
+		WebSeeds:    webSeeds,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		Source:      *source,
+		Include:     include,
+		Exclude:     exclude,
+		PadFiles:    *pad,
+	}
+	for _, tier := range announce {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+
+	tmeta, err := md.Create(root, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	path := *out
+	if path == "" {
+		path = filepath.Base(tmeta.Name) + ".torrent"
+	}
+	if err := tmeta.WriteTorrentFile(path); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s: %d files, %d pieces of %d KiB, info hash %x\n",
+		path, len(tmeta.Files), len(tmeta.PieceHashes), tmeta.PieceLength/1024, tmeta.InfoHash)
+}
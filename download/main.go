@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -32,9 +33,13 @@ func main() {
 		log.Fatal(err)
 	}
 
+	events, unsubscribe := t.Subscribe()
+	defer unsubscribe()
+
 	m := model{
 		progress: progress.New(progress.WithDefaultGradient()),
 		Torrent:  t,
+		events:   events,
 	}
 	t.Start()
 
@@ -42,17 +47,29 @@ func main() {
 		fmt.Println("Oh no!", err)
 		os.Exit(1)
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := t.Stop(ctx); err != nil {
+		log.Println(err)
+	}
+	if err := t.Err(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 type tickMsg time.Time
 
+type eventMsg torrent.Event
+
 type model struct {
 	progress progress.Model
 	Torrent  *torrent.Torrent
+	events   <-chan torrent.Event
 }
 
 func (m model) Init() tea.Cmd {
-	return tickCmd()
+	return tea.Batch(tickCmd(), waitEvent(m.events))
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -67,11 +84,13 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return m, nil
 
-	case tickMsg:
-		if m.progress.Percent() == 1.0 {
+	case eventMsg:
+		if msg.Type == torrent.EventStateChanged && msg.State != torrent.StateDownloading {
 			return m, tea.Quit
 		}
+		return m, waitEvent(m.events)
 
+	case tickMsg:
 		currentProgress := float64(m.Torrent.Downloaded()) / float64(m.Torrent.Length())
 		cmd := m.progress.SetPercent(currentProgress)
 		return m, tea.Batch(tickCmd(), cmd)
@@ -87,24 +106,42 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 }
 
 func (m model) View() string {
-	downloadingSpeed := m.Torrent.DownloadingSpeed()
-
-	speedStr := ""
-	switch {
-	case downloadingSpeed > 999999:
-		speedStr = fmt.Sprintf("[%d MB/s]", downloadingSpeed/1000000)
-	case downloadingSpeed > 999:
-		speedStr = fmt.Sprintf("[%d KB/s]", downloadingSpeed/1000)
-	default:
-		speedStr = fmt.Sprintf("[%d B/s]", downloadingSpeed)
+	stats := m.Torrent.Stats()
+	speedStr := "[" + formatRate(stats.DownloadRate) + "]"
+	statsStr := fmt.Sprintf("up %s  peers %d (%d seeds)  pieces %d/%d",
+		formatRate(stats.UploadRate), stats.ConnectedPeers, stats.Seeds, stats.PiecesHave, stats.PiecesTotal)
+	if stats.ETA > 0 {
+		statsStr += fmt.Sprintf("  eta %s", stats.ETA)
 	}
 
 	pad := strings.Repeat(" ", padding)
 	return "\n" +
-		pad + m.progress.View() + speedStr + "\n\n" +
+		pad + m.progress.View() + speedStr + "\n" +
+		pad + statsStr + "\n\n" +
 		pad + helpStyle("Press any key to quit")
 }
 
+func formatRate(rate int) string {
+	switch {
+	case rate > 999999:
+		return fmt.Sprintf("%d MB/s", rate/1000000)
+	case rate > 999:
+		return fmt.Sprintf("%d KB/s", rate/1000)
+	default:
+		return fmt.Sprintf("%d B/s", rate)
+	}
+}
+
+func waitEvent(events <-chan torrent.Event) tea.Cmd {
+	return func() tea.Msg {
+		e, ok := <-events
+		if !ok {
+			return nil
+		}
+		return eventMsg(e)
+	}
+}
+
 func tickCmd() tea.Cmd {
 	return tea.Tick(time.Second*1, func(t time.Time) tea.Msg {
 		return tickMsg(t)
@@ -0,0 +1,259 @@
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// eMule entries with an access level above this value are allowed.
+const emuleMaxBlockedLevel = 127
+
+type ipRange struct {
+	first, last [16]byte
+}
+
+// Filter blocks IP ranges. Ranges are kept sorted and merged, so a lookup
+// is a binary search.
+type Filter struct {
+	m      sync.RWMutex
+	ranges []ipRange
+}
+
+func New() *Filter {
+	return &Filter{}
+}
+
+func key(ip net.IP) ([16]byte, bool) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return [16]byte{}, false
+	}
+	return [16]byte(ip16), true
+}
+
+// AddRange blocks all addresses from first to last.
+func (f *Filter) AddRange(first, last net.IP) error {
+	r, err := newRange(first, last)
+	if err != nil {
+		return err
+	}
+	f.add([]ipRange{r})
+	return nil
+}
+
+// AddCIDR blocks a network like 10.0.0.0/8.
+func (f *Filter) AddCIDR(cidr string) error {
+	r, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	f.add([]ipRange{r})
+	return nil
+}
+
+func newRange(first, last net.IP) (ipRange, error) {
+	k1, ok1 := key(first)
+	k2, ok2 := key(last)
+	if !ok1 || !ok2 || (first.To4() == nil) != (last.To4() == nil) {
+		return ipRange{}, fmt.Errorf("invalid range %s - %s", first, last)
+	}
+	if bytes.Compare(k1[:], k2[:]) > 0 {
+		return ipRange{}, fmt.Errorf("range start %s after end %s", first, last)
+	}
+	return ipRange{first: k1, last: k2}, nil
+}
+
+func parseCIDR(s string) (ipRange, error) {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return ipRange{}, err
+	}
+	first := network.IP
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^network.Mask[i]
+	}
+	return newRange(first, last)
+}
+
+func (f *Filter) add(ranges []ipRange) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	all := append(f.ranges, ranges...)
+	slices.SortFunc(all, func(a, b ipRange) int {
+		return bytes.Compare(a.first[:], b.first[:])
+	})
+
+	merged := all[:0]
+	for _, r := range all {
+		if n := len(merged); n > 0 && !after(r.first, merged[n-1].last) {
+			if bytes.Compare(r.last[:], merged[n-1].last[:]) > 0 {
+				merged[n-1].last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	f.ranges = merged
+}
+
+// after reports whether a is more than one address after b, so ranges
+// ending at b and starting at a can not be merged.
+func after(a, b [16]byte) bool {
+	next := b
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+		if i == 0 {
+			// b is the last address
+			return false
+		}
+	}
+	return bytes.Compare(a[:], next[:]) > 0
+}
+
+// Blocked reports whether the IP is in one of the ranges. A nil filter blocks nothing.
+func (f *Filter) Blocked(ip net.IP) bool {
+	if f == nil {
+		return false
+	}
+	k, ok := key(ip)
+	if !ok {
+		return false
+	}
+
+	f.m.RLock()
+	defer f.m.RUnlock()
+	i, found := slices.BinarySearchFunc(f.ranges, k, func(r ipRange, k [16]byte) int {
+		return bytes.Compare(r.first[:], k[:])
+	})
+	if found {
+		return true
+	}
+	return i > 0 && bytes.Compare(k[:], f.ranges[i-1].last[:]) <= 0
+}
+
+// Len returns the number of merged ranges.
+func (f *Filter) Len() int {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return len(f.ranges)
+}
+
+// Load adds the ranges of a blocklist. Every line can be in eMule
+// ipfilter.dat format, PeerGuardian P2P format, CIDR notation or a single
+// IP. Empty lines and lines starting with # or // are skipped.
+func (f *Filter) Load(r io.Reader) error {
+	ranges := []ipRange{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		r, ok, err := parseLine(line)
+		if err != nil {
+			return fmt.Errorf("blocklist line %d: %w", n, err)
+		}
+		if ok {
+			ranges = append(ranges, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.add(ranges)
+	return nil
+}
+
+func (f *Filter) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close() //nolint:errcheck
+	return f.Load(file)
+}
+
+// parseLine returns false for eMule entries that allow the range.
+func parseLine(line string) (ipRange, bool, error) {
+	// eMule: 001.002.003.000 - 001.002.003.255 , 100 , description
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		if r, err := parseIPRange(fields[0]); err == nil {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return ipRange{}, false, fmt.Errorf("invalid access level %q", fields[1])
+			}
+			return r, level <= emuleMaxBlockedLevel, nil
+		}
+	}
+
+	// PeerGuardian: description:1.2.3.0-1.2.3.255, the description can contain colons
+	if i := strings.LastIndex(line, ":"); i >= 0 && strings.Contains(line[i:], "-") && strings.Count(line[i:], ".") >= 6 {
+		r, err := parseIPRange(line[i+1:])
+		return r, err == nil, err
+	}
+
+	if strings.Contains(line, "/") {
+		r, err := parseCIDR(line)
+		return r, err == nil, err
+	}
+
+	if strings.Contains(line, "-") {
+		r, err := parseIPRange(line)
+		return r, err == nil, err
+	}
+
+	ip := parseIP(line)
+	if ip == nil {
+		return ipRange{}, false, fmt.Errorf("invalid IP %q", line)
+	}
+	r, err := newRange(ip, ip)
+	return r, err == nil, err
+}
+
+func parseIPRange(s string) (ipRange, error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+	firstIP, lastIP := parseIP(first), parseIP(last)
+	if firstIP == nil || lastIP == nil {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+	return newRange(firstIP, lastIP)
+}
+
+// parseIP also accepts IPv4 addresses with leading zeros as used by ipfilter.dat.
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3])
+}
@@ -0,0 +1,76 @@
+package ipfilter
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadFormats(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	blocklist := `# comment
+// another comment
+
+001.002.003.000 - 001.002.003.255 , 000 , eMule entry
+005.000.000.000 - 005.255.255.255 , 200 , allowed eMule entry
+Some Org, Inc: with colon:10.1.0.0-10.1.255.255
+192.168.0.0/16
+172.16.5.5
+2001:db8::/32
+`
+	f := New()
+	require.NoError(f.Load(strings.NewReader(blocklist)))
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{ip: "1.2.3.0", blocked: true},
+		{ip: "1.2.3.255", blocked: true},
+		{ip: "1.2.4.0", blocked: false},
+		{ip: "5.1.1.1", blocked: false},
+		{ip: "10.1.200.3", blocked: true},
+		{ip: "10.2.0.0", blocked: false},
+		{ip: "192.168.77.1", blocked: true},
+		{ip: "172.16.5.5", blocked: true},
+		{ip: "172.16.5.6", blocked: false},
+		{ip: "2001:db8::1", blocked: true},
+		{ip: "2001:db9::1", blocked: false},
+		{ip: "8.8.8.8", blocked: false},
+	}
+	for _, tst := range tests {
+		require.Equal(tst.blocked, f.Blocked(net.ParseIP(tst.ip)), tst.ip)
+	}
+}
+
+func TestLoadInvalidLine(t *testing.T) {
+	t.Parallel()
+	err := New().Load(strings.NewReader("10.0.0.0/8\nnot an ip\n"))
+	require.ErrorContains(t, err, "line 2")
+
+	err = New().Load(strings.NewReader("1.2.3.4 - 1.2.3.0 , 0 , reversed\n"))
+	require.Error(t, err)
+}
+
+func TestRangesAreMerged(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	f := New()
+	require.NoError(f.AddRange(net.ParseIP("10.0.0.10"), net.ParseIP("10.0.0.20")))
+	require.NoError(f.AddRange(net.ParseIP("10.0.0.21"), net.ParseIP("10.0.0.30")))
+	require.NoError(f.AddRange(net.ParseIP("10.0.0.15"), net.ParseIP("10.0.0.25")))
+	require.NoError(f.AddCIDR("10.0.1.0/24"))
+	require.Equal(2, f.Len())
+
+	require.False(f.Blocked(net.ParseIP("10.0.0.9")))
+	require.True(f.Blocked(net.ParseIP("10.0.0.30")))
+	require.False(f.Blocked(net.ParseIP("10.0.0.31")))
+	require.True(f.Blocked(net.ParseIP("10.0.1.255")))
+
+	var nilFilter *Filter
+	require.False(nilFilter.Blocked(net.ParseIP("10.0.0.10")))
+}
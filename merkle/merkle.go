@@ -0,0 +1,105 @@
+// Package merkle computes the SHA-256 merkle trees of BitTorrent v2 files
+// (BEP 52). Leaves are the hashes of 16 KiB blocks, leaves past the end of
+// a file are zero.
+package merkle
+
+import (
+	"crypto/sha256"
+	"math/bits"
+)
+
+const BlockSize = 16 * 1024
+
+// BlockHashes returns the leaf hashes of data, the last block may be short.
+func BlockHashes(data []byte) [][32]byte {
+	hashes := make([][32]byte, 0, (len(data)+BlockSize-1)/BlockSize)
+	for i := 0; i < len(data); i += BlockSize {
+		hashes = append(hashes, sha256.Sum256(data[i:min(i+BlockSize, len(data))]))
+	}
+	return hashes
+}
+
+// Width returns the smallest power of two that is at least n.
+func Width(n int) int {
+	if n <= 1 {
+		return 1
+	}
+	return 1 << bits.Len(uint(n-1))
+}
+
+// Height returns log2 of the power of two width.
+func Height(width int) int {
+	return bits.TrailingZeros(uint(width))
+}
+
+// PadHash returns the root of a subtree of 2^height zero leaves.
+func PadHash(height int) [32]byte {
+	var h [32]byte
+	for range height {
+		h = parent(h, h)
+	}
+	return h
+}
+
+func parent(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+// Layers returns the layers of the tree over hashes, the first is hashes
+// padded to width with pad and the last holds the root. Width must be a
+// power of two of at least len(hashes).
+func Layers(hashes [][32]byte, width int, pad [32]byte) [][][32]byte {
+	layer := make([][32]byte, width)
+	copy(layer, hashes)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+
+	layers := [][][32]byte{layer}
+	for len(layer) > 1 {
+		next := make([][32]byte, len(layer)/2)
+		for i := range next {
+			next[i] = parent(layer[2*i], layer[2*i+1])
+		}
+		layers = append(layers, next)
+		layer = next
+	}
+	return layers
+}
+
+// Root returns the root of the tree over hashes padded to width with pad.
+func Root(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	layers := Layers(hashes, width, pad)
+	return layers[len(layers)-1][0]
+}
+
+// Proof returns up to n uncle hashes of the node at index of the first
+// layer, from the lowest layer up.
+func Proof(layers [][][32]byte, index, n int) [][32]byte {
+	proof := [][32]byte{}
+	for _, layer := range layers[:len(layers)-1] {
+		if len(proof) == n {
+			break
+		}
+		proof = append(proof, layer[index^1])
+		index /= 2
+	}
+	return proof
+}
+
+// VerifyProof reports whether the node at index, combined with the uncle
+// hashes of proof, yields root.
+func VerifyProof(root, node [32]byte, index int, proof [][32]byte) bool {
+	for _, uncle := range proof {
+		if index%2 == 0 {
+			node = parent(node, uncle)
+		} else {
+			node = parent(uncle, node)
+		}
+		index /= 2
+	}
+	return index == 0 && node == root
+}
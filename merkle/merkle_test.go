@@ -0,0 +1,59 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoot(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	data := bytes.Repeat([]byte{1}, 2*BlockSize+100)
+	leaves := BlockHashes(data)
+	require.Len(leaves, 3)
+	require.Equal(sha256.Sum256(data[2*BlockSize:]), leaves[2], "the last block is short")
+
+	var zero [32]byte
+	want := parent(parent(leaves[0], leaves[1]), parent(leaves[2], zero))
+	require.Equal(want, Root(leaves, Width(len(leaves)), zero))
+
+	require.Equal(parent(zero, zero), PadHash(1))
+	require.Equal(zero, PadHash(0))
+}
+
+func TestWidth(t *testing.T) {
+	t.Parallel()
+	for n, want := range map[int]int{0: 1, 1: 1, 2: 2, 3: 4, 4: 4, 5: 8, 1000: 1024} {
+		require.Equal(t, want, Width(n), n)
+	}
+	require.Equal(t, 10, Height(1024))
+}
+
+func TestProof(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	data := make([]byte, 5*BlockSize)
+	for i := range data {
+		data[i] = byte(i / BlockSize)
+	}
+	leaves := BlockHashes(data)
+	layers := Layers(leaves, 8, [32]byte{})
+	root := layers[len(layers)-1][0]
+
+	for i := range leaves {
+		proof := Proof(layers, i, 10)
+		require.Len(proof, 3)
+		require.True(VerifyProof(root, leaves[i], i, proof))
+		require.False(VerifyProof(root, leaves[i], i^1, proof))
+	}
+
+	// a subtree root from the second layer
+	proof := Proof(layers[1:], 1, 2)
+	require.True(VerifyProof(root, layers[1][1], 1, proof))
+	require.False(VerifyProof(root, layers[1][1], 1, proof[:1]), "proof too short")
+}
@@ -5,8 +5,13 @@ import (
 	"io"
 )
 
+// ReservedV2 is the bit in Reserved[7] announcing BitTorrent v2 support
+// (BEP 52).
+const ReservedV2 = 0x10
+
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
@@ -25,7 +30,7 @@ func (h *Handshake) Serialize() []byte {
 	hBytes[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(hBytes[curr:], []byte(h.Pstr))
-	curr += copy(hBytes[curr:], []byte{0, 0, 0, 0, 0, 0, 0, 0})
+	curr += copy(hBytes[curr:], h.Reserved[:])
 	curr += copy(hBytes[curr:], h.InfoHash[:])
 	curr += copy(hBytes[curr:], h.PeerID[:])
 
@@ -45,8 +50,14 @@ func ReadHandshake(r io.Reader) (h Handshake, err error) {
 	if h.Pstr != "BitTorrent protocol" {
 		return h, errors.New("Handshake format error")
 	}
+	copy(h.Reserved[:], hBytes[20:28])
 	copy(h.InfoHash[:], hBytes[28:48])
 	copy(h.PeerID[:], hBytes[48:68])
 
 	return h, nil
 }
+
+// SupportsV2 reports whether the sender supports BitTorrent v2.
+func (h *Handshake) SupportsV2() bool {
+	return h.Reserved[7]&ReservedV2 != 0
+}
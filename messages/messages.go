@@ -19,6 +19,9 @@ const (
 	MsgRequest       msgID = 6
 	MsgPiece         msgID = 7
 	MsgCancel        msgID = 8
+	MsgHashRequest   msgID = 21
+	MsgHashes        msgID = 22
+	MsgHashReject    msgID = 23
 )
 
 type Message struct {
@@ -38,8 +41,30 @@ type PieceMessage struct {
 	Data        []byte
 }
 
+type HaveMessage struct {
+	PieceID uint32
+}
+
 type BitfieldMessage []byte
 
+// HashRequestMessage asks for Length hashes of a v2 merkle tree layer
+// starting at Index, with ProofLayers uncle hashes to verify them (BEP 52).
+// A hash reject has the same fields.
+type HashRequestMessage struct {
+	PiecesRoot  [32]byte
+	BaseLayer   uint32
+	Index       uint32
+	Length      uint32
+	ProofLayers uint32
+}
+
+// HashesMessage answers a hash request with the requested hashes followed
+// by the uncle hashes.
+type HashesMessage struct {
+	HashRequestMessage
+	Hashes [][32]byte
+}
+
 func (msg *Message) Serialize() []byte {
 	if msg == nil {
 		return make([]byte, 4)
@@ -70,6 +95,33 @@ func (rMsg *RequestMessage) ToMessage() *Message {
 	return &msg
 }
 
+func (hMsg *HashRequestMessage) payload() []byte {
+	payload := make([]byte, 48)
+	copy(payload, hMsg.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], hMsg.BaseLayer)
+	binary.BigEndian.PutUint32(payload[36:40], hMsg.Index)
+	binary.BigEndian.PutUint32(payload[40:44], hMsg.Length)
+	binary.BigEndian.PutUint32(payload[44:48], hMsg.ProofLayers)
+	return payload
+}
+
+func (hMsg *HashRequestMessage) ToMessage() *Message {
+	return &Message{ID: MsgHashRequest, Payload: hMsg.payload()}
+}
+
+// ToRejectMessage returns the hash reject of the request.
+func (hMsg *HashRequestMessage) ToRejectMessage() *Message {
+	return &Message{ID: MsgHashReject, Payload: hMsg.payload()}
+}
+
+func (hMsg *HashesMessage) ToMessage() *Message {
+	payload := hMsg.payload()
+	for _, h := range hMsg.Hashes {
+		payload = append(payload, h[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
 func (pMsg *PieceMessage) ToMessage() *Message {
 	payload := make([]byte, len(pMsg.Data)+8)
 
@@ -85,6 +137,18 @@ func (pMsg *PieceMessage) ToMessage() *Message {
 	return &msg
 }
 
+func (hMsg *HaveMessage) ToMessage() *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, hMsg.PieceID)
+
+	msg := Message{
+		ID:      MsgHave,
+		Payload: payload,
+	}
+
+	return &msg
+}
+
 func (bMsg BitfieldMessage) ToMessage() *Message {
 	msg := Message{
 		ID:      MsgBitfield,
@@ -113,7 +177,7 @@ func ParseMessage(buf []byte) (*Message, error) {
 		ID: msgID(buf[0]),
 	}
 
-	if msg.ID > 8 {
+	if msg.ID > MsgCancel && (msg.ID < MsgHashRequest || msg.ID > MsgHashReject) {
 		return nil, errors.New("not a message")
 	}
 
@@ -151,6 +215,48 @@ func ToPieceMessage(msg *Message) (*PieceMessage, error) {
 	return &pMsg, nil
 }
 
+// ToHashRequestMessage converts a hash request or a hash reject.
+func ToHashRequestMessage(msg *Message) (*HashRequestMessage, error) {
+	if msg == nil || (msg.ID != MsgHashRequest && msg.ID != MsgHashReject) || len(msg.Payload) != 48 {
+		return nil, errors.New("cant convert to HashRequestMessage")
+	}
+	return parseHashRequest(msg.Payload), nil
+}
+
+func ToHashesMessage(msg *Message) (*HashesMessage, error) {
+	if msg == nil || msg.ID != MsgHashes || len(msg.Payload) < 48 || (len(msg.Payload)-48)%32 != 0 {
+		return nil, errors.New("cant convert to HashesMessage")
+	}
+
+	hMsg := HashesMessage{HashRequestMessage: *parseHashRequest(msg.Payload)}
+	for i := 48; i < len(msg.Payload); i += 32 {
+		hMsg.Hashes = append(hMsg.Hashes, [32]byte(msg.Payload[i:i+32]))
+	}
+	return &hMsg, nil
+}
+
+func parseHashRequest(payload []byte) *HashRequestMessage {
+	return &HashRequestMessage{
+		PiecesRoot:  [32]byte(payload[0:32]),
+		BaseLayer:   binary.BigEndian.Uint32(payload[32:36]),
+		Index:       binary.BigEndian.Uint32(payload[36:40]),
+		Length:      binary.BigEndian.Uint32(payload[40:44]),
+		ProofLayers: binary.BigEndian.Uint32(payload[44:48]),
+	}
+}
+
+func ToHaveMessage(msg *Message) (*HaveMessage, error) {
+	if msg == nil || msg.ID != MsgHave || len(msg.Payload) != 4 {
+		return nil, errors.New("cant convert to HaveMessage")
+	}
+
+	hMsg := HaveMessage{
+		PieceID: binary.BigEndian.Uint32(msg.Payload),
+	}
+
+	return &hMsg, nil
+}
+
 func ToBitfieldMessage(msg *Message) (BitfieldMessage, error) {
 	if msg == nil || msg.ID != MsgBitfield {
 		return nil, errors.New("cant convert to BitfieldMessage")
@@ -179,6 +285,14 @@ func NewRequestMessage(pieceID, blockOffset, blockLength uint32) *RequestMessage
 	return &rMsg
 }
 
+func NewHaveMessage(pieceID uint32) *HaveMessage {
+	hMsg := HaveMessage{
+		PieceID: pieceID,
+	}
+
+	return &hMsg
+}
+
 func NewBitfieldMessage(bitfield []byte) BitfieldMessage {
 	return bitfield
 }
@@ -35,3 +35,63 @@ func TestReadHandshake(t *testing.T) {
 		t.Fatalf("%+v != %+v", res, expected)
 	}
 }
+
+func TestHaveMessageRoundTrip(t *testing.T) {
+	t.Parallel()
+	msg := NewHaveMessage(258).ToMessage()
+
+	if !slices.Equal([]byte{0, 0, 1, 2}, msg.Payload) {
+		t.Fatalf("wrong payload %v", msg.Payload)
+	}
+
+	hMsg, err := ToHaveMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hMsg.PieceID != 258 {
+		t.Fatalf("%d != 258", hMsg.PieceID)
+	}
+}
+
+func TestHashesMessageRoundTrip(t *testing.T) {
+	t.Parallel()
+	req := HashRequestMessage{PiecesRoot: [32]byte{1, 2, 3}, BaseLayer: 0, Index: 4, Length: 2, ProofLayers: 1}
+	sent := HashesMessage{HashRequestMessage: req, Hashes: [][32]byte{{4}, {5}, {6}}}
+
+	msg, err := ParseMessage(sent.ToMessage().Serialize()[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := ToHashesMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.HashRequestMessage != req || !slices.Equal(received.Hashes, sent.Hashes) {
+		t.Fatalf("%+v != %+v", received, sent)
+	}
+
+	reject, err := ToHashRequestMessage(req.ToRejectMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *reject != req {
+		t.Fatalf("%+v != %+v", reject, req)
+	}
+	if _, err := ToHashesMessage(&Message{ID: MsgHashes, Payload: make([]byte, 50)}); err == nil {
+		t.Fatal("hashes with a partial hash must be rejected")
+	}
+}
+
+func TestHandshakeReserved(t *testing.T) {
+	t.Parallel()
+	hshake := NewHandshake([20]byte{}, [20]byte{})
+	hshake.Reserved[7] |= ReservedV2
+
+	res, err := ReadHandshake(strings.NewReader(string(hshake.Serialize())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.SupportsV2() {
+		t.Fatal("v2 bit must survive a round trip")
+	}
+}
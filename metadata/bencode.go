@@ -0,0 +1,266 @@
+package metadata
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+var errMalformedBencode = errors.New("malformed bencode")
+
+// valueLen returns the length in bytes of the bencoded value at the start of data.
+func valueLen(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, errMalformedBencode
+	}
+
+	switch c := data[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(data, 'e')
+		if end < 0 {
+			return 0, errMalformedBencode
+		}
+		return end + 1, nil
+	case c == 'l' || c == 'd':
+		pos := 1
+		for {
+			if pos >= len(data) {
+				return 0, errMalformedBencode
+			}
+			if data[pos] == 'e' {
+				return pos + 1, nil
+			}
+			n, err := valueLen(data[pos:])
+			if err != nil {
+				return 0, err
+			}
+			pos += n
+		}
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data, ':')
+		if colon < 0 {
+			return 0, errMalformedBencode
+		}
+		l, err := strconv.Atoi(string(data[:colon]))
+		if err != nil || l < 0 || colon+1+l > len(data) {
+			return 0, errMalformedBencode
+		}
+		return colon + 1 + l, nil
+	default:
+		return 0, errMalformedBencode
+	}
+}
+
+// rawDictValue returns the raw bencoded value stored under key in the dictionary at the start of data.
+func rawDictValue(data []byte, key string) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("not a dictionary: %w", errMalformedBencode)
+	}
+
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		kLen, err := valueLen(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		k := data[pos : pos+kLen]
+		pos += kLen
+
+		vLen, err := valueLen(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		if string(k[bytes.IndexByte(k, ':')+1:]) == key {
+			return data[pos : pos+vLen], nil
+		}
+		pos += vLen
+	}
+
+	return nil, fmt.Errorf("key %q not found", key)
+}
+
+// rawEntry is a key of a bencoded dictionary with its raw value.
+type rawEntry struct {
+	key   string
+	value []byte
+}
+
+// rawDictEntries returns the entries of the dictionary that makes up data
+// in their original order.
+func rawDictEntries(data []byte) ([]rawEntry, error) {
+	n, err := valueLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if data[0] != 'd' || n != len(data) {
+		return nil, fmt.Errorf("not a dictionary: %w", errMalformedBencode)
+	}
+
+	entries := []rawEntry{}
+	for pos := 1; data[pos] != 'e'; {
+		kLen, _ := valueLen(data[pos:])
+		key, err := decodeString(data[pos : pos+kLen])
+		if err != nil {
+			return nil, fmt.Errorf("dictionary key: %w", err)
+		}
+		pos += kLen
+		if data[pos] == 'e' {
+			return nil, fmt.Errorf("dictionary without value: %w", errMalformedBencode)
+		}
+		vLen, _ := valueLen(data[pos:])
+		entries = append(entries, rawEntry{key: key, value: data[pos : pos+vLen]})
+		pos += vLen
+	}
+	return entries, nil
+}
+
+// decodeValue decodes the bencoded value at the start of data into an int,
+// a string, a []any or a map[string]any.
+func decodeValue(data []byte) (any, error) {
+	n, err := valueLen(data)
+	if err != nil {
+		return nil, err
+	}
+	switch data[0] {
+	case 'i':
+		v, err := strconv.Atoi(string(data[1 : n-1]))
+		if err != nil {
+			return nil, fmt.Errorf("integer: %w", errMalformedBencode)
+		}
+		return v, nil
+	case 'l', 'd':
+		items := []any{}
+		for pos := 1; data[pos] != 'e'; {
+			l, _ := valueLen(data[pos:])
+			item, err := decodeValue(data[pos : pos+l])
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			pos += l
+		}
+		if data[0] == 'l' {
+			return items, nil
+		}
+		if len(items)%2 != 0 {
+			return nil, fmt.Errorf("dictionary without value: %w", errMalformedBencode)
+		}
+		dict := make(map[string]any, len(items)/2)
+		for i := 0; i < len(items); i += 2 {
+			key, ok := items[i].(string)
+			if !ok {
+				return nil, fmt.Errorf("dictionary key: %w", errMalformedBencode)
+			}
+			dict[key] = items[i+1]
+		}
+		return dict, nil
+	default:
+		return decodeString(data[:n])
+	}
+}
+
+// decodeString decodes the bencoded string at the start of data.
+func decodeString(data []byte) (string, error) {
+	if len(data) == 0 || data[0] < '0' || data[0] > '9' {
+		return "", fmt.Errorf("not a string: %w", errMalformedBencode)
+	}
+	n, err := valueLen(data)
+	if err != nil {
+		return "", err
+	}
+	return string(data[bytes.IndexByte(data, ':')+1 : n]), nil
+}
+
+// decodeStringList decodes a bencoded list of strings, a single string is
+// returned as a list of one.
+func decodeStringList(data []byte) ([]string, error) {
+	if len(data) > 0 && data[0] != 'l' {
+		s, err := decodeString(data)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+	if _, err := valueLen(data); err != nil {
+		return nil, err
+	}
+
+	list := []string{}
+	pos := 1
+	for data[pos] != 'e' {
+		n, err := valueLen(data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		s, err := decodeString(data[pos : pos+n])
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+		pos += n
+	}
+	return list, nil
+}
+
+// rawValue is written to the output as it is, it must be valid bencode.
+type rawValue []byte
+
+// encodeValue bencodes ints, strings, byte slices, raw values, lists and
+// string keyed dictionaries.
+func encodeValue(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeValue(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeValue(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(v))
+		buf.Write(v)
+	case rawValue:
+		buf.Write(v)
+	case []string:
+		buf.WriteByte('l')
+		for _, s := range v {
+			fmt.Fprintf(buf, "%d:%s", len(s), s)
+		}
+		buf.WriteByte('e')
+	case []any:
+		buf.WriteByte('l')
+		for _, e := range v {
+			if err := writeValue(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('d')
+		for _, k := range keys {
+			fmt.Fprintf(buf, "%d:%s", len(k), k)
+			if err := writeValue(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("unsupported bencode type %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	// targetPieceCount is the piece count the automatic piece length aims for
+	targetPieceCount = 1500
+)
+
+var ErrNoFiles = errors.New("no files to add")
+
+// CreateOptions are the settings of a new torrent. Only the root is required.
+type CreateOptions struct {
+	// Name defaults to the base name of the root.
+	Name string
+	// PieceLength must be a power of two of at least 16 KiB, zero picks one
+	// based on the total size.
+	PieceLength int
+	// AnnounceList holds tiers of tracker URLs, the first URL is also the
+	// announce URL.
+	AnnounceList [][]string
+	WebSeeds     []string
+	Comment      string
+	CreatedBy    string
+	// CreationDate is omitted when zero.
+	CreationDate time.Time
+	Private      bool
+	Source       string
+	// Include and Exclude are path.Match patterns matched against the slash
+	// separated path relative to the root and against the file name. Without
+	// Include all files are added, Exclude wins over Include.
+	Include []string
+	Exclude []string
+	// Workers hash pieces in parallel, zero means GOMAXPROCS.
+	Workers int
+	// PadFiles aligns every file of a directory to a piece boundary with
+	// pad files (BEP 47), so no piece spans two files.
+	PadFiles bool
+}
+
+// fileSource is a file to hash, or padding of zeros when path is empty.
+type fileSource struct {
+	path string
+	pad  int
+}
+
+// Create builds a torrent from a file or a directory. Files of a directory
+// are added in lexical order.
+func Create(root string, opts CreateOptions) (*TorrentMetadata, error) {
+	for _, p := range slices.Concat(opts.Include, opts.Exclude) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", p, err)
+		}
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	name := opts.Name
+	if name == "" {
+		// "." and relative roots are named after the directory they refer to
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		name = filepath.Base(abs)
+	}
+
+	tm := &TorrentMetadata{
+		Name:         name,
+		URLList:      opts.WebSeeds,
+		AnnounceList: opts.AnnounceList,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: opts.CreationDate,
+		Private:      opts.Private,
+		Source:       opts.Source,
+	}
+	if len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		tm.Announce = opts.AnnounceList[0][0]
+	}
+
+	var sources []fileSource
+	if info.IsDir() {
+		sources, err = walkFiles(root, name, &opts, tm)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		tm.Files = []FileInfo{{Path: []string{name}, Length: int(info.Size())}}
+		tm.Length = int(info.Size())
+		sources = []fileSource{{path: root}}
+	}
+	if tm.Length == 0 {
+		return nil, ErrNoFiles
+	}
+
+	tm.PieceLength = opts.PieceLength
+	if tm.PieceLength == 0 {
+		tm.PieceLength = autoPieceLength(tm.Length)
+	}
+	if tm.PieceLength < minPieceLength || tm.PieceLength&(tm.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %d is not a power of two of at least %d", tm.PieceLength, minPieceLength)
+	}
+	if opts.PadFiles && info.IsDir() {
+		sources = tm.addPadFiles(sources)
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if tm.PieceHashes, err = hashFiles(sources, tm.Length, tm.PieceLength, workers); err != nil {
+		return nil, err
+	}
+	// a name like "/" or ".." would not download anywhere safe
+	if err := tm.Validate(); err != nil {
+		return nil, err
+	}
+
+	if tm.rawInfo, err = encodeValue(tm.infoDict()); err != nil {
+		return nil, err
+	}
+	tm.InfoHash = sha1.Sum(tm.rawInfo)
+	return tm, nil
+}
+
+// walkFiles adds the matching regular files below root to tm and returns
+// their sources.
+func walkFiles(root, name string, opts *CreateOptions, tm *TorrentMetadata) ([]fileSource, error) {
+	var sources []fileSource
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !opts.matches(rel) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		tm.Files = append(tm.Files, FileInfo{
+			Path:   append([]string{name}, strings.Split(rel, "/")...),
+			Length: int(info.Size()),
+			Offset: tm.Length,
+		})
+		tm.Length += int(info.Size())
+		sources = append(sources, fileSource{path: p})
+		return nil
+	})
+	return sources, err
+}
+
+// addPadFiles inserts a pad file after every file that does not end at a
+// piece boundary, except the last one. It returns the sources with padding.
+func (tm *TorrentMetadata) addPadFiles(sources []fileSource) []fileSource {
+	files := make([]FileInfo, 0, len(tm.Files))
+	padded := make([]fileSource, 0, len(sources))
+	tm.Length = 0
+	for i, f := range tm.Files {
+		f.Offset = tm.Length
+		files = append(files, f)
+		padded = append(padded, sources[i])
+		tm.Length += f.Length
+
+		pad := (tm.PieceLength - tm.Length%tm.PieceLength) % tm.PieceLength
+		if pad == 0 || i == len(tm.Files)-1 {
+			continue
+		}
+		files = append(files, FileInfo{
+			Path:   []string{tm.Name, ".pad", strconv.Itoa(pad)},
+			Length: pad,
+			Offset: tm.Length,
+			Attr:   "p",
+		})
+		padded = append(padded, fileSource{pad: pad})
+		tm.Length += pad
+	}
+	tm.Files = files
+	return padded
+}
+
+func (opts *CreateOptions) matches(rel string) bool {
+	match := func(patterns []string) bool {
+		for _, p := range patterns {
+			// patterns were checked in Create
+			if ok, _ := path.Match(p, rel); ok {
+				return true
+			}
+			if ok, _ := path.Match(p, path.Base(rel)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if match(opts.Exclude) {
+		return false
+	}
+	return len(opts.Include) == 0 || match(opts.Include)
+}
+
+// autoPieceLength picks the smallest power of two piece length that keeps
+// the piece count near targetPieceCount.
+func autoPieceLength(length int) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && length/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// hashFiles hashes the concatenated files of the given total length. Pieces
+// are read in order and hashed by workers.
+func hashFiles(sources []fileSource, length, pieceLength, workers int) ([][20]byte, error) {
+	type job struct {
+		index int
+		data  []byte
+	}
+	jobs := make(chan job, workers)
+	// every worker writes other indices, so hashes needs no lock
+	hashes := make([][20]byte, (length+pieceLength-1)/pieceLength)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				hashes[j.index] = sha1.Sum(j.data)
+			}
+		}()
+	}
+
+	read, err := readPieces(sources, pieceLength, func(index int, data []byte) {
+		// a grown file is detected by the length check below
+		if index < len(hashes) {
+			jobs <- job{index: index, data: data}
+		}
+	})
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if read != length {
+		return nil, fmt.Errorf("files changed while hashing, read %d of %d bytes", read, length)
+	}
+	return hashes, nil
+}
+
+// readPieces reads the files as one stream and passes every piece to fn.
+// It returns the number of bytes read.
+func readPieces(sources []fileSource, pieceLength int, fn func(index int, data []byte)) (int, error) {
+	total, index := 0, 0
+	piece := make([]byte, 0, pieceLength)
+	for _, src := range sources {
+		var f io.ReadCloser = io.NopCloser(io.LimitReader(zeros{}, int64(src.pad)))
+		if src.path != "" {
+			var err error
+			if f, err = os.Open(src.path); err != nil {
+				return total, err
+			}
+		}
+		for {
+			n, err := io.ReadFull(f, piece[len(piece):pieceLength])
+			piece = piece[:len(piece)+n]
+			total += n
+			if len(piece) == pieceLength {
+				fn(index, piece)
+				index++
+				piece = make([]byte, 0, pieceLength)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				f.Close() //nolint:errcheck
+				return total, err
+			}
+		}
+		f.Close() //nolint:errcheck
+	}
+	if len(piece) > 0 {
+		fn(index, piece)
+	}
+	return total, nil
+}
+
+// zeros reads an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,207 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCreateDirectory(t *testing.T) {
+	t.Parallel()
+	root := filepath.Join(t.TempDir(), "release")
+	a := string(bytes.Repeat([]byte("a"), 20000))
+	b := string(bytes.Repeat([]byte("b"), 30000))
+	writeFiles(t, root, map[string]string{
+		"a.bin":        a,
+		"sub/b.bin":    b,
+		"sub/skip.tmp": "temporary",
+		"notes.txt":    "not included",
+	})
+
+	opts := CreateOptions{
+		AnnounceList: [][]string{{"http://t1/announce", "http://t2/announce"}, {"http://backup/announce"}},
+		WebSeeds:     []string{"http://seed/files/"},
+		Comment:      "nightly build",
+		CreatedBy:    "torrent test",
+		CreationDate: time.Unix(1700000000, 0),
+		Private:      true,
+		Source:       "INTERNAL",
+		Include:      []string{"*.bin", "*.tmp"},
+		Exclude:      []string{"sub/*.tmp"},
+		Workers:      3,
+	}
+	created, err := Create(root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "release.torrent")
+	if err := created.WriteTorrentFile(path); err != nil {
+		t.Fatal(err)
+	}
+	tMeta, err := ParseTorrentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tMeta.InfoHash != created.InfoHash {
+		t.Errorf("info hash changed after writing")
+	}
+	if tMeta.Announce != "http://t1/announce" || !reflect.DeepEqual(opts.AnnounceList, tMeta.AnnounceList) {
+		t.Errorf("announce %q, announce-list %q", tMeta.Announce, tMeta.AnnounceList)
+	}
+	if !reflect.DeepEqual(opts.WebSeeds, tMeta.URLList) {
+		t.Errorf("URLList %q", tMeta.URLList)
+	}
+	if tMeta.Comment != opts.Comment || tMeta.CreatedBy != opts.CreatedBy || !tMeta.CreationDate.Equal(opts.CreationDate) {
+		t.Errorf("comment %q, created by %q, date %v", tMeta.Comment, tMeta.CreatedBy, tMeta.CreationDate)
+	}
+	if !tMeta.Private || tMeta.Source != "INTERNAL" {
+		t.Errorf("private %v, source %q", tMeta.Private, tMeta.Source)
+	}
+
+	expected := []FileInfo{
+		{Path: []string{"release", "a.bin"}, Length: len(a), Offset: 0},
+		{Path: []string{"release", "sub", "b.bin"}, Length: len(b), Offset: len(a)},
+	}
+	if !reflect.DeepEqual(expected, tMeta.Files) {
+		t.Errorf("Files %v != %v", tMeta.Files, expected)
+	}
+
+	data := []byte(a + b)
+	if tMeta.PieceLength != minPieceLength || tMeta.Length != len(data) {
+		t.Fatalf("piece length %d, length %d", tMeta.PieceLength, tMeta.Length)
+	}
+	for i, h := range tMeta.PieceHashes {
+		piece := data[i*minPieceLength : min((i+1)*minPieceLength, len(data))]
+		if h != sha1.Sum(piece) {
+			t.Errorf("piece %d hash mismatch", i)
+		}
+	}
+	if len(tMeta.PieceHashes) != 4 {
+		t.Errorf("%d pieces != 4", len(tMeta.PieceHashes))
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"file.iso": "content"})
+
+	tMeta, err := Create(filepath.Join(dir, "file.iso"), CreateOptions{PieceLength: 32 * 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tMeta.Name != "file.iso" || tMeta.Length != 7 || len(tMeta.PieceHashes) != 1 {
+		t.Errorf("name %q, length %d, %d pieces", tMeta.Name, tMeta.Length, len(tMeta.PieceHashes))
+	}
+
+	encoded, err := tMeta.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(encoded, []byte("6:lengthi7e")) || bytes.Contains(encoded, []byte("5:files")) {
+		t.Errorf("single file torrent must use length instead of files: %q", encoded)
+	}
+}
+
+func TestCreatePadFiles(t *testing.T) {
+	t.Parallel()
+	root := filepath.Join(t.TempDir(), "padded")
+	a := string(bytes.Repeat([]byte("a"), 20000))
+	b := string(bytes.Repeat([]byte("b"), 16384))
+	writeFiles(t, root, map[string]string{"a": a, "b": b, "c": "c"})
+
+	tMeta, err := Create(root, CreateOptions{PieceLength: 16384, PadFiles: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FileInfo{
+		{Path: []string{"padded", "a"}, Length: 20000, Offset: 0},
+		{Path: []string{"padded", ".pad", "12768"}, Length: 12768, Offset: 20000, Attr: "p"},
+		{Path: []string{"padded", "b"}, Length: 16384, Offset: 32768},
+		{Path: []string{"padded", "c"}, Length: 1, Offset: 49152},
+	}
+	if !reflect.DeepEqual(expected, tMeta.Files) {
+		t.Errorf("%+v != %+v", tMeta.Files, expected)
+	}
+
+	stream := a + string(make([]byte, 12768)) + b + "c"
+	if tMeta.Length != len(stream) || len(tMeta.PieceHashes) != 4 {
+		t.Fatalf("length %d, %d pieces", tMeta.Length, len(tMeta.PieceHashes))
+	}
+	for i := range tMeta.PieceHashes {
+		if tMeta.PieceHashes[i] != sha1.Sum([]byte(stream[i*16384:min((i+1)*16384, len(stream))])) {
+			t.Errorf("piece %d hash mismatch", i)
+		}
+	}
+}
+
+func TestCreateWorkingDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "current")
+	writeFiles(t, dir, map[string]string{"a.txt": "a"})
+	t.Chdir(dir)
+
+	tMeta, err := Create(".", CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tMeta.Name != "current" || !reflect.DeepEqual(tMeta.Files[0].Path, []string{"current", "a.txt"}) {
+		t.Errorf("name %q, path %q", tMeta.Name, tMeta.Files[0].Path)
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"a.txt": "a"})
+
+	if _, err := Create(dir, CreateOptions{Exclude: []string{"*"}}); !errors.Is(err, ErrNoFiles) {
+		t.Errorf("all files excluded: %v", err)
+	}
+	if _, err := Create(dir, CreateOptions{Include: []string{"["}}); err == nil {
+		t.Errorf("malformed pattern must fail")
+	}
+	if _, err := Create(dir, CreateOptions{PieceLength: 20000}); err == nil {
+		t.Errorf("piece length that is not a power of two must fail")
+	}
+	if _, err := Create(dir, CreateOptions{Name: ".."}); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("unsafe name: %v", err)
+	}
+}
+
+func TestAutoPieceLength(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		length int
+		want   int
+	}{
+		{length: 1, want: minPieceLength},
+		{length: targetPieceCount * minPieceLength, want: minPieceLength},
+		{length: 700 << 20, want: 512 << 10},
+		{length: 1 << 40, want: maxPieceLength},
+	}
+	for _, tst := range tests {
+		if got := autoPieceLength(tst.length); got != tst.want {
+			t.Errorf("autoPieceLength(%d) = %d, want %d", tst.length, got, tst.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrNoInfo = errors.New("torrent has no info dictionary")
+
+// TorrentFile is a torrent file opened for editing the keys outside of the
+// info dictionary. All keys keep their raw bytes and order, so Encode
+// returns the file unchanged apart from the edited keys and the info hash
+// stays the same.
+type TorrentFile struct {
+	entries []rawEntry
+}
+
+// OpenTorrentFile reads the torrent file at path for editing.
+func OpenTorrentFile(path string) (*TorrentFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := DecodeTorrentFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("torrent file (%s): %w", path, err)
+	}
+	return tf, nil
+}
+
+// DecodeTorrentFile parses a bencoded torrent for editing.
+func DecodeTorrentFile(data []byte) (*TorrentFile, error) {
+	entries, err := rawDictEntries(data)
+	if err != nil {
+		return nil, err
+	}
+	tf := &TorrentFile{entries: entries}
+	if tf.raw("info") == nil {
+		return nil, ErrNoInfo
+	}
+	return tf, nil
+}
+
+// InfoHash returns the SHA-1 hash of the unchanged info dictionary.
+func (tf *TorrentFile) InfoHash() [20]byte {
+	return sha1.Sum(tf.raw("info"))
+}
+
+// Announce returns the tracker URL, empty when missing or malformed.
+func (tf *TorrentFile) Announce() string {
+	s, _ := decodeString(tf.raw("announce"))
+	return s
+}
+
+// SetAnnounce replaces the tracker URL, an empty URL removes the key.
+func (tf *TorrentFile) SetAnnounce(url string) {
+	tf.set("announce", url, url == "")
+}
+
+// AnnounceList returns the tracker tiers (BEP 12).
+func (tf *TorrentFile) AnnounceList() [][]string {
+	value, err := decodeValue(tf.raw("announce-list"))
+	if err != nil {
+		return nil
+	}
+	tiers, _ := value.([]any)
+	list := [][]string{}
+	for _, tier := range tiers {
+		urls, _ := tier.([]any)
+		t := []string{}
+		for _, u := range urls {
+			if u, ok := u.(string); ok {
+				t = append(t, u)
+			}
+		}
+		list = append(list, t)
+	}
+	return list
+}
+
+// SetAnnounceList replaces the tracker tiers, an empty list removes the key.
+func (tf *TorrentFile) SetAnnounceList(tiers [][]string) {
+	list := make([]any, len(tiers))
+	for i, tier := range tiers {
+		list[i] = tier
+	}
+	tf.set("announce-list", list, len(tiers) == 0)
+}
+
+// Comment returns the comment, empty when missing or malformed.
+func (tf *TorrentFile) Comment() string {
+	s, _ := decodeString(tf.raw("comment"))
+	return s
+}
+
+// SetComment replaces the comment, an empty comment removes the key.
+func (tf *TorrentFile) SetComment(comment string) {
+	tf.set("comment", comment, comment == "")
+}
+
+// URLList returns the web seed URLs (BEP 19).
+func (tf *TorrentFile) URLList() []string {
+	urls, _ := decodeStringList(tf.raw("url-list"))
+	return urls
+}
+
+// SetURLList replaces the web seed URLs, an empty list removes the key.
+func (tf *TorrentFile) SetURLList(urls []string) {
+	tf.set("url-list", urls, len(urls) == 0)
+}
+
+// Encode returns the bencoded torrent file.
+func (tf *TorrentFile) Encode() []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('d')
+	for _, e := range tf.entries {
+		fmt.Fprintf(&buf, "%d:%s", len(e.key), e.key)
+		buf.Write(e.value)
+	}
+	buf.WriteByte('e')
+	return buf.Bytes()
+}
+
+// WriteFile writes the bencoded torrent to path.
+func (tf *TorrentFile) WriteFile(path string) error {
+	return os.WriteFile(path, tf.Encode(), 0o644)
+}
+
+// raw returns the raw value of key, nil when missing.
+func (tf *TorrentFile) raw(key string) []byte {
+	for _, e := range tf.entries {
+		if e.key == key {
+			return e.value
+		}
+	}
+	return nil
+}
+
+// set replaces the value of key in place or removes it. A new key is
+// inserted in sorted position, the order bencode requires.
+func (tf *TorrentFile) set(key string, value any, remove bool) {
+	i := 0
+	for i < len(tf.entries) && tf.entries[i].key != key {
+		i++
+	}
+	if remove {
+		if i < len(tf.entries) {
+			tf.entries = append(tf.entries[:i], tf.entries[i+1:]...)
+		}
+		return
+	}
+
+	// only strings and lists of strings are set, they always encode
+	raw, _ := encodeValue(value)
+	if i < len(tf.entries) {
+		tf.entries[i].value = raw
+		return
+	}
+	i = 0
+	for i < len(tf.entries) && tf.entries[i].key < key {
+		i++
+	}
+	tf.entries = append(tf.entries[:i], append([]rawEntry{{key: key, value: raw}}, tf.entries[i:]...)...)
+}
@@ -0,0 +1,69 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEditTorrentFile(t *testing.T) {
+	t.Parallel()
+	info := "d6:lengthi4e4:name4:test12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "e"
+	// an unknown key and a non canonical key order must survive
+	torrent := "d8:announce10:http://old7:comment3:old4:info" + info + "5:x-tagi7e8:url-list10:http://webe"
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(path, []byte(torrent), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tf, err := OpenTorrentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tf.Encode(), []byte(torrent)) {
+		t.Fatalf("unchanged torrent %s != %s", tf.Encode(), torrent)
+	}
+	if tf.Announce() != "http://old" || tf.Comment() != "old" || !reflect.DeepEqual(tf.URLList(), []string{"http://web"}) {
+		t.Errorf("outer keys %q %q %q", tf.Announce(), tf.Comment(), tf.URLList())
+	}
+	if tf.InfoHash() != sha1.Sum([]byte(info)) {
+		t.Error("info hash must be calculated from raw info dictionary")
+	}
+
+	tf.SetAnnounce("http://new")
+	tf.SetAnnounceList([][]string{{"http://new", "http://backup"}, {"udp://other"}})
+	tf.SetComment("")
+	tf.SetURLList([]string{"http://a", "http://b"})
+	expected := "d8:announce10:http://new13:announce-listll10:http://new13:http://backupel11:udp://otheree" +
+		"4:info" + info + "5:x-tagi7e8:url-listl8:http://a8:http://bee"
+	if !bytes.Equal(tf.Encode(), []byte(expected)) {
+		t.Fatalf("edited torrent %s != %s", tf.Encode(), expected)
+	}
+	if !reflect.DeepEqual(tf.AnnounceList(), [][]string{{"http://new", "http://backup"}, {"udp://other"}}) {
+		t.Errorf("AnnounceList %q", tf.AnnounceList())
+	}
+
+	if err := tf.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	tMeta, err := ParseTorrentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tMeta.InfoHash != sha1.Sum([]byte(info)) || tMeta.Announce != "http://new" || tMeta.Comment != "" {
+		t.Errorf("edited torrent parsed as %+v", tMeta)
+	}
+}
+
+func TestDecodeTorrentFileErrors(t *testing.T) {
+	t.Parallel()
+	for _, data := range []string{"", "l4:infoe", "d7:comment1:xe", "d4:infodeex", "d4:info"} {
+		if _, err := DecodeTorrentFile([]byte(data)); err == nil {
+			t.Errorf("%q must fail", data)
+		}
+	}
+}
@@ -1,11 +1,13 @@
 package metadata
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/lksndrttm/bencode"
 )
@@ -41,39 +43,159 @@ func GenerateTorrent(source io.Reader, announce string, name string, pieceLength
 
 	bt.Info.Pieces = string(pieceHashes)
 
-	return bt.toTorrentFile()
+	rawInfo, err := encodeValue(map[string]any{
+		"length":       bt.Info.Length,
+		"name":         bt.Info.Name,
+		"piece length": bt.Info.PieceLength,
+		"pieces":       bt.Info.Pieces,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bt.toTorrentFile(rawInfo)
 }
 
 func ParseTorrentFile(pathToTorrentFile string) (*TorrentMetadata, error) {
-	file, err := os.Open(pathToTorrentFile)
+	data, err := os.ReadFile(pathToTorrentFile)
 	if err != nil {
 		return nil, fmt.Errorf("torrent file (%s) parse error: %w", pathToTorrentFile, err)
 	}
 
 	bt := bencodeTorrent{}
-	err = bencode.Unmarshal(&bt, file)
+	err = bencode.Unmarshal(&bt, bytes.NewReader(data))
 	if err != nil {
 		return nil, fmt.Errorf("unmarshaling torrent file (%s) data error: %w", pathToTorrentFile, err)
 	}
 
-	tmeta, err := bt.toTorrentFile()
+	rawInfo, err := rawDictValue(data, "info")
+	if err != nil {
+		return nil, fmt.Errorf("torrent file (%s) info dictionary error: %w", pathToTorrentFile, err)
+	}
+
+	tmeta, err := bt.toTorrentFile(rawInfo)
 	if err != nil {
 		return nil, fmt.Errorf("bencodeTorrent to TorrentMetadata conversion error: %w", err)
 	}
 
+	// url-list is a string or a list of strings, so it is not in bencodeTorrent
+	if rawURLs, err := rawDictValue(data, "url-list"); err == nil {
+		urls, err := decodeStringList(rawURLs)
+		if err != nil {
+			return nil, fmt.Errorf("torrent file (%s) url-list error: %w", pathToTorrentFile, err)
+		}
+		for _, u := range urls {
+			if u != "" {
+				tmeta.URLList = append(tmeta.URLList, u)
+			}
+		}
+	}
+
+	switch bt.Info.MetaVersion {
+	case 0, 1:
+	case 2:
+		rawLayers, _ := rawDictValue(data, "piece layers")
+		if err := tmeta.parseV2(rawLayers); err != nil {
+			return nil, fmt.Errorf("torrent file (%s) v2 metadata error: %w", pathToTorrentFile, err)
+		}
+	default:
+		return nil, fmt.Errorf("torrent file (%s) has unsupported meta version %d", pathToTorrentFile, bt.Info.MetaVersion)
+	}
+
+	problems := tmeta.problems()
+	// trailing bytes of pieces are dropped by toTorrentFile
+	if len(bt.Info.Pieces)%20 != 0 {
+		problems = append(ValidationErrors{{
+			Field: "info.pieces",
+			Err:   ErrPieces,
+			Msg:   fmt.Sprintf("length %d is not a multiple of 20", len(bt.Info.Pieces)),
+		}}, problems...)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("torrent file (%s) is invalid: %w", pathToTorrentFile, problems)
+	}
+
 	return tmeta, nil
 }
 
+type bencodeFile struct {
+	Length      int      `bencode:"length"`
+	Path        []string `bencode:"path"`
+	Attr        string   `bencode:"attr"`
+	SymlinkPath []string `bencode:"symlink path"`
+	SHA1        string   `bencode:"sha1"`
+}
+
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length"`
+	Name        string        `bencode:"name"`
+	Files       []bencodeFile `bencode:"files"`
+	Private     int           `bencode:"private"`
+	Source      string        `bencode:"source"`
+	MetaVersion int           `bencode:"meta version"`
+	Attr        string        `bencode:"attr"`
+	SymlinkPath []string      `bencode:"symlink path"`
+	SHA1        string        `bencode:"sha1"`
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list"`
+	Comment      string      `bencode:"comment"`
+	CreatedBy    string      `bencode:"created by"`
+	CreationDate int         `bencode:"creation date"`
+	Info         bencodeInfo `bencode:"info"`
+}
+
+// FileInfo describes a single file of the torrent. Path starts with the
+// torrent name for multi-file torrents, Offset is the position of the first
+// file byte in the torrent byte stream.
+type FileInfo struct {
+	Path   []string
+	Length int
+	Offset int
+	// PiecesRoot is the merkle root of a v2 file, zero for empty files.
+	PiecesRoot [32]byte
+	// Attr holds the BEP 47 attributes: p for pad files, x for executable,
+	// h for hidden files and l for symlinks.
+	Attr string
+	// SymlinkPath is the link target relative to the torrent root.
+	SymlinkPath []string
+	// SHA1 is the optional hash of the whole file, zero when missing.
+	SHA1 [20]byte
+}
+
+// IsPad reports whether the file only aligns the next file to a piece
+// boundary. Pad files are zeros and never stored.
+func (f FileInfo) IsPad() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+func (f FileInfo) IsExecutable() bool {
+	return strings.Contains(f.Attr, "x")
+}
+
+func (f FileInfo) IsHidden() bool {
+	return strings.Contains(f.Attr, "h")
+}
+
+func (f FileInfo) IsSymlink() bool {
+	return strings.Contains(f.Attr, "l")
+}
+
+// fileAttrs adds the attribute keys of f to a file dictionary.
+func (f FileInfo) fileAttrs(dict map[string]any) {
+	if f.Attr != "" {
+		dict["attr"] = f.Attr
+	}
+	if f.IsSymlink() {
+		dict["symlink path"] = f.SymlinkPath
+	}
+	if f.SHA1 != [20]byte{} {
+		dict["sha1"] = f.SHA1[:]
+	}
 }
 
 type TorrentMetadata struct {
@@ -83,48 +205,167 @@ type TorrentMetadata struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Files       []FileInfo
+	// URLList holds the web seed URLs (BEP 19).
+	URLList []string
+	// AnnounceList holds tiers of tracker URLs (BEP 12).
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	// CreationDate is zero when the torrent does not have one.
+	CreationDate time.Time
+	// Private and Source are part of the info dictionary, so they change
+	// the info hash.
+	Private bool
+	Source  string
+	// InfoHashV2 is the SHA-256 info hash of v2 and hybrid torrents (BEP 52),
+	// zero for v1 torrents. InfoHash of a pure v2 torrent is its truncation.
+	InfoHashV2 [32]byte
+	// PieceLayers maps the pieces root of every v2 file longer than a piece
+	// to the hashes of its pieces.
+	PieceLayers map[[32]byte][][32]byte
+
+	// rawInfo is the bencoded info dictionary the info hash is computed from
+	rawInfo []byte
 }
 
-func (tm *TorrentMetadata) toBencodeTorrent() (*bencodeTorrent, error) {
-	bInfo := bencodeInfo{
-		PieceLength: tm.PieceLength,
-		Length:      tm.Length,
-		Name:        tm.Name,
+// infoDict builds the info dictionary from the metadata fields.
+func (tm *TorrentMetadata) infoDict() map[string]any {
+	pieces := make([]byte, 0, len(tm.PieceHashes)*20)
+	for _, h := range tm.PieceHashes {
+		pieces = append(pieces, h[:]...)
 	}
-	bTorrent := bencodeTorrent{
-		Announce: tm.Announce,
-		Info:     bInfo,
+	info := map[string]any{
+		"name":         tm.Name,
+		"piece length": tm.PieceLength,
+		"pieces":       pieces,
 	}
+	if len(tm.Files) == 0 || (len(tm.Files) == 1 && len(tm.Files[0].Path) == 1) {
+		info["length"] = tm.Length
+		if len(tm.Files) == 1 {
+			tm.Files[0].fileAttrs(info)
+		}
+	} else {
+		files := make([]any, len(tm.Files))
+		for i, f := range tm.Files {
+			file := map[string]any{"length": f.Length, "path": f.Path[1:]}
+			f.fileAttrs(file)
+			files[i] = file
+		}
+		info["files"] = files
+	}
+	if tm.Private {
+		info["private"] = 1
+	}
+	if tm.Source != "" {
+		info["source"] = tm.Source
+	}
+	return info
+}
 
-	piecesByte := []byte{}
-
-	for _, v := range tm.PieceHashes {
-		piecesByte = append(piecesByte, v[:]...)
+// Encode returns the bencoded torrent file. A parsed info dictionary is
+// written unchanged, so the info hash stays the same.
+func (tm *TorrentMetadata) Encode() ([]byte, error) {
+	rawInfo := tm.rawInfo
+	if rawInfo == nil {
+		var err error
+		if rawInfo, err = encodeValue(tm.infoDict()); err != nil {
+			return nil, err
+		}
 	}
-	pieces := string(piecesByte)
 
-	bTorrent.Info.Pieces = pieces
+	torrent := map[string]any{"info": rawValue(rawInfo)}
+	if tm.Announce != "" {
+		torrent["announce"] = tm.Announce
+	}
+	if len(tm.AnnounceList) > 0 {
+		tiers := make([]any, len(tm.AnnounceList))
+		for i, tier := range tm.AnnounceList {
+			tiers[i] = tier
+		}
+		torrent["announce-list"] = tiers
+	}
+	if len(tm.URLList) > 0 {
+		torrent["url-list"] = tm.URLList
+	}
+	if tm.Comment != "" {
+		torrent["comment"] = tm.Comment
+	}
+	if tm.CreatedBy != "" {
+		torrent["created by"] = tm.CreatedBy
+	}
+	if !tm.CreationDate.IsZero() {
+		torrent["creation date"] = tm.CreationDate.Unix()
+	}
+	if len(tm.PieceLayers) > 0 {
+		layers := make(map[string]any, len(tm.PieceLayers))
+		for root, layer := range tm.PieceLayers {
+			concat := make([]byte, 0, len(layer)*32)
+			for _, h := range layer {
+				concat = append(concat, h[:]...)
+			}
+			layers[string(root[:])] = concat
+		}
+		torrent["piece layers"] = layers
+	}
+	return encodeValue(torrent)
+}
 
-	return &bTorrent, nil
+// WriteTorrentFile writes the bencoded torrent to path.
+func (tm *TorrentMetadata) WriteTorrentFile(path string) error {
+	data, err := tm.Encode()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
 }
 
-func (bt *bencodeTorrent) toTorrentFile() (*TorrentMetadata, error) {
+func (bt *bencodeTorrent) toTorrentFile(rawInfo []byte) (*TorrentMetadata, error) {
 	t := TorrentMetadata{
-		Announce:    bt.Announce,
-		PieceLength: bt.Info.PieceLength,
-		Length:      bt.Info.Length,
-		Name:        bt.Info.Name,
+		Announce:     bt.Announce,
+		PieceLength:  bt.Info.PieceLength,
+		Length:       bt.Info.Length,
+		Name:         bt.Info.Name,
+		AnnounceList: bt.AnnounceList,
+		Comment:      bt.Comment,
+		CreatedBy:    bt.CreatedBy,
+		Private:      bt.Info.Private == 1,
+		Source:       bt.Info.Source,
+		rawInfo:      rawInfo,
 	}
-	info, err := bencode.Marshal(&bt.Info)
-	if err != nil {
-		return &t, err
+	if bt.CreationDate != 0 {
+		t.CreationDate = time.Unix(int64(bt.CreationDate), 0)
 	}
 
 	hasher := sha1.New()
-	hasher.Write(info)
+	hasher.Write(rawInfo)
 
 	t.InfoHash = [20]byte(hasher.Sum(nil))
 
+	if len(bt.Info.Files) == 0 {
+		t.Files = []FileInfo{{
+			Path:        []string{bt.Info.Name},
+			Length:      bt.Info.Length,
+			Attr:        bt.Info.Attr,
+			SymlinkPath: bt.Info.SymlinkPath,
+			SHA1:        fileSHA1(bt.Info.SHA1),
+		}}
+	} else {
+		t.Length = 0
+		for _, f := range bt.Info.Files {
+			path := append([]string{bt.Info.Name}, f.Path...)
+			t.Files = append(t.Files, FileInfo{
+				Path:        path,
+				Length:      f.Length,
+				Offset:      t.Length,
+				Attr:        f.Attr,
+				SymlinkPath: f.SymlinkPath,
+				SHA1:        fileSHA1(f.SHA1),
+			})
+			t.Length += f.Length
+		}
+	}
+
 	reader := strings.NewReader(bt.Info.Pieces)
 	var pieceHash [20]byte
 	for {
@@ -137,3 +378,11 @@ func (bt *bencodeTorrent) toTorrentFile() (*TorrentMetadata, error) {
 
 	return &t, nil
 }
+
+// fileSHA1 converts the optional per-file hash, other lengths are ignored.
+func fileSHA1(s string) [20]byte {
+	if len(s) != 20 {
+		return [20]byte{}
+	}
+	return [20]byte([]byte(s))
+}
@@ -1,7 +1,11 @@
 package metadata
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
 	"slices"
 	"strings"
 	"testing"
@@ -31,3 +35,114 @@ func TestGenerateTorrentPieceHashes(t *testing.T) {
 		}
 	}
 }
+
+func TestParseMultiFileTorrent(t *testing.T) {
+	t.Parallel()
+	info := "d5:filesld6:lengthi3e4:pathl1:aeed6:lengthi5e4:pathl3:dir1:beee4:name5:multi12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "e"
+	torrent := "d8:announce4:test4:info" + info + "e"
+
+	path := filepath.Join(t.TempDir(), "multi.torrent")
+	if err := os.WriteFile(path, []byte(torrent), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tMeta, err := ParseTorrentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tMeta.InfoHash != sha1.Sum([]byte(info)) {
+		t.Errorf("info hash must be calculated from raw info dictionary")
+	}
+	if tMeta.Length != 8 {
+		t.Errorf("Length %d != 8", tMeta.Length)
+	}
+	expected := []FileInfo{
+		{Path: []string{"multi", "a"}, Length: 3, Offset: 0},
+		{Path: []string{"multi", "dir", "b"}, Length: 5, Offset: 3},
+	}
+	if !reflect.DeepEqual(expected, tMeta.Files) {
+		t.Errorf("%+v != %+v", expected, tMeta.Files)
+	}
+}
+
+func TestParseURLList(t *testing.T) {
+	t.Parallel()
+	info := "d6:lengthi4e4:name4:test12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "e"
+	tests := []struct {
+		name    string
+		urlList string
+		want    []string
+		fails   bool
+	}{
+		{name: "missing"},
+		{name: "string", urlList: "8:url-list17:http://host/path/", want: []string{"http://host/path/"}},
+		{name: "list", urlList: "8:url-listl13:http://a/test0:13:http://b/teste", want: []string{"http://a/test", "http://b/test"}},
+		{name: "malformed", urlList: "8:url-listli1ee", fails: true},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			t.Parallel()
+			path := filepath.Join(t.TempDir(), "test.torrent")
+			torrent := "d8:announce4:test4:info" + info + tst.urlList + "e"
+			if err := os.WriteFile(path, []byte(torrent), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			tMeta, err := ParseTorrentFile(path)
+			if tst.fails {
+				if err == nil {
+					t.Fatal("malformed url-list must fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tst.want, tMeta.URLList) {
+				t.Errorf("URLList %q != %q", tMeta.URLList, tst.want)
+			}
+		})
+	}
+}
+
+func TestParseFileAttributes(t *testing.T) {
+	t.Parallel()
+	sum := sha1.Sum([]byte("abc"))
+	files := "ld6:lengthi3e4:pathl1:ae4:sha120:" + string(sum[:]) + "e" +
+		"d4:attr1:p6:lengthi1e4:pathl4:.pad1:1ee" +
+		"d4:attr2:xh6:lengthi4e4:pathl1:bee" +
+		"d4:attr1:l6:lengthi0e4:pathl4:linke12:symlink pathl1:aeee"
+	info := "d5:files" + files + "4:name5:attrs12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "e"
+	path := filepath.Join(t.TempDir(), "attrs.torrent")
+	if err := os.WriteFile(path, []byte("d8:announce4:test4:info"+info+"e"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tMeta, err := ParseTorrentFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []FileInfo{
+		{Path: []string{"attrs", "a"}, Length: 3, Offset: 0, SHA1: sum},
+		{Path: []string{"attrs", ".pad", "1"}, Length: 1, Offset: 3, Attr: "p"},
+		{Path: []string{"attrs", "b"}, Length: 4, Offset: 4, Attr: "xh"},
+		{Path: []string{"attrs", "link"}, Length: 0, Offset: 8, Attr: "l", SymlinkPath: []string{"a"}},
+	}
+	if !reflect.DeepEqual(expected, tMeta.Files) {
+		t.Errorf("%+v != %+v", tMeta.Files, expected)
+	}
+	if !tMeta.Files[1].IsPad() || !tMeta.Files[2].IsExecutable() || !tMeta.Files[2].IsHidden() || !tMeta.Files[3].IsSymlink() {
+		t.Error("attributes not reported")
+	}
+
+	// attributes survive encoding the info dictionary again
+	tMeta.rawInfo = nil
+	data, err := tMeta.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(info)) {
+		t.Errorf("encoded info %s != %s", data, info)
+	}
+}
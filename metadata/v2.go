@@ -0,0 +1,241 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/lksndrttm/torrent/merkle"
+)
+
+var errMalformedV2 = errors.New("malformed v2 metadata")
+
+// parseV2 adds the BitTorrent v2 data (BEP 52) of a torrent with meta
+// version 2. Files are laid out piece aligned like in hybrid torrents, the
+// gaps stand for padding that is never stored.
+func (tm *TorrentMetadata) parseV2(rawLayers []byte) error {
+	value, err := decodeValue(tm.rawInfo)
+	if err != nil {
+		return err
+	}
+	info := value.(map[string]any)
+	tree, ok := info["file tree"].(map[string]any)
+	if !ok {
+		return fmt.Errorf("%w: file tree missing", errMalformedV2)
+	}
+	if tm.PieceLength < merkle.BlockSize || tm.PieceLength&(tm.PieceLength-1) != 0 {
+		return fmt.Errorf("%w: piece length %d is not a power of two of at least 16 KiB", errMalformedV2, tm.PieceLength)
+	}
+
+	files := []FileInfo{}
+	if err := walkFileTree(tree, nil, &files); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("%w: empty file tree", errMalformedV2)
+	}
+	single := len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == tm.Name
+	offset := 0
+	for i := range files {
+		if !single {
+			files[i].Path = append([]string{tm.Name}, files[i].Path...)
+		}
+		if files[i].Length > 0 {
+			offset = (offset + tm.PieceLength - 1) / tm.PieceLength * tm.PieceLength
+		}
+		files[i].Offset = offset
+		offset += files[i].Length
+	}
+
+	if tm.HasV1() {
+		// the pad files of the v1 part make both layouts the same
+		if offset > tm.Length {
+			return fmt.Errorf("%w: v1 length %d shorter than v2 layout %d", errMalformedV2, tm.Length, offset)
+		}
+	} else {
+		tm.Length = offset
+	}
+	tm.Files = files
+
+	tm.PieceLayers = map[[32]byte][][32]byte{}
+	if rawLayers != nil {
+		value, err := decodeValue(rawLayers)
+		if err != nil {
+			return err
+		}
+		layers, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%w: piece layers is not a dictionary", errMalformedV2)
+		}
+		for root, hashes := range layers {
+			concat, ok := hashes.(string)
+			if len(root) != 32 || !ok || len(concat)%32 != 0 {
+				return fmt.Errorf("%w: piece layer %x", errMalformedV2, root)
+			}
+			layer := make([][32]byte, len(concat)/32)
+			for i := range layer {
+				copy(layer[i][:], concat[i*32:])
+			}
+			tm.PieceLayers[[32]byte([]byte(root))] = layer
+		}
+	}
+	for _, f := range tm.Files {
+		if err := tm.checkPieceLayer(f); err != nil {
+			return err
+		}
+	}
+
+	tm.InfoHashV2 = sha256.Sum256(tm.rawInfo)
+	if !tm.HasV1() {
+		tm.InfoHash = [20]byte(tm.InfoHashV2[:20])
+	}
+	return nil
+}
+
+// checkPieceLayer verifies the piece layer of a file against its pieces
+// root. A missing layer is not a parse error, but layers are not fetched
+// from peers, so such a torrent can not be downloaded.
+func (tm *TorrentMetadata) checkPieceLayer(f FileInfo) error {
+	layer, ok := tm.PieceLayers[f.PiecesRoot]
+	if !ok || f.Length <= tm.PieceLength {
+		return nil
+	}
+	pieces := (f.Length + tm.PieceLength - 1) / tm.PieceLength
+	pad := merkle.PadHash(merkle.Height(tm.PieceLength / merkle.BlockSize))
+	if len(layer) != pieces || merkle.Root(layer, merkle.Width(pieces), pad) != f.PiecesRoot {
+		return fmt.Errorf("%w: piece layer of file %q does not match its pieces root", errMalformedV2, f.Path)
+	}
+	return nil
+}
+
+// walkFileTree appends the files of the tree in key order. A file is a
+// dictionary with an empty key holding its length and pieces root.
+func walkFileTree(tree map[string]any, path []string, files *[]FileInfo) error {
+	keys := make([]string, 0, len(tree))
+	for k := range tree {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		node, ok := tree[k].(map[string]any)
+		if !ok {
+			return fmt.Errorf("%w: file tree entry %q", errMalformedV2, k)
+		}
+		if k != "" {
+			if err := walkFileTree(node, append(slices.Clone(path), k), files); err != nil {
+				return err
+			}
+			continue
+		}
+
+		length, ok := node["length"].(int)
+		if !ok || length < 0 || len(path) == 0 {
+			return fmt.Errorf("%w: file %q", errMalformedV2, path)
+		}
+		f := FileInfo{Path: path, Length: length}
+		f.Attr, _ = node["attr"].(string)
+		if target, ok := node["symlink path"].([]any); ok {
+			for _, p := range target {
+				if p, ok := p.(string); ok {
+					f.SymlinkPath = append(f.SymlinkPath, p)
+				}
+			}
+		}
+		if length > 0 {
+			root, ok := node["pieces root"].(string)
+			if !ok || len(root) != 32 {
+				return fmt.Errorf("%w: pieces root of file %q", errMalformedV2, path)
+			}
+			f.PiecesRoot = [32]byte([]byte(root))
+		}
+		*files = append(*files, f)
+	}
+	return nil
+}
+
+// HasV1 reports whether the torrent has v1 piece hashes.
+func (tm *TorrentMetadata) HasV1() bool {
+	return len(tm.PieceHashes) > 0
+}
+
+// HasV2 reports whether the torrent has v2 merkle trees, a hybrid torrent
+// has both.
+func (tm *TorrentMetadata) HasV2() bool {
+	return tm.InfoHashV2 != [32]byte{}
+}
+
+// PieceCount returns the number of pieces.
+func (tm *TorrentMetadata) PieceCount() int {
+	if tm.PieceLength <= 0 {
+		return 0
+	}
+	return (tm.Length + tm.PieceLength - 1) / tm.PieceLength
+}
+
+// V2Piece describes the merkle subtree of a piece in a v2 file.
+type V2Piece struct {
+	// File is the index in Files, Index the piece index inside the file.
+	File  int
+	Index int
+	// Root is the piece layer hash, or the pieces root for files not longer
+	// than a piece.
+	Root [32]byte
+	// Width is the leaf count of the subtree.
+	Width int
+	// Length is the number of file bytes in the piece.
+	Length int
+}
+
+// V2Piece returns the merkle subtree of the piece. It reports false for v1
+// torrents and pieces without a known hash.
+func (tm *TorrentMetadata) V2Piece(index int) (V2Piece, bool) {
+	if !tm.HasV2() || index < 0 || index >= tm.PieceCount() {
+		return V2Piece{}, false
+	}
+	begin := index * tm.PieceLength
+	for i, f := range tm.Files {
+		if f.Length == 0 || begin < f.Offset || begin >= f.Offset+f.Length {
+			continue
+		}
+		p := V2Piece{
+			File:   i,
+			Index:  (begin - f.Offset) / tm.PieceLength,
+			Length: min(tm.PieceLength, f.Offset+f.Length-begin),
+		}
+		if f.Length <= tm.PieceLength {
+			p.Root = f.PiecesRoot
+			p.Width = merkle.Width((f.Length + merkle.BlockSize - 1) / merkle.BlockSize)
+			return p, true
+		}
+		layer := tm.PieceLayers[f.PiecesRoot]
+		if p.Index >= len(layer) {
+			return V2Piece{}, false
+		}
+		p.Root = layer[p.Index]
+		p.Width = tm.PieceLength / merkle.BlockSize
+		return p, true
+	}
+	return V2Piece{}, false
+}
+
+// VerifyPiece checks the piece data against the v1 hash and the v2 merkle
+// tree, a hybrid torrent must pass both.
+func (tm *TorrentMetadata) VerifyPiece(index int, data []byte) bool {
+	if index < 0 || index >= tm.PieceCount() {
+		return false
+	}
+	if tm.HasV1() && (index >= len(tm.PieceHashes) || sha1.Sum(data) != tm.PieceHashes[index]) {
+		return false
+	}
+	if !tm.HasV2() {
+		return true
+	}
+	p, ok := tm.V2Piece(index)
+	if !ok || len(data) < p.Length {
+		return false
+	}
+	return merkle.Root(merkle.BlockHashes(data[:p.Length]), p.Width, [32]byte{}) == p.Root
+}
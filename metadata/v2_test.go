@@ -0,0 +1,170 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/lksndrttm/torrent/merkle"
+)
+
+const v2PieceLength = 2 * merkle.BlockSize
+
+// v2Files returns the data of a file spanning two pieces and of a small one.
+func v2Files() (a, b []byte) {
+	a = make([]byte, 40000)
+	for i := range a {
+		a[i] = byte(i * 7)
+	}
+	return a, []byte("small file")
+}
+
+// writeV2Torrent writes a v2 torrent of v2Files, with v1 data and a pad file
+// when hybrid. It returns the path and the info dictionary.
+func writeV2Torrent(t *testing.T, hybrid bool, corruptLayer bool) (string, []byte) {
+	t.Helper()
+	a, b := v2Files()
+
+	var layer [][32]byte
+	for i := 0; i < len(a); i += v2PieceLength {
+		blocks := merkle.BlockHashes(a[i:min(i+v2PieceLength, len(a))])
+		layer = append(layer, merkle.Root(blocks, v2PieceLength/merkle.BlockSize, [32]byte{}))
+	}
+	rootA := merkle.Root(layer, merkle.Width(len(layer)), merkle.PadHash(1))
+	rootB := merkle.Root(merkle.BlockHashes(b), 1, [32]byte{})
+	if corruptLayer {
+		layer[1][0] ^= 1
+	}
+
+	info := map[string]any{
+		"name":         "v2",
+		"piece length": v2PieceLength,
+		"meta version": 2,
+		"file tree": map[string]any{
+			"a": map[string]any{"": map[string]any{"length": len(a), "pieces root": rootA[:]}},
+			"b": map[string]any{"": map[string]any{"length": len(b), "pieces root": rootB[:]}},
+		},
+	}
+	if hybrid {
+		pad := 2*v2PieceLength - len(a)
+		stream := append(append(bytes.Clone(a), make([]byte, pad)...), b...)
+		var pieces []byte
+		for i := 0; i < len(stream); i += v2PieceLength {
+			h := sha1.Sum(stream[i:min(i+v2PieceLength, len(stream))])
+			pieces = append(pieces, h[:]...)
+		}
+		info["pieces"] = pieces
+		info["files"] = []any{
+			map[string]any{"length": len(a), "path": []string{"a"}},
+			map[string]any{"length": pad, "path": []string{".pad", "pad"}, "attr": "p"},
+			map[string]any{"length": len(b), "path": []string{"b"}},
+		}
+	}
+	rawInfo, err := encodeValue(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var concat []byte
+	for _, h := range layer {
+		concat = append(concat, h[:]...)
+	}
+	data, err := encodeValue(map[string]any{
+		"announce":     "test",
+		"info":         rawValue(rawInfo),
+		"piece layers": map[string]any{string(rootA[:]): concat},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "v2.torrent")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path, rawInfo
+}
+
+func TestParseV2(t *testing.T) {
+	t.Parallel()
+	for _, hybrid := range []bool{false, true} {
+		path, rawInfo := writeV2Torrent(t, hybrid, false)
+		tm, err := ParseTorrentFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tm.InfoHashV2 != sha256.Sum256(rawInfo) {
+			t.Errorf("hybrid %v: v2 info hash must be the SHA-256 of the info dictionary", hybrid)
+		}
+		wantHash := [20]byte(tm.InfoHashV2[:20])
+		if hybrid {
+			wantHash = sha1.Sum(rawInfo)
+		}
+		if tm.InfoHash != wantHash {
+			t.Errorf("hybrid %v: info hash %x != %x", hybrid, tm.InfoHash, wantHash)
+		}
+		if !tm.HasV2() || tm.HasV1() != hybrid {
+			t.Errorf("hybrid %v: HasV1 %v, HasV2 %v", hybrid, tm.HasV1(), tm.HasV2())
+		}
+		if tm.Length != 2*v2PieceLength+10 || tm.PieceCount() != 3 {
+			t.Errorf("hybrid %v: length %d, %d pieces", hybrid, tm.Length, tm.PieceCount())
+		}
+
+		a, b := v2Files()
+		files := []FileInfo{
+			{Path: []string{"v2", "a"}, Length: len(a), Offset: 0, PiecesRoot: tm.Files[0].PiecesRoot},
+			{Path: []string{"v2", "b"}, Length: len(b), Offset: 2 * v2PieceLength, PiecesRoot: tm.Files[1].PiecesRoot},
+		}
+		if !reflect.DeepEqual(tm.Files, files) {
+			t.Errorf("hybrid %v: files %+v != %+v", hybrid, tm.Files, files)
+		}
+		if len(tm.PieceLayers[tm.Files[0].PiecesRoot]) != 2 {
+			t.Errorf("hybrid %v: piece layer of a missing", hybrid)
+		}
+
+		pieces := [][]byte{a[:v2PieceLength], append(bytes.Clone(a[v2PieceLength:]), make([]byte, 2*v2PieceLength-len(a))...), b}
+		for i, data := range pieces {
+			if !tm.VerifyPiece(i, data) {
+				t.Errorf("hybrid %v: piece %d must verify", hybrid, i)
+			}
+			data[0] ^= 1
+			if tm.VerifyPiece(i, data) {
+				t.Errorf("hybrid %v: corrupted piece %d must not verify", hybrid, i)
+			}
+			data[0] ^= 1
+		}
+
+		p, ok := tm.V2Piece(1)
+		if !ok || p.File != 0 || p.Index != 1 || p.Width != 2 || p.Length != len(a)-v2PieceLength {
+			t.Errorf("hybrid %v: piece 1 %+v", hybrid, p)
+		}
+		p, ok = tm.V2Piece(2)
+		if !ok || p.File != 1 || p.Index != 0 || p.Width != 1 || p.Root != tm.Files[1].PiecesRoot {
+			t.Errorf("hybrid %v: piece 2 %+v", hybrid, p)
+		}
+
+		data, err := tm.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, raw) {
+			t.Errorf("hybrid %v: encoded torrent differs from the parsed one", hybrid)
+		}
+	}
+}
+
+func TestParseV2BadPieceLayer(t *testing.T) {
+	t.Parallel()
+	path, _ := writeV2Torrent(t, false, true)
+	if _, err := ParseTorrentFile(path); err == nil {
+		t.Error("piece layer not matching the pieces root must be rejected")
+	}
+}
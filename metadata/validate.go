@@ -0,0 +1,164 @@
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lksndrttm/torrent/merkle"
+)
+
+// Problems reported by Validate, every ValidationError wraps one of them.
+var (
+	ErrPieceLength = errors.New("invalid piece length")
+	ErrPieces      = errors.New("invalid pieces")
+	ErrPieceCount  = errors.New("piece count mismatch")
+	ErrLength      = errors.New("invalid length")
+	ErrUnsafePath  = errors.New("unsafe path")
+)
+
+// ValidationError is a single problem of the metadata. Field names the
+// offending key, like "info.files[2].path".
+type ValidationError struct {
+	Field string
+	Err   error
+	Msg   string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %v: %s", e.Field, e.Err, e.Msg)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors lists all problems of the metadata.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, v := range e {
+		msgs[i] = v.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e ValidationErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, v := range e {
+		errs[i] = v
+	}
+	return errs
+}
+
+// Validate checks the structural invariants of the metadata and that file
+// paths stay inside the download directory. It returns ValidationErrors
+// with every problem found.
+func (tm *TorrentMetadata) Validate() error {
+	if problems := tm.problems(); len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func (tm *TorrentMetadata) problems() ValidationErrors {
+	var problems ValidationErrors
+	add := func(field string, err error, format string, args ...any) {
+		problems = append(problems, &ValidationError{Field: field, Err: err, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if tm.PieceLength <= 0 || tm.PieceLength%merkle.BlockSize != 0 {
+		add("info.piece length", ErrPieceLength, "%d is not a positive multiple of %d", tm.PieceLength, merkle.BlockSize)
+	}
+	if tm.Length <= 0 {
+		add("info.length", ErrLength, "total length %d", tm.Length)
+	}
+	// pure v2 torrents have no piece hashes in the info dictionary
+	if (tm.HasV1() || !tm.HasV2()) && tm.PieceLength > 0 && len(tm.PieceHashes) != tm.PieceCount() {
+		add("info.pieces", ErrPieceCount, "%d piece hashes for %d pieces", len(tm.PieceHashes), tm.PieceCount())
+	}
+
+	if reason := unsafeElem(tm.Name); reason != "" {
+		add("info.name", ErrUnsafePath, "%q %s", tm.Name, reason)
+	}
+	if len(tm.Files) == 0 {
+		add("info.files", ErrLength, "no files")
+	}
+	end := 0
+	seen := map[string]bool{}
+	for i, f := range tm.Files {
+		field := fmt.Sprintf("info.files[%d]", i)
+		if f.Length < 0 {
+			add(field+".length", ErrLength, "negative length %d", f.Length)
+		}
+		if f.Offset < end || f.Offset+f.Length > tm.Length {
+			add(field+".length", ErrLength, "file at %d of length %d outside of the torrent", f.Offset, f.Length)
+		}
+		end = max(end, f.Offset+f.Length)
+
+		if len(f.Path) == 0 {
+			add(field+".path", ErrUnsafePath, "empty path")
+		}
+		for j, elem := range f.Path {
+			// the name was checked above
+			if j == 0 && elem == tm.Name {
+				continue
+			}
+			if reason := unsafeElem(elem); reason != "" {
+				add(field+".path", ErrUnsafePath, "%q %s", elem, reason)
+			}
+		}
+		// pad files are not stored, so their names may repeat
+		key := strings.Join(f.Path, "/")
+		if seen[key] && !f.IsPad() {
+			add(field+".path", ErrUnsafePath, "duplicate path %q", f.Path)
+		}
+		seen[key] = true
+
+		if f.IsSymlink() {
+			if len(f.SymlinkPath) == 0 {
+				add(field+".symlink path", ErrUnsafePath, "empty symlink path")
+			}
+			for _, elem := range f.SymlinkPath {
+				if reason := unsafeElem(elem); reason != "" {
+					add(field+".symlink path", ErrUnsafePath, "%q %s", elem, reason)
+				}
+			}
+		}
+	}
+	return problems
+}
+
+// unsafeElem returns why a path element may escape the download directory
+// or cannot be created, or an empty string for a safe element.
+func unsafeElem(elem string) string {
+	switch {
+	case elem == "":
+		return "is empty"
+	case elem == "." || elem == "..":
+		return "is a relative reference"
+	case strings.ContainsAny(elem, "/\\\x00"):
+		return "contains a separator"
+	case len(elem) >= 2 && elem[1] == ':' && (elem[0]|0x20 >= 'a' && elem[0]|0x20 <= 'z'):
+		return "starts with a drive letter"
+	case reservedName(elem):
+		return "is a reserved name"
+	}
+	return ""
+}
+
+// reservedName reports whether Windows reserves the name, also with an
+// extension like in "con.txt".
+func reservedName(elem string) bool {
+	base, _, _ := strings.Cut(elem, ".")
+	base = strings.ToUpper(strings.TrimRight(base, " "))
+	switch base {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) {
+		return base[3] >= '1' && base[3] <= '9'
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package metadata
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lksndrttm/torrent/merkle"
+)
+
+func validTestMetadata() *TorrentMetadata {
+	return &TorrentMetadata{
+		Name:        "multi",
+		PieceLength: merkle.BlockSize,
+		Length:      merkle.BlockSize + 1,
+		PieceHashes: make([][20]byte, 2),
+		Files: []FileInfo{
+			{Path: []string{"multi", "a"}, Length: merkle.BlockSize},
+			{Path: []string{"multi", "dir", "b"}, Length: 1, Offset: merkle.BlockSize},
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		modify func(tm *TorrentMetadata)
+		want   []error
+	}{
+		{name: "valid", modify: func(tm *TorrentMetadata) {}},
+		{
+			name:   "zero piece length",
+			modify: func(tm *TorrentMetadata) { tm.PieceLength = 0 },
+			want:   []error{ErrPieceLength},
+		},
+		{
+			name:   "piece length not a multiple of the block size",
+			modify: func(tm *TorrentMetadata) { tm.PieceLength = merkle.BlockSize + 1 },
+			want:   []error{ErrPieceLength, ErrPieceCount},
+		},
+		{
+			name:   "missing piece hash",
+			modify: func(tm *TorrentMetadata) { tm.PieceHashes = tm.PieceHashes[:1] },
+			want:   []error{ErrPieceCount},
+		},
+		{
+			name:   "negative file length",
+			modify: func(tm *TorrentMetadata) { tm.Files[1].Length = -1 },
+			want:   []error{ErrLength},
+		},
+		{
+			name:   "overlapping files",
+			modify: func(tm *TorrentMetadata) { tm.Files[1].Offset = 1 },
+			want:   []error{ErrLength},
+		},
+		{
+			name:   "parent reference",
+			modify: func(tm *TorrentMetadata) { tm.Files[1].Path = []string{"multi", "..", "b"} },
+			want:   []error{ErrUnsafePath},
+		},
+		{
+			name:   "absolute path",
+			modify: func(tm *TorrentMetadata) { tm.Files[1].Path = []string{"multi", "/etc/passwd"} },
+			want:   []error{ErrUnsafePath},
+		},
+		{
+			name:   "drive letter",
+			modify: func(tm *TorrentMetadata) { tm.Name = "C:" },
+			want:   []error{ErrUnsafePath},
+		},
+		{
+			name:   "reserved name",
+			modify: func(tm *TorrentMetadata) { tm.Files[0].Path = []string{"multi", "Com1.txt"} },
+			want:   []error{ErrUnsafePath},
+		},
+		{
+			name:   "duplicate path",
+			modify: func(tm *TorrentMetadata) { tm.Files[1].Path = []string{"multi", "a"} },
+			want:   []error{ErrUnsafePath},
+		},
+		{
+			name: "symlink outside",
+			modify: func(tm *TorrentMetadata) {
+				tm.Files[1].Attr = "l"
+				tm.Files[1].SymlinkPath = []string{"..", "x"}
+			},
+			want: []error{ErrUnsafePath},
+		},
+		{
+			name: "every problem reported",
+			modify: func(tm *TorrentMetadata) {
+				tm.PieceHashes = nil
+				tm.Files[0].Path = []string{"multi", ""}
+				tm.Files[1].Path = []string{"multi", "nul"}
+			},
+			want: []error{ErrPieceCount, ErrUnsafePath, ErrUnsafePath},
+		},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			t.Parallel()
+			tm := validTestMetadata()
+			tst.modify(tm)
+
+			err := tm.Validate()
+			if len(tst.want) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var problems ValidationErrors
+			if !errors.As(err, &problems) {
+				t.Fatalf("%v is not ValidationErrors", err)
+			}
+			if len(problems) != len(tst.want) {
+				t.Fatalf("%d problems %v, want %d", len(problems), problems, len(tst.want))
+			}
+			for i, want := range tst.want {
+				if !errors.Is(problems[i], want) {
+					t.Errorf("problem %d %v is not %v", i, problems[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseInvalidTorrent(t *testing.T) {
+	t.Parallel()
+	// 25 bytes of pieces for one piece and a path leaving the torrent
+	info := "d5:filesld6:lengthi3e4:pathl2:..1:aeee4:name5:multi12:piece lengthi16384e6:pieces25:" + strings.Repeat("x", 25) + "e"
+	path := filepath.Join(t.TempDir(), "invalid.torrent")
+	if err := os.WriteFile(path, []byte("d8:announce4:test4:info"+info+"e"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ParseTorrentFile(path)
+	if !errors.Is(err, ErrPieces) || !errors.Is(err, ErrUnsafePath) {
+		t.Fatalf("%v must report the pieces length and the unsafe path", err)
+	}
+	var problem *ValidationError
+	if !errors.As(err, &problem) || problem.Field != "info.pieces" {
+		t.Errorf("first problem %v must be about info.pieces", problem)
+	}
+}
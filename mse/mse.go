@@ -0,0 +1,387 @@
+// Package mse implements BitTorrent Message Stream Encryption: a
+// Diffie-Hellman key exchange followed by an RC4 obfuscated stream.
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+)
+
+// Policy decides whether connections are encrypted.
+type Policy int
+
+const (
+	// Disabled only allows plaintext connections.
+	Disabled Policy = iota
+	// Prefer encrypts when the other side supports it and falls back to plaintext.
+	Prefer
+	// Require refuses plaintext connections.
+	Require
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "disabled"
+	case Prefer:
+		return "prefer"
+	case Require:
+		return "require"
+	default:
+		return fmt.Sprintf("policy(%d)", int(p))
+	}
+}
+
+// crypto_provide and crypto_select methods
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+)
+
+const (
+	keyLen     = 96
+	maxPadLen  = 512
+	privKeyLen = 20
+	// the first bytes of the RC4 key stream are discarded
+	rc4Discard = 1024
+)
+
+var (
+	ErrHandshake = errors.New("mse handshake failed")
+	// ErrPlaintext is returned by Accept for a plaintext connection when encryption is required.
+	ErrPlaintext = errors.New("plaintext connection refused")
+	// ErrEncrypted is returned by Accept for an encrypted connection when encryption is disabled.
+	ErrEncrypted = errors.New("encrypted connection refused")
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+	vc        = make([]byte, 8)
+)
+
+// plaintextHeader starts every plaintext BitTorrent handshake.
+var plaintextHeader = []byte("\x13BitTorrent protocol")
+
+// Conn is a connection after the MSE handshake. Data is encrypted with RC4
+// if it was selected, otherwise it passes through unchanged.
+type Conn struct {
+	net.Conn
+	r       io.Reader
+	pending []byte
+	enc     *rc4.Cipher
+	dec     *rc4.Cipher
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// Encrypted reports whether RC4 was selected.
+func (c *Conn) Encrypted() bool {
+	return c.enc != nil
+}
+
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (keyPair, error) {
+	priv := make([]byte, privKeyLen)
+	if _, err := rand.Read(priv); err != nil {
+		return keyPair{}, err
+	}
+	x := new(big.Int).SetBytes(priv)
+	return keyPair{private: x, public: pad(new(big.Int).Exp(generator, x, prime))}, nil
+}
+
+// secret computes S from the public key of the other side.
+func (kp keyPair) secret(public []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(public)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(prime, big.NewInt(1))) >= 0 {
+		return nil, fmt.Errorf("%w: invalid public key", ErrHandshake)
+	}
+	return pad(new(big.Int).Exp(y, kp.private, prime)), nil
+}
+
+func pad(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, keyLen))
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func newCipher(name string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey))
+	discard := make([]byte, rc4Discard)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+	p := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadLen+1))
+	_, err := rand.Read(p)
+	return p, err
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// syncTo reads until the last read bytes equal pattern, reading at most limit bytes.
+func syncTo(r io.ByteReader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	for len(window) < limit {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrHandshake, err)
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: sync pattern not found", ErrHandshake)
+}
+
+// Dial performs the initiating side of the handshake on con. skey is the
+// info hash of the torrent. With Require only RC4 is offered, otherwise
+// the other side may also select plaintext.
+func Dial(con net.Conn, skey [20]byte, policy Policy) (*Conn, error) {
+	kp, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := con.Write(append(kp.public, padA...)); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+
+	br := bufio.NewReader(con)
+	yb := make([]byte, keyLen)
+	if _, err := io.ReadFull(br, yb); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	s, err := kp.secret(yb)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := newCipher("keyA", s, skey[:])
+	dec := newCipher("keyB", s, skey[:])
+
+	provide := cryptoRC4
+	if policy != Require {
+		provide |= cryptoPlaintext
+	}
+	padC, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	payload := append([]byte{}, vc...)
+	payload = binary.BigEndian.AppendUint32(payload, provide)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(padC)))
+	payload = append(payload, padC...)
+	// no initial payload, the BitTorrent handshake follows on the stream
+	payload = binary.BigEndian.AppendUint16(payload, 0)
+	enc.XORKeyStream(payload, payload)
+
+	msg := hash([]byte("req1"), s)
+	msg = append(msg, xor(hash([]byte("req2"), skey[:]), hash([]byte("req3"), s))...)
+	if _, err := con.Write(append(msg, payload...)); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+
+	// padB is followed by the encrypted verification constant
+	encVC := make([]byte, len(vc))
+	dec.XORKeyStream(encVC, vc)
+	if err := syncTo(br, encVC, maxPadLen+len(vc)); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	dec.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header)
+	padD := make([]byte, binary.BigEndian.Uint16(header[4:]))
+	if len(padD) > maxPadLen {
+		return nil, fmt.Errorf("%w: pad too long", ErrHandshake)
+	}
+	if _, err := io.ReadFull(br, padD); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	dec.XORKeyStream(padD, padD)
+
+	c := &Conn{Conn: con, r: br}
+	switch {
+	case selected == cryptoRC4:
+		c.enc, c.dec = enc, dec
+	case selected == cryptoPlaintext && policy != Require:
+	default:
+		return nil, fmt.Errorf("%w: unsupported crypto_select %#x", ErrHandshake, selected)
+	}
+	return c, nil
+}
+
+// Accept performs the receiving side of the handshake. A plaintext
+// BitTorrent handshake is detected and passed through unless the policy
+// requires encryption. skeys returns the info hashes the other side may
+// ask for.
+func Accept(con net.Conn, policy Policy, skeys func() [][20]byte) (*Conn, error) {
+	br := bufio.NewReader(con)
+	head := make([]byte, len(plaintextHeader))
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	if bytes.Equal(head, plaintextHeader) {
+		if policy == Require {
+			return nil, ErrPlaintext
+		}
+		return &Conn{Conn: con, r: br, pending: head}, nil
+	}
+	if policy == Disabled {
+		return nil, ErrEncrypted
+	}
+
+	ya := make([]byte, keyLen)
+	copy(ya, head)
+	if _, err := io.ReadFull(br, ya[len(head):]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	kp, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := con.Write(append(kp.public, padB...)); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	s, err := kp.secret(ya)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syncTo(br, hash([]byte("req1"), s), maxPadLen+sha1.Size); err != nil {
+		return nil, err
+	}
+	req := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(br, req); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	req2 := xor(req, hash([]byte("req3"), s))
+	var skey []byte
+	for _, h := range skeys() {
+		if bytes.Equal(req2, hash([]byte("req2"), h[:])) {
+			skey = h[:]
+			break
+		}
+	}
+	if skey == nil {
+		return nil, fmt.Errorf("%w: unknown info hash", ErrHandshake)
+	}
+
+	dec := newCipher("keyA", s, skey)
+	enc := newCipher("keyB", s, skey)
+
+	header := make([]byte, len(vc)+6)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	dec.XORKeyStream(header, header)
+	if !bytes.Equal(header[:len(vc)], vc) {
+		return nil, fmt.Errorf("%w: invalid verification constant", ErrHandshake)
+	}
+	provide := binary.BigEndian.Uint32(header[len(vc):])
+	padLen := int(binary.BigEndian.Uint16(header[len(vc)+4:]))
+	if padLen > maxPadLen {
+		return nil, fmt.Errorf("%w: pad too long", ErrHandshake)
+	}
+	rest := make([]byte, padLen+2)
+	if _, err := io.ReadFull(br, rest); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	dec.XORKeyStream(rest, rest)
+	ia := make([]byte, binary.BigEndian.Uint16(rest[padLen:]))
+	if _, err := io.ReadFull(br, ia); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy != Require:
+		selected = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("%w: no acceptable crypto method in %#x", ErrHandshake, provide)
+	}
+
+	padD, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	reply := append([]byte{}, vc...)
+	reply = binary.BigEndian.AppendUint32(reply, selected)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(len(padD)))
+	reply = append(reply, padD...)
+	enc.XORKeyStream(reply, reply)
+	if _, err := con.Write(reply); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+	}
+
+	c := &Conn{Conn: con, r: br, pending: ia}
+	if selected == cryptoRC4 {
+		c.enc, c.dec = enc, dec
+	}
+	return c, nil
+}
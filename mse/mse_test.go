@@ -0,0 +1,121 @@
+package mse
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// handshakePair connects over loopback and runs Dial and Accept with the policies.
+func handshakePair(t *testing.T, dialPolicy, acceptPolicy Policy, skey [20]byte, known [][20]byte) (dialed, accepted *Conn, dialErr, acceptErr error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close() //nolint:errcheck
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		con, err := ln.Accept()
+		if err != nil {
+			acceptErr = err
+			return
+		}
+		con.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+		accepted, acceptErr = Accept(con, acceptPolicy, func() [][20]byte { return known })
+		if acceptErr != nil {
+			con.Close() //nolint:errcheck
+		}
+	}()
+
+	con, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	con.SetDeadline(time.Now().Add(5 * time.Second)) //nolint:errcheck
+	dialed, dialErr = Dial(con, skey, dialPolicy)
+	if dialErr != nil {
+		con.Close() //nolint:errcheck
+	}
+	<-done
+	return dialed, accepted, dialErr, acceptErr
+}
+
+func TestHandshake(t *testing.T) {
+	t.Parallel()
+	skey := [20]byte{1, 2, 3}
+	tests := []struct {
+		name         string
+		dial, accept Policy
+		encrypted    bool
+		fails        bool
+	}{
+		{name: "prefer both", dial: Prefer, accept: Prefer, encrypted: true},
+		{name: "require dial", dial: Require, accept: Prefer, encrypted: true},
+		{name: "require accept", dial: Prefer, accept: Require, encrypted: true},
+		{name: "disabled accept", dial: Prefer, accept: Disabled, fails: true},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+			dialed, accepted, dialErr, acceptErr := handshakePair(t, tst.dial, tst.accept, skey, [][20]byte{{9}, skey})
+			if tst.fails {
+				require.Error(dialErr)
+				require.Error(acceptErr)
+				return
+			}
+			require.NoError(dialErr)
+			require.NoError(acceptErr)
+			defer dialed.Close()   //nolint:errcheck
+			defer accepted.Close() //nolint:errcheck
+			require.Equal(tst.encrypted, dialed.Encrypted())
+			require.Equal(tst.encrypted, accepted.Encrypted())
+
+			go dialed.Write([]byte("ping from a")) //nolint:errcheck
+			buf := make([]byte, len("ping from a"))
+			_, err := io.ReadFull(accepted, buf)
+			require.NoError(err)
+			require.Equal("ping from a", string(buf))
+
+			go accepted.Write([]byte("pong from b")) //nolint:errcheck
+			_, err = io.ReadFull(dialed, buf)
+			require.NoError(err)
+			require.Equal("pong from b", string(buf))
+		})
+	}
+}
+
+func TestHandshakeUnknownInfoHash(t *testing.T) {
+	t.Parallel()
+	_, _, dialErr, acceptErr := handshakePair(t, Prefer, Prefer, [20]byte{1}, [][20]byte{{2}})
+	require.ErrorIs(t, acceptErr, ErrHandshake)
+	require.ErrorIs(t, dialErr, ErrHandshake)
+}
+
+func TestAcceptPlaintext(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	handshake := append([]byte{}, plaintextHeader...)
+	handshake = append(handshake, make([]byte, 48)...)
+
+	for _, policy := range []Policy{Disabled, Prefer, Require} {
+		a, b := net.Pipe()
+		go a.Write(handshake) //nolint:errcheck
+
+		con, err := Accept(b, policy, func() [][20]byte { return nil })
+		if policy == Require {
+			require.ErrorIs(err, ErrPlaintext)
+		} else {
+			require.NoError(err)
+			require.False(con.Encrypted())
+			buf := make([]byte, len(handshake))
+			_, err = io.ReadFull(con, buf)
+			require.NoError(err)
+			require.Equal(handshake, buf)
+		}
+		a.Close() //nolint:errcheck
+		b.Close() //nolint:errcheck
+	}
+}
@@ -0,0 +1,50 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Sizes of compact peer entries: the IP followed by a 2 byte port, as used
+// by tracker responses, peer exchange and DHT.
+const (
+	CompactIPv4Len = net.IPv4len + 2
+	CompactIPv6Len = net.IPv6len + 2
+)
+
+var ErrMalformedCompact = errors.New("malformed compact peers")
+
+// ParseCompactPeers parses a list of compact entries of size CompactIPv4Len or CompactIPv6Len.
+func ParseCompactPeers(data []byte, entryLen int) ([]PeerAddr, error) {
+	if entryLen != CompactIPv4Len && entryLen != CompactIPv6Len || len(data)%entryLen != 0 {
+		return []PeerAddr{}, ErrMalformedCompact
+	}
+
+	peers := make([]PeerAddr, len(data)/entryLen)
+	for i := range peers {
+		entry := data[i*entryLen : (i+1)*entryLen]
+		ipLen := entryLen - 2
+		peers[i].IP = net.IP(append([]byte{}, entry[:ipLen]...))
+		peers[i].Port = binary.BigEndian.Uint16(entry[ipLen:])
+	}
+	return peers, nil
+}
+
+// Compact returns the compact entry of the address, 6 bytes for IPv4 and 18
+// bytes for IPv6. It returns nil for an invalid IP.
+func (p *PeerAddr) Compact() []byte {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
+	}
+	if ip == nil {
+		return nil
+	}
+	return binary.BigEndian.AppendUint16(append([]byte{}, ip...), p.Port)
+}
+
+// IsIPv6 reports whether the address is an IPv6 address, IPv4-mapped addresses count as IPv4.
+func (p *PeerAddr) IsIPv6() bool {
+	return p.IP.To4() == nil && p.IP.To16() != nil
+}
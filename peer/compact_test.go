@@ -0,0 +1,48 @@
+package peer
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactRoundTrip(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	addrs := []PeerAddr{
+		{IP: net.ParseIP("192.168.1.2"), Port: 6881},
+		{IP: net.ParseIP("2001:db8::2"), Port: 51413},
+	}
+	for _, addr := range addrs {
+		data := addr.Compact()
+		entryLen := CompactIPv4Len
+		if addr.IsIPv6() {
+			entryLen = CompactIPv6Len
+		}
+		require.Len(data, entryLen)
+
+		peers, err := ParseCompactPeers(data, entryLen)
+		require.NoError(err)
+		require.Len(peers, 1)
+		require.True(peers[0].IP.Equal(addr.IP))
+		require.Equal(addr.Port, peers[0].Port)
+	}
+
+	_, err := ParseCompactPeers(make([]byte, 7), CompactIPv4Len)
+	require.ErrorIs(err, ErrMalformedCompact)
+}
+
+func TestPeerAddrStringIPv6(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	addr := PeerAddr{IP: net.ParseIP("::1"), Port: 6881}
+	require.Equal("[::1]:6881", addr.String())
+
+	parsed, err := ParsePeerAddr(addr.String())
+	require.NoError(err)
+	require.True(parsed.IP.Equal(addr.IP))
+	require.Equal(addr.Port, parsed.Port)
+}
@@ -1,16 +1,21 @@
 package peer
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/lksndrttm/torrent/bitfield"
 	m "github.com/lksndrttm/torrent/messages"
 	md "github.com/lksndrttm/torrent/metadata"
+	"github.com/lksndrttm/torrent/mse"
+	"github.com/lksndrttm/torrent/utp"
 )
 
 type PeerAddr struct {
@@ -19,7 +24,7 @@ type PeerAddr struct {
 }
 
 func (p *PeerAddr) String() string {
-	return fmt.Sprintf("%s:%d", p.IP, p.Port)
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
 
 func ParsePeerAddr(addr string) (PeerAddr, error) {
@@ -32,44 +37,116 @@ func ParsePeerAddr(addr string) (PeerAddr, error) {
 }
 
 type Peer struct {
-	Con      net.Conn
-	Choking  bool
-	Bitfield bitfield.Bitfield
-	Addr     PeerAddr
+	Con        net.Conn
+	Choking    bool
+	Interested bool
+	Bitfield   bitfield.Bitfield
+	Addr       PeerAddr
+	// ID is the peer ID from the remote handshake.
+	ID [20]byte
+	// SupportsV2 is set when the remote handshake announces BitTorrent v2,
+	// then the peer answers hash requests.
+	SupportsV2 bool
+
+	sendMutex sync.Mutex
+	pending   []*m.Message
+
+	upload   Limiter
+	download Limiter
+	ctxOnce  sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// Limiter delays transfers to limit the bandwidth.
+type Limiter interface {
+	WaitN(ctx context.Context, n int) error
+}
+
+// SetRateLimits limits the bandwidth of the connection. It must be called
+// before the peer is used from several goroutines.
+func (p *Peer) SetRateLimits(upload, download Limiter) {
+	p.upload = upload
+	p.download = download
+}
+
+// limitCtx returns the context for limiter waits, it is canceled by Close.
+func (p *Peer) limitCtx() context.Context {
+	p.ctxOnce.Do(func() {
+		p.ctx, p.cancel = context.WithCancel(context.Background())
+	})
+	return p.ctx
 }
 
+// SendMessage is safe to call from several goroutines.
 func (p *Peer) SendMessage(m *m.Message) error {
-	_, err := p.Con.Write(m.Serialize())
+	data := m.Serialize()
+	if p.upload != nil {
+		if err := p.upload.WaitN(p.limitCtx(), len(data)); err != nil {
+			return err
+		}
+	}
+
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+	_, err := p.Con.Write(data)
 	return err
 }
 
 func (p *Peer) ReceiveMessage() (*m.Message, error) {
+	if len(p.pending) > 0 {
+		msg := p.pending[0]
+		p.pending = p.pending[1:]
+		return msg, nil
+	}
 	msg, err := ReceiveMessage(p.Con)
-	return msg, err
+	if err != nil || p.download == nil {
+		return msg, err
+	}
+
+	// the next message is read after the limiter allows this one
+	size := 4
+	if msg != nil {
+		size += 1 + len(msg.Payload)
+	}
+	if err := p.download.WaitN(p.limitCtx(), size); err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
 
 func (p *Peer) Close() {
+	p.limitCtx()
+	p.cancel()
 	p.Con.Close() //nolint:errcheck
 }
 
 func HandshakePeer(peer net.Conn, tmeta *md.TorrentMetadata, peerID [20]byte) error {
+	_, err := handshake(peer, tmeta, peerID)
+	return err
+}
+
+func handshake(peer net.Conn, tmeta *md.TorrentMetadata, peerID [20]byte) (m.Handshake, error) {
 	hshake := m.NewHandshake(tmeta.InfoHash, peerID)
+	if tmeta.HasV2() {
+		hshake.Reserved[7] |= m.ReservedV2
+	}
 
 	_, err := peer.Write(hshake.Serialize())
 	if err != nil {
-		return err
+		return m.Handshake{}, err
 	}
 
 	respHshake, err := m.ReadHandshake(peer)
 	if err != nil {
-		return err
+		return m.Handshake{}, err
 	}
 
 	if hshake.InfoHash != respHshake.InfoHash {
-		return errors.New("info hashes different")
+		return m.Handshake{}, errors.New("info hashes different")
 	}
 
-	return nil
+	return respHshake, nil
 }
 
 func ReceiveMessage(peer net.Conn) (*m.Message, error) {
@@ -79,7 +156,8 @@ func ReceiveMessage(peer net.Conn) (*m.Message, error) {
 		return nil, err
 	}
 	msgLen := binary.BigEndian.Uint32(msgLenBuf)
-	const maxMsgLen = 20000
+	// the block hashes of a 16 MiB piece are the longest v2 hashes message
+	const maxMsgLen = 34000
 
 	if msgLen > maxMsgLen {
 		return nil, fmt.Errorf("message too long")
@@ -119,11 +197,130 @@ func ReceiveBitfield(peer net.Conn) (bitfield.Bitfield, error) {
 }
 
 func Connect(addr PeerAddr, tmeta *md.TorrentMetadata, timeout time.Duration, peerID [20]byte) (p *Peer, err error) {
-	deadline := time.Now().Add(timeout)
-	peer, err := net.DialTimeout("tcp", addr.String(), time.Second*timeout)
+	return ConnectContext(context.Background(), addr, tmeta, timeout, peerID)
+}
+
+// ConnectContext dials the peer and performs the handshake. Canceling ctx aborts the connection setup.
+func ConnectContext(ctx context.Context, addr PeerAddr, tmeta *md.TorrentMetadata, timeout time.Duration, peerID [20]byte) (p *Peer, err error) {
+	d := Dialer{Timeout: timeout}
+	return d.Connect(ctx, addr, tmeta, peerID)
+}
+
+// Transport selects the protocols used to dial peers.
+type Transport int
+
+const (
+	TransportTCP Transport = iota
+	// TransportPreferTCP tries uTP when TCP fails.
+	TransportPreferTCP
+	// TransportPreferUTP tries TCP when uTP fails.
+	TransportPreferUTP
+	TransportUTP
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportTCP:
+		return "tcp"
+	case TransportPreferTCP:
+		return "prefer tcp"
+	case TransportPreferUTP:
+		return "prefer utp"
+	case TransportUTP:
+		return "utp"
+	default:
+		return fmt.Sprintf("transport(%d)", int(t))
+	}
+}
+
+// Dialer holds the settings for outgoing peer connections.
+type Dialer struct {
+	Timeout time.Duration
+	// Encryption is the MSE policy. With mse.Prefer a peer that fails the
+	// encrypted handshake is dialed again in plaintext.
+	Encryption mse.Policy
+	// Transport is ignored without UTP, then only TCP is used.
+	Transport Transport
+	UTP       *utp.Socket
+	// Proxy, when set, dials the TCP connections.
+	Proxy ContextDialer
+}
+
+// ContextDialer dials connections, proxy.Dialer implements it.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// transports returns the transports to try in order, true stands for uTP.
+func (d *Dialer) transports() []bool {
+	if d.UTP == nil {
+		return []bool{false}
+	}
+	switch d.Transport {
+	case TransportPreferTCP:
+		return []bool{false, true}
+	case TransportPreferUTP:
+		return []bool{true, false}
+	case TransportUTP:
+		return []bool{true}
+	default:
+		return []bool{false}
+	}
+}
+
+// Connect dials the peer and performs the handshake. Canceling ctx aborts the connection setup.
+func (d *Dialer) Connect(ctx context.Context, addr PeerAddr, tmeta *md.TorrentMetadata, peerID [20]byte) (p *Peer, err error) {
+	for _, useUTP := range d.transports() {
+		p, err = d.connectEncrypted(ctx, addr, tmeta, peerID, useUTP)
+		if err == nil || ctx.Err() != nil {
+			return p, err
+		}
+	}
+	return p, err
+}
+
+func (d *Dialer) connectEncrypted(ctx context.Context, addr PeerAddr, tmeta *md.TorrentMetadata, peerID [20]byte, useUTP bool) (*Peer, error) {
+	if d.Encryption == mse.Disabled {
+		return d.connect(ctx, addr, tmeta, peerID, useUTP, false)
+	}
+	p, err := d.connect(ctx, addr, tmeta, peerID, useUTP, true)
+	if err != nil && d.Encryption == mse.Prefer && errors.Is(err, mse.ErrHandshake) && ctx.Err() == nil {
+		return d.connect(ctx, addr, tmeta, peerID, useUTP, false)
+	}
+	return p, err
+}
+
+func (d *Dialer) dial(ctx context.Context, addr PeerAddr, useUTP bool) (net.Conn, error) {
+	if useUTP {
+		ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+		return d.UTP.DialContext(ctx, addr.String())
+	}
+	if d.Proxy != nil {
+		ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+		return d.Proxy.DialContext(ctx, "tcp", addr.String())
+	}
+	dialer := net.Dialer{Timeout: d.Timeout}
+	return dialer.DialContext(ctx, "tcp", addr.String())
+}
+
+func (d *Dialer) connect(ctx context.Context, addr PeerAddr, tmeta *md.TorrentMetadata, peerID [20]byte, useUTP, encrypt bool) (p *Peer, err error) {
+	deadline := time.Now().Add(d.Timeout)
+	peer, err := d.dial(ctx, addr, useUTP)
 	if err != nil {
 		return p, err
 	}
+	stop := context.AfterFunc(ctx, func() {
+		peer.SetDeadline(time.Now()) //nolint:errcheck
+	})
+	defer func() {
+		stop()
+		if err != nil {
+			peer.Close() //nolint:errcheck
+		}
+	}()
+
 	err = peer.SetDeadline(deadline)
 	if err != nil {
 		return p, err
@@ -134,16 +331,57 @@ func Connect(addr PeerAddr, tmeta *md.TorrentMetadata, timeout time.Duration, pe
 		}
 	}()
 
-	err = HandshakePeer(peer, tmeta, peerID)
+	con := peer
+	if encrypt {
+		if con, err = mse.Dial(peer, tmeta.InfoHash, d.Encryption); err != nil {
+			return p, err
+		}
+	}
+
+	hshake, err := handshake(con, tmeta, peerID)
 	if err != nil {
 		return p, err
 	}
 
-	bitfield, err := ReceiveBitfield(peer)
+	bitfield, err := ReceiveBitfield(con)
 	if err != nil {
 		return p, err
 	}
 
-	p = &Peer{Con: peer, Choking: true, Bitfield: bitfield, Addr: addr}
+	p = &Peer{Con: con, Choking: true, Bitfield: bitfield, Addr: addr, ID: hshake.PeerID, SupportsV2: hshake.SupportsV2()}
 	return p, err
 }
+
+// Accept finishes setting up an inbound connection after the handshake was
+// answered. The bitfield of the remote peer is optional, so the first
+// message is kept for later if it is something else.
+func Accept(con net.Conn, addr PeerAddr, bf bitfield.Bitfield, timeout time.Duration) (p *Peer, err error) {
+	err = con.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return p, err
+	}
+	defer func() {
+		if err == nil {
+			err = con.SetDeadline(time.Time{})
+		}
+	}()
+
+	err = SendMessage(con, m.NewBitfieldMessage(bf).ToMessage())
+	if err != nil {
+		return p, err
+	}
+
+	msg, err := ReceiveMessage(con)
+	if err != nil {
+		return p, err
+	}
+
+	p = &Peer{Con: con, Choking: true, Addr: addr}
+	if bMsg, bErr := m.ToBitfieldMessage(msg); bErr == nil {
+		p.Bitfield = bMsg.Bitfield()
+	} else {
+		p.Bitfield = bitfield.New(len(bf) * 8)
+		p.pending = append(p.pending, msg)
+	}
+	return p, nil
+}
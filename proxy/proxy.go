@@ -0,0 +1,123 @@
+// Package proxy dials connections through SOCKS5 and HTTP CONNECT proxies.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+type Type int
+
+const (
+	SOCKS5 Type = iota
+	HTTP
+)
+
+func (t Type) String() string {
+	switch t {
+	case SOCKS5:
+		return "socks5"
+	case HTTP:
+		return "http"
+	default:
+		return fmt.Sprintf("proxy(%d)", int(t))
+	}
+}
+
+var (
+	ErrProxy = errors.New("proxy error")
+	// ErrUDPUnsupported is returned by ListenPacket for proxies that can not relay UDP.
+	ErrUDPUnsupported = errors.New("proxy does not relay udp")
+)
+
+// Dialer connects through the proxy at Addr. Username and Password are
+// optional.
+type Dialer struct {
+	Type     Type
+	Addr     string
+	Username string
+	Password string
+}
+
+// DialContext connects to addr through the proxy, only TCP is supported.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: network %s not supported", ErrProxy, network)
+	}
+
+	var dialer net.Dialer
+	con, err := dialer.DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	// canceling ctx aborts the proxy handshake
+	stop := context.AfterFunc(ctx, func() {
+		con.Close() //nolint:errcheck
+	})
+
+	var result net.Conn
+	switch d.Type {
+	case SOCKS5:
+		_, err = d.socksRequest(con, socksConnect, addr)
+		result = con
+	case HTTP:
+		result, err = d.httpConnect(con, addr)
+	default:
+		err = fmt.Errorf("%w: unknown type %s", ErrProxy, d.Type)
+	}
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		con.Close() //nolint:errcheck
+		return nil, err
+	}
+	return result, nil
+}
+
+// HTTPClient returns a client that sends all requests through the proxy.
+func (d *Dialer) HTTPClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+}
+
+func (d *Dialer) httpConnect(con net.Conn, addr string) (net.Conn, error) {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if d.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := con.Write([]byte(req + "\r\n")); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(con)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProxy, err)
+	}
+	resp.Body.Close() //nolint:errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: CONNECT %s: %s", ErrProxy, addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: con, r: br}, nil
+	}
+	return con, nil
+}
+
+// bufferedConn returns data the proxy sent along with its response first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lksndrttm/torrent/proxy/proxytest"
+	"github.com/stretchr/testify/require"
+)
+
+func startEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() }) //nolint:errcheck
+	go func() {
+		for {
+			con, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer con.Close() //nolint:errcheck
+				io.Copy(con, con) //nolint:errcheck
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestDialContext(t *testing.T) {
+	t.Parallel()
+	echo := startEcho(t)
+
+	tests := []struct {
+		name     string
+		typ      Type
+		username string
+		password string
+		wantErr  bool
+	}{
+		{name: "socks5", typ: SOCKS5},
+		{name: "socks5 auth", typ: SOCKS5, username: "user", password: "pass"},
+		{name: "socks5 wrong password", typ: SOCKS5, username: "user", password: "wrong", wantErr: true},
+		{name: "http", typ: HTTP},
+		{name: "http auth", typ: HTTP, username: "user", password: "pass"},
+		{name: "http wrong password", typ: HTTP, username: "user", password: "wrong", wantErr: true},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			start := proxytest.NewSOCKS5
+			if tst.typ == HTTP {
+				start = proxytest.NewHTTP
+			}
+			server, err := start(tst.username, "pass")
+			require.NoError(err)
+			defer server.Close() //nolint:errcheck
+
+			d := &Dialer{Type: tst.typ, Addr: server.Addr(), Username: tst.username, Password: tst.password}
+			con, err := d.DialContext(context.Background(), "tcp", echo)
+			if tst.wantErr {
+				require.ErrorIs(err, ErrProxy)
+				return
+			}
+			require.NoError(err)
+			defer con.Close() //nolint:errcheck
+			require.NoError(con.SetDeadline(time.Now().Add(5 * time.Second)))
+
+			_, err = con.Write([]byte("ping"))
+			require.NoError(err)
+			buf := make([]byte, 4)
+			_, err = io.ReadFull(con, buf)
+			require.NoError(err)
+			require.Equal("ping", string(buf))
+			require.EqualValues(1, server.Requests.Load())
+		})
+	}
+}
+
+func TestDialContextRefused(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	server, err := proxytest.NewSOCKS5("", "")
+	require.NoError(err)
+	defer server.Close() //nolint:errcheck
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	addr := ln.Addr().String()
+	require.NoError(ln.Close())
+
+	d := &Dialer{Type: SOCKS5, Addr: server.Addr()}
+	_, err = d.DialContext(context.Background(), "tcp", addr)
+	require.ErrorIs(err, ErrProxy)
+	require.ErrorContains(err, "connection refused")
+
+	_, err = d.DialContext(context.Background(), "udp", addr)
+	require.ErrorIs(err, ErrProxy)
+}
+
+func TestHTTPClient(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello") //nolint:errcheck
+	}))
+	defer web.Close()
+	server, err := proxytest.NewSOCKS5("", "")
+	require.NoError(err)
+	defer server.Close() //nolint:errcheck
+
+	d := &Dialer{Type: SOCKS5, Addr: server.Addr()}
+	resp, err := d.HTTPClient().Get(web.URL)
+	require.NoError(err)
+	defer resp.Body.Close() //nolint:errcheck
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(err)
+	require.Equal("hello", string(body))
+	require.EqualValues(1, server.Requests.Load())
+}
+
+func TestListenPacket(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	server, err := proxytest.NewSOCKS5("user", "pass")
+	require.NoError(err)
+	defer server.Close() //nolint:errcheck
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer echo.Close() //nolint:errcheck
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr) //nolint:errcheck
+		}
+	}()
+
+	d := &Dialer{Type: SOCKS5, Addr: server.Addr(), Username: "user", Password: "pass"}
+	pc, err := d.ListenPacket(context.Background())
+	require.NoError(err)
+	defer pc.Close() //nolint:errcheck
+	require.NoError(pc.SetDeadline(time.Now().Add(5 * time.Second)))
+
+	_, err = pc.WriteTo([]byte("ping"), echo.LocalAddr())
+	require.NoError(err)
+	buf := make([]byte, 1500)
+	n, from, err := pc.ReadFrom(buf)
+	require.NoError(err)
+	require.Equal("ping", string(buf[:n]))
+	require.Equal(echo.LocalAddr().String(), from.String())
+
+	_, err = (&Dialer{Type: HTTP, Addr: server.Addr()}).ListenPacket(context.Background())
+	require.ErrorIs(err, ErrUDPUnsupported)
+}
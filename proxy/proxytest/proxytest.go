@@ -0,0 +1,308 @@
+// Package proxytest runs in-process SOCKS5 and HTTP CONNECT proxies for tests.
+package proxytest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Server is a proxy listening on a loopback address.
+type Server struct {
+	// Username and Password are required from clients when Username is set.
+	Username string
+	Password string
+
+	ln net.Listener
+	// Requests counts the CONNECT and UDP ASSOCIATE requests served.
+	Requests atomic.Int64
+
+	socks bool
+	wg    sync.WaitGroup
+	m     sync.Mutex
+	conns map[io.Closer]struct{}
+}
+
+// NewSOCKS5 starts a SOCKS5 proxy supporting CONNECT and UDP ASSOCIATE.
+func NewSOCKS5(username, password string) (*Server, error) {
+	return start(true, username, password)
+}
+
+// NewHTTP starts an HTTP CONNECT proxy.
+func NewHTTP(username, password string) (*Server, error) {
+	return start(false, username, password)
+}
+
+func start(socks bool, username, password string) (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Username: username, Password: password, ln: ln, socks: socks, conns: map[io.Closer]struct{}{}}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the proxy and closes all relayed connections.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.m.Lock()
+	for c := range s.conns {
+		c.Close() //nolint:errcheck
+	}
+	s.conns = nil
+	s.m.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// track registers c to be closed with the server, after Close it is closed
+// right away.
+func (s *Server) track(c io.Closer) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.conns == nil {
+		c.Close() //nolint:errcheck
+		return
+	}
+	s.conns[c] = struct{}{}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		con, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.track(con)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer con.Close() //nolint:errcheck
+			if s.socks {
+				s.serveSOCKS(con)
+			} else {
+				s.serveHTTP(con)
+			}
+		}()
+	}
+}
+
+func (s *Server) relay(client, target net.Conn) {
+	s.track(target)
+	defer target.Close() //nolint:errcheck
+	done := make(chan struct{})
+	go func() {
+		io.Copy(target, client) //nolint:errcheck
+		target.Close()          //nolint:errcheck
+		close(done)
+	}()
+	io.Copy(client, target) //nolint:errcheck
+	client.Close()          //nolint:errcheck
+	<-done
+}
+
+func (s *Server) serveHTTP(con net.Conn) {
+	br := bufio.NewReader(con)
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	if s.Username != "" {
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(s.Username+":"+s.Password))
+		if req.Header.Get("Proxy-Authorization") != auth {
+			io.WriteString(con, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n") //nolint:errcheck
+			return
+		}
+	}
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		io.WriteString(con, "HTTP/1.1 502 Bad Gateway\r\n\r\n") //nolint:errcheck
+		return
+	}
+	s.Requests.Add(1)
+	io.WriteString(con, "HTTP/1.1 200 Connection established\r\n\r\n") //nolint:errcheck
+	s.relay(con, target)
+}
+
+func (s *Server) serveSOCKS(con net.Conn) {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(con, buf); err != nil || buf[0] != 5 {
+		return
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(con, methods); err != nil {
+		return
+	}
+	want := byte(0)
+	if s.Username != "" {
+		want = 2
+	}
+	if !slices.Contains(methods, want) {
+		con.Write([]byte{5, 0xff}) //nolint:errcheck
+		return
+	}
+	con.Write([]byte{5, want}) //nolint:errcheck
+	if want == 2 && !s.socksAuth(con) {
+		return
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(con, header); err != nil {
+		return
+	}
+	addr, err := readAddr(con)
+	if err != nil {
+		return
+	}
+	switch header[1] {
+	case 1:
+		target, err := net.Dial("tcp", addr)
+		if err != nil {
+			con.Write(reply(5, nil)) //nolint:errcheck
+			return
+		}
+		s.Requests.Add(1)
+		con.Write(reply(0, target.LocalAddr())) //nolint:errcheck
+		s.relay(con, target)
+	case 3:
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			con.Write(reply(1, nil)) //nolint:errcheck
+			return
+		}
+		s.track(pc)
+		defer pc.Close() //nolint:errcheck
+		s.Requests.Add(1)
+		con.Write(reply(0, pc.LocalAddr())) //nolint:errcheck
+		go relayUDP(pc)
+		// the association ends with the control connection
+		io.Copy(io.Discard, con) //nolint:errcheck
+	default:
+		con.Write(reply(7, nil)) //nolint:errcheck
+	}
+}
+
+func (s *Server) socksAuth(con net.Conn) bool {
+	read := func() string {
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(con, n); err != nil {
+			return ""
+		}
+		b := make([]byte, n[0])
+		io.ReadFull(con, b) //nolint:errcheck
+		return string(b)
+	}
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(con, version); err != nil {
+		return false
+	}
+	ok := read() == s.Username && read() == s.Password
+	status := byte(1)
+	if ok {
+		status = 0
+	}
+	con.Write([]byte{1, status}) //nolint:errcheck
+	return ok
+}
+
+// relayUDP forwards datagrams of the first client to their targets and
+// wraps the replies.
+func relayUDP(pc net.PacketConn) {
+	var client net.Addr
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			if n < 4 {
+				continue
+			}
+			r := bytes.NewReader(buf[3:n])
+			addr, err := readAddr(r)
+			if err != nil {
+				continue
+			}
+			target, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				continue
+			}
+			pc.WriteTo(buf[n-r.Len():n], target) //nolint:errcheck
+			continue
+		}
+		packet := reply(0, from)
+		packet[0] = 0
+		pc.WriteTo(append(packet, buf[:n]...), client) //nolint:errcheck
+	}
+}
+
+func readAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if atyp[0] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", io.ErrUnexpectedEOF
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// reply builds a SOCKS5 reply, addr may be nil.
+func reply(rep byte, addr net.Addr) []byte {
+	b := []byte{5, rep, 0}
+	ip, port := net.IPv4zero.To4(), 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, 1), ip4...)
+	} else {
+		b = append(append(b, 4), ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port))
+}
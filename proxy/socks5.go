@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socksVersion = 5
+
+	socksNoAuth   = 0x00
+	socksUserPass = 0x02
+
+	socksConnect      = 0x01
+	socksUDPAssociate = 0x03
+
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+var socksReplies = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socksRequest authenticates and sends a request for addr. It returns the
+// address bound by the proxy.
+func (d *Dialer) socksRequest(con net.Conn, cmd byte, addr string) (*net.UDPAddr, error) {
+	methods := []byte{socksNoAuth}
+	if d.Username != "" {
+		methods = append(methods, socksUserPass)
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := con.Write(greeting); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(con, reply); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProxy, err)
+	}
+	if reply[0] != socksVersion {
+		return nil, fmt.Errorf("%w: not a socks5 proxy", ErrProxy)
+	}
+	switch reply[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if err := d.socksAuth(con); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: no acceptable authentication method", ErrProxy)
+	}
+
+	req := []byte{socksVersion, cmd, 0}
+	req, err := appendSocksAddr(req, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := con.Write(req); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(con, header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProxy, err)
+	}
+	if header[1] != 0 {
+		msg, ok := socksReplies[header[1]]
+		if !ok {
+			msg = fmt.Sprintf("reply %d", header[1])
+		}
+		return nil, fmt.Errorf("%w: %s: %s", ErrProxy, addr, msg)
+	}
+	bound, err := readSocksAddr(con)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrProxy, err)
+	}
+	return bound, nil
+}
+
+// socksAuth performs the username/password subnegotiation of RFC 1929.
+func (d *Dialer) socksAuth(con net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return fmt.Errorf("%w: username or password too long", ErrProxy)
+	}
+	req := []byte{1, byte(len(d.Username))}
+	req = append(req, d.Username...)
+	req = append(req, byte(len(d.Password)))
+	req = append(req, d.Password...)
+	if _, err := con.Write(req); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(con, reply); err != nil {
+		return fmt.Errorf("%w: %w", ErrProxy, err)
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("%w: authentication failed", ErrProxy)
+	}
+	return nil
+}
+
+func appendSocksAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip.To4() != nil:
+		b = append(append(b, atypIPv4), ip.To4()...)
+	case ip != nil:
+		b = append(append(b, atypIPv6), ip.To16()...)
+	default:
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q too long", host)
+		}
+		// the proxy resolves host names, so DNS does not leak
+		b = append(append(b, atypDomain, byte(len(host))), host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// readSocksAddr reads an address, domain names are returned without IP.
+func readSocksAddr(r io.Reader) (*net.UDPAddr, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return nil, err
+	}
+	var ip []byte
+	switch atyp[0] {
+	case atypIPv4:
+		ip = make([]byte, net.IPv4len)
+	case atypIPv6:
+		ip = make([]byte, net.IPv6len)
+	case atypDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return nil, err
+		}
+		ip = make([]byte, n[0])
+	default:
+		return nil, fmt.Errorf("unknown address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, ip); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	addr := &net.UDPAddr{Port: int(binary.BigEndian.Uint16(port))}
+	if atyp[0] != atypDomain {
+		addr.IP = ip
+	}
+	return addr, nil
+}
+
+// ListenPacket opens a UDP association with a SOCKS5 proxy. Datagrams
+// written to the returned connection are relayed by the proxy.
+func (d *Dialer) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	if d.Type != SOCKS5 {
+		return nil, ErrUDPUnsupported
+	}
+
+	var dialer net.Dialer
+	control, err := dialer.DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		control.SetDeadline(deadline) //nolint:errcheck
+	}
+	relay, err := d.socksRequest(control, socksUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		control.Close() //nolint:errcheck
+		return nil, err
+	}
+	control.SetDeadline(time.Time{}) //nolint:errcheck
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		relay.IP = control.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	pc, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		control.Close() //nolint:errcheck
+		return nil, err
+	}
+	return &packetConn{PacketConn: pc, control: control, relay: relay}, nil
+}
+
+// packetConn wraps datagrams in SOCKS5 UDP request headers. The
+// association lasts as long as the control connection.
+type packetConn struct {
+	net.PacketConn
+	control net.Conn
+	relay   *net.UDPAddr
+}
+
+func (pc *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	header, err := appendSocksAddr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := pc.PacketConn.WriteTo(append(header, b...), pc.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (pc *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, from, err := pc.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// only datagrams from the relay that are not fragmented
+		if udp, ok := from.(*net.UDPAddr); !ok || !udp.IP.Equal(pc.relay.IP) || n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		addr, err := readSocksAddr(r)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), addr, nil
+	}
+}
+
+func (pc *packetConn) Close() error {
+	pc.control.Close() //nolint:errcheck
+	return pc.PacketConn.Close()
+}
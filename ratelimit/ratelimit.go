@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket limiting transfers to a number of bytes per
+// second. Waiters are served in arrival order, so peers sharing a limiter
+// get equal shares of the bandwidth. A limiter can have a parent, then a
+// transfer has to pass both, which gives session, torrent and peer limits.
+type Limiter struct {
+	m      sync.Mutex
+	rate   int
+	parent *Limiter
+	// paid and reserved are the tokens added and taken since creation.
+	// A waiter holds a ticket and may continue once paid reaches it.
+	paid     float64
+	reserved float64
+	last     time.Time
+	changed  chan struct{}
+}
+
+// New returns a limiter for rate bytes per second. Zero rate means unlimited.
+func New(rate int, parent *Limiter) *Limiter {
+	return &Limiter{
+		rate:    max(rate, 0),
+		parent:  parent,
+		paid:    float64(max(rate, 0)),
+		last:    time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+func (l *Limiter) Rate() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.rate
+}
+
+// SetRate changes the rate. Waiting transfers continue with the new rate.
+func (l *Limiter) SetRate(rate int) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.refill(time.Now())
+	l.rate = max(rate, 0)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *Limiter) SetParent(parent *Limiter) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.parent = parent
+}
+
+// refill must be called with l.m held. The bucket holds at most one second of tokens.
+func (l *Limiter) refill(now time.Time) {
+	if l.rate == 0 {
+		l.paid = l.reserved
+	} else {
+		l.paid += now.Sub(l.last).Seconds() * float64(l.rate)
+		l.paid = min(l.paid, l.reserved+float64(l.rate))
+	}
+	l.last = now
+}
+
+// WaitN blocks until n bytes may be transferred or ctx is done.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.m.Lock()
+	l.refill(time.Now())
+	l.reserved += float64(n)
+	ticket := l.reserved
+	parent := l.parent
+	for l.rate > 0 && l.paid < ticket {
+		wait := time.Duration((ticket - l.paid) / float64(l.rate) * float64(time.Second))
+		changed := l.changed
+		l.m.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+		case <-ctx.Done():
+			timer.Stop()
+			l.m.Lock()
+			// give the tokens to the next waiters
+			l.paid += float64(n)
+			l.m.Unlock()
+			return ctx.Err()
+		}
+		timer.Stop()
+
+		l.m.Lock()
+		l.refill(time.Now())
+	}
+	l.m.Unlock()
+
+	return parent.WaitN(ctx, n)
+}
@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterUnlimited(t *testing.T) {
+	t.Parallel()
+	l := New(0, nil)
+	start := time.Now()
+	for range 100 {
+		require.NoError(t, l.WaitN(context.Background(), 1<<20))
+	}
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	var nilLimiter *Limiter
+	require.NoError(t, nilLimiter.WaitN(context.Background(), 1))
+}
+
+func TestLimiterRate(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	l := New(1000, nil)
+
+	start := time.Now()
+	// the full bucket allows one second of data at once
+	require.NoError(l.WaitN(context.Background(), 1000))
+	require.Less(time.Since(start), 50*time.Millisecond)
+
+	require.NoError(l.WaitN(context.Background(), 200))
+	require.GreaterOrEqual(time.Since(start), 180*time.Millisecond)
+}
+
+func TestLimiterParent(t *testing.T) {
+	t.Parallel()
+	parent := New(1000, nil)
+	l := New(0, parent)
+
+	start := time.Now()
+	require.NoError(t, l.WaitN(context.Background(), 1200))
+	require.GreaterOrEqual(t, time.Since(start), 180*time.Millisecond)
+}
+
+func TestLimiterFairShare(t *testing.T) {
+	t.Parallel()
+	l := New(10000, nil)
+	require.NoError(t, l.WaitN(context.Background(), 10000))
+
+	var m sync.Mutex
+	received := map[int]int{}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	for id := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l.WaitN(ctx, 100) == nil {
+				m.Lock()
+				received[id] += 100
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.InDelta(t, received[0], received[1], 300)
+}
+
+func TestLimiterSetRateWakesWaiters(t *testing.T) {
+	t.Parallel()
+	l := New(1, nil)
+	require.NoError(t, l.WaitN(context.Background(), 1))
+
+	done := make(chan error)
+	go func() {
+		done <- l.WaitN(context.Background(), 1000)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	l.SetRate(0)
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("waiter not woken by rate change")
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	t.Parallel()
+	l := New(1, nil)
+	require.NoError(t, l.WaitN(context.Background(), 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, l.WaitN(ctx, 1000), context.DeadlineExceeded)
+}
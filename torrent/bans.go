@@ -0,0 +1,147 @@
+package torrent
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBanThreshold = 3
+	defaultBanDuration  = time.Hour
+	// maxFailureEntries bounds the IPs with hash failures below the threshold
+	maxFailureEntries = 4096
+)
+
+// BannedIP is an entry of the ban list. Until is zero for permanent bans.
+type BannedIP struct {
+	IP    net.IP
+	Until time.Time
+}
+
+// banList keeps banned IPs and counts hash failures of peers. An IP that
+// sent data of threshold failed pieces is banned for duration. Failures are
+// forgotten after duration without a new one.
+type banList struct {
+	threshold int
+	duration  time.Duration
+
+	m        sync.Mutex
+	bans     map[string]BannedIP
+	failures map[string]hashFailures
+	onBan    func(ip net.IP)
+}
+
+type hashFailures struct {
+	count int
+	last  time.Time
+}
+
+func newBanList(threshold int, duration time.Duration) *banList {
+	return &banList{
+		threshold: threshold,
+		duration:  duration,
+		bans:      map[string]BannedIP{},
+		failures:  map[string]hashFailures{},
+	}
+}
+
+func (bl *banList) setOnBan(onBan func(ip net.IP)) {
+	bl.m.Lock()
+	defer bl.m.Unlock()
+	bl.onBan = onBan
+}
+
+// Ban bans the IP for d, zero d bans it permanently. Connections from the IP are closed.
+func (bl *banList) Ban(ip net.IP, d time.Duration, now time.Time) {
+	ban := BannedIP{IP: ip}
+	if d > 0 {
+		ban.Until = now.Add(d)
+	}
+
+	bl.m.Lock()
+	bl.bans[ip.String()] = ban
+	onBan := bl.onBan
+	bl.m.Unlock()
+
+	if onBan != nil {
+		onBan(ip)
+	}
+}
+
+func (bl *banList) Unban(ip net.IP) {
+	bl.m.Lock()
+	defer bl.m.Unlock()
+	delete(bl.bans, ip.String())
+	delete(bl.failures, ip.String())
+}
+
+func (bl *banList) Banned(ip net.IP, now time.Time) bool {
+	bl.m.Lock()
+	defer bl.m.Unlock()
+	ban, ok := bl.bans[ip.String()]
+	if !ok {
+		return false
+	}
+	if !ban.Until.IsZero() && !now.Before(ban.Until) {
+		delete(bl.bans, ip.String())
+		delete(bl.failures, ip.String())
+		return false
+	}
+	return true
+}
+
+// Bans returns the active bans.
+func (bl *banList) Bans(now time.Time) []BannedIP {
+	bl.m.Lock()
+	defer bl.m.Unlock()
+	bans := []BannedIP{}
+	for _, ban := range bl.bans {
+		if ban.Until.IsZero() || now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+// hashFailed counts a failed piece for every peer that contributed data to
+// it. It returns the IPs that got banned.
+func (bl *banList) hashFailed(contributors []net.IP, now time.Time) []net.IP {
+	bl.m.Lock()
+	bl.pruneFailures(now)
+	banned := []net.IP{}
+	for _, ip := range contributors {
+		f := bl.failures[ip.String()]
+		f.count++
+		f.last = now
+		bl.failures[ip.String()] = f
+		if f.count >= bl.threshold {
+			banned = append(banned, ip)
+		}
+	}
+	bl.m.Unlock()
+
+	for _, ip := range banned {
+		bl.Ban(ip, bl.duration, now)
+	}
+	return banned
+}
+
+// pruneFailures drops expired failures and, above maxFailureEntries, the
+// oldest ones. It must be called with bl.m held.
+func (bl *banList) pruneFailures(now time.Time) {
+	for ip, f := range bl.failures {
+		if now.Sub(f.last) >= bl.duration {
+			delete(bl.failures, ip)
+		}
+	}
+	for len(bl.failures) >= maxFailureEntries {
+		oldest := ""
+		for ip, f := range bl.failures {
+			if oldest == "" || f.last.Before(bl.failures[oldest].last) {
+				oldest = ip
+			}
+		}
+		delete(bl.failures, oldest)
+	}
+}
@@ -0,0 +1,146 @@
+package torrent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lksndrttm/torrent/bitfield"
+	"github.com/lksndrttm/torrent/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBanListExpiry(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	now := time.Now()
+	bl := newBanList(2, time.Hour)
+	ip := net.ParseIP("10.0.0.1")
+	other := net.ParseIP("10.0.0.2")
+
+	require.Empty(bl.hashFailed([]net.IP{ip, other}, now))
+	require.Equal([]net.IP{ip}, bl.hashFailed([]net.IP{ip}, now))
+	require.True(bl.Banned(ip, now))
+	require.False(bl.Banned(other, now))
+	require.Len(bl.Bans(now), 1)
+
+	require.True(bl.Banned(ip, now.Add(time.Hour-time.Second)))
+	require.False(bl.Banned(ip, now.Add(time.Hour)))
+	require.Empty(bl.Bans(now.Add(time.Hour)))
+	// the failure count starts over after the ban
+	require.Empty(bl.hashFailed([]net.IP{ip}, now))
+
+	bl.Ban(other, 0, now)
+	require.True(bl.Banned(other, now.Add(24*time.Hour)))
+	bl.Unban(other)
+	require.False(bl.Banned(other, now))
+}
+
+func TestBanListForgetsFailures(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	now := time.Now()
+	bl := newBanList(2, time.Hour)
+	ip := net.ParseIP("10.0.0.1")
+
+	require.Empty(bl.hashFailed([]net.IP{ip}, now))
+	// the first failure expired
+	require.Empty(bl.hashFailed([]net.IP{ip}, now.Add(time.Hour)))
+	require.Len(bl.failures, 1)
+
+	for i := range maxFailureEntries {
+		bl.hashFailed([]net.IP{{10, 1, byte(i >> 8), byte(i)}}, now.Add(time.Hour+time.Duration(i+1)))
+	}
+	require.Len(bl.failures, maxFailureEntries)
+	_, ok := bl.failures[ip.String()]
+	require.False(ok, "the oldest entry is dropped")
+}
+
+func TestBlameAllContributors(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, _, err := generateTestTorrent(2, 2, BlockSize, BlockSize)
+	require.NoError(err)
+	tr := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+	tr.bans = newBanList(1, time.Hour)
+	addrs := testPeerAddrs(t, "10.0.0.1:1", "10.0.0.2:1")
+	tr.pool.Add(addrs, SourceTracker)
+
+	pdInfo := NewPieceDownloadInfo(0, 2*BlockSize)
+	pdInfo.setSource(0, addrs[0])
+	pdInfo.setSource(BlockSize, addrs[1])
+	contributors := pdInfo.contributors()
+	require.Equal(addrs, contributors)
+
+	require.True(tr.blame(contributors, addrs[1].IP))
+	for _, addr := range addrs {
+		require.False(tr.allowed(addr), addr.String())
+	}
+	for _, kp := range tr.KnownPeers() {
+		require.Equal(1, kp.HashFailures)
+	}
+}
+
+func TestHashFailingPeerIsBanned(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, tdata, err := generateTestTorrent(defaultBanThreshold, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	corrupted := bytes.Clone(tdata)
+	for i := range defaultBanThreshold {
+		corrupted[i*BlockSize]++
+	}
+	addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bitfield.Bitfield{255}, tmeta, corrupted, BlockSize))
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	tr := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, t.TempDir())
+	events, cancel := tr.Subscribe()
+	defer cancel()
+	tr.Download()
+
+	require.ErrorIs(tr.Err(), ErrNoPeers)
+	require.False(tr.allowed(peerAddr))
+	kp := tr.KnownPeers()
+	require.Len(kp, 1)
+	require.Equal(defaultBanThreshold, kp[0].HashFailures)
+
+	for e := range events {
+		if e.Type == EventPeerBanned {
+			require.True(peerAddr.IP.Equal(e.Peer.IP))
+			break
+		}
+	}
+
+	tr.Unban(peerAddr.IP)
+	require.True(tr.allowed(peerAddr))
+}
+
+func TestSessionBanIP(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s, err := NewSession(Config{})
+	require.NoError(err)
+	defer s.Close() //nolint:errcheck
+	tmeta, _, err := generateTestTorrent(1, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	tr := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+	require.NoError(s.addTorrent(tr))
+
+	addr := peer.PeerAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	s.BanIP(addr.IP, time.Hour)
+	require.False(tr.allowed(addr))
+	bans := s.BannedIPs()
+	require.Len(bans, 1)
+	require.True(addr.IP.Equal(bans[0].IP))
+
+	s.UnbanIP(addr.IP)
+	require.True(tr.allowed(addr))
+	require.Empty(s.BannedIPs())
+}
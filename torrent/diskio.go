@@ -0,0 +1,284 @@
+package torrent
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	defaultDiskWorkers    = 4
+	defaultWriteCacheSize = 64 << 20
+	defaultReadCacheSize  = 32 << 20
+	maxCoalescedWrite     = 4 << 20
+)
+
+var errDiskPoolClosed = errors.New("disk pool closed")
+
+type storage interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// diskPool runs storage writes on a fixed number of workers. Verified pieces
+// wait in a bounded write cache, adjacent pieces are written with one call.
+// When the cache is full new writes block, which slows down the peers
+// delivering pieces instead of growing memory usage.
+type diskPool struct {
+	m          sync.Mutex
+	spaceFreed *sync.Cond
+	maxPending int
+	pending    int
+	jobs       chan diskJob
+	readCache  *pieceCache
+	wg         sync.WaitGroup
+
+	// closeM is held for reading while a job is queued, so jobs is not
+	// closed under a sender
+	closeM sync.RWMutex
+	closed bool
+}
+
+type diskJob struct {
+	disk *torrentDisk
+	id   uint32
+}
+
+func newDiskPool(workers, writeCacheSize, readCacheSize int) *diskPool {
+	dp := &diskPool{
+		maxPending: writeCacheSize,
+		jobs:       make(chan diskJob, 256),
+		readCache:  newPieceCache(readCacheSize),
+	}
+	dp.spaceFreed = sync.NewCond(&dp.m)
+
+	for range workers {
+		dp.wg.Add(1)
+		go func() {
+			defer dp.wg.Done()
+			for job := range dp.jobs {
+				job.disk.writeRun(job.id)
+			}
+		}()
+	}
+	return dp
+}
+
+func (dp *diskPool) reserve(n int) {
+	dp.m.Lock()
+	defer dp.m.Unlock()
+	for dp.pending > 0 && dp.pending+n > dp.maxPending {
+		dp.spaceFreed.Wait()
+	}
+	dp.pending += n
+}
+
+func (dp *diskPool) release(n int) {
+	dp.m.Lock()
+	defer dp.m.Unlock()
+	dp.pending -= n
+	dp.spaceFreed.Broadcast()
+}
+
+// Close waits for queued writes and stops the workers. Later writes fail
+// with errDiskPoolClosed.
+func (dp *diskPool) Close() {
+	dp.closeM.Lock()
+	dp.closed = true
+	close(dp.jobs)
+	dp.closeM.Unlock()
+	dp.wg.Wait()
+}
+
+// torrentDisk is the per torrent part of the disk pool.
+type torrentDisk struct {
+	pool        *diskPool
+	storage     storage
+	pieceLength int
+	length      int
+	onWritten   func(piece *Piece, err error)
+
+	m       sync.Mutex
+	writes  map[uint32][]byte
+	writing map[uint32][]byte
+	wg      sync.WaitGroup
+}
+
+func newTorrentDisk(pool *diskPool, s storage, pieceLength, length int, onWritten func(*Piece, error)) *torrentDisk {
+	return &torrentDisk{
+		pool:        pool,
+		storage:     s,
+		pieceLength: pieceLength,
+		length:      length,
+		onWritten:   onWritten,
+		writes:      map[uint32][]byte{},
+		writing:     map[uint32][]byte{},
+	}
+}
+
+// WritePiece queues a verified piece for writing. It blocks while the write
+// cache is full and fails once the pool is closed.
+func (td *torrentDisk) WritePiece(id uint32, data []byte) error {
+	td.pool.reserve(len(data))
+	td.pool.closeM.RLock()
+	defer td.pool.closeM.RUnlock()
+	if td.pool.closed {
+		td.pool.release(len(data))
+		return errDiskPoolClosed
+	}
+	td.wg.Add(1)
+
+	td.m.Lock()
+	td.writes[id] = data
+	td.m.Unlock()
+
+	td.pool.jobs <- diskJob{disk: td, id: id}
+	return nil
+}
+
+// writeRun writes the piece together with the adjacent cached pieces.
+func (td *torrentDisk) writeRun(id uint32) {
+	td.m.Lock()
+	if _, ok := td.writes[id]; !ok {
+		// already written as part of another run
+		td.m.Unlock()
+		return
+	}
+
+	size := len(td.writes[id])
+	first := id
+	for first > 0 {
+		data, ok := td.writes[first-1]
+		if !ok || size+len(data) > maxCoalescedWrite {
+			break
+		}
+		size += len(data)
+		first--
+	}
+	last := id
+	for {
+		data, ok := td.writes[last+1]
+		if !ok || size+len(data) > maxCoalescedWrite {
+			break
+		}
+		size += len(data)
+		last++
+	}
+
+	buf := make([]byte, 0, size)
+	for i := first; i <= last; i++ {
+		buf = append(buf, td.writes[i]...)
+		td.writing[i] = td.writes[i]
+		delete(td.writes, i)
+	}
+	td.m.Unlock()
+
+	_, err := td.storage.WriteAt(buf, int64(first)*int64(td.pieceLength))
+
+	pieces := []*Piece{}
+	td.m.Lock()
+	for i := first; i <= last; i++ {
+		pieces = append(pieces, &Piece{ID: i, Data: td.writing[i]})
+		delete(td.writing, i)
+	}
+	td.m.Unlock()
+	td.pool.release(size)
+
+	for _, p := range pieces {
+		td.onWritten(p, err)
+		td.wg.Done()
+	}
+}
+
+// Flush waits until all queued pieces are written.
+func (td *torrentDisk) Flush() {
+	td.wg.Wait()
+}
+
+// ReadPiece returns piece data from the write cache, the read cache or the storage.
+func (td *torrentDisk) ReadPiece(id uint32) ([]byte, error) {
+	td.m.Lock()
+	data, ok := td.writes[id]
+	if !ok {
+		data, ok = td.writing[id]
+	}
+	td.m.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	key := pieceKey{disk: td, id: id}
+	if data, ok := td.pool.readCache.Get(key); ok {
+		return data, nil
+	}
+
+	begin := int(id) * td.pieceLength
+	end := min(begin+td.pieceLength, td.length)
+	data = make([]byte, end-begin)
+	if _, err := td.storage.ReadAt(data, int64(begin)); err != nil {
+		return nil, err
+	}
+	td.pool.readCache.Put(key, data)
+	return data, nil
+}
+
+type pieceKey struct {
+	disk *torrentDisk
+	id   uint32
+}
+
+type cacheEntry struct {
+	key  pieceKey
+	data []byte
+}
+
+// pieceCache is a LRU cache of recently read pieces.
+type pieceCache struct {
+	m       sync.Mutex
+	maxSize int
+	size    int
+	order   *list.List
+	entries map[pieceKey]*list.Element
+}
+
+func newPieceCache(maxSize int) *pieceCache {
+	return &pieceCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: map[pieceKey]*list.Element{},
+	}
+}
+
+func (pc *pieceCache) Get(key pieceKey) ([]byte, bool) {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+	e, ok := pc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	pc.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).data, true
+}
+
+func (pc *pieceCache) Put(key pieceKey, data []byte) {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+	if len(data) > pc.maxSize {
+		return
+	}
+	if e, ok := pc.entries[key]; ok {
+		pc.order.MoveToFront(e)
+		return
+	}
+
+	pc.entries[key] = pc.order.PushFront(&cacheEntry{key: key, data: data})
+	pc.size += len(data)
+	for pc.size > pc.maxSize {
+		e := pc.order.Back()
+		entry := e.Value.(*cacheEntry)
+		pc.order.Remove(e)
+		delete(pc.entries, entry.key)
+		pc.size -= len(entry.data)
+	}
+}
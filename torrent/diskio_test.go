@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type writeCall struct {
+	off    int64
+	length int
+}
+
+type memStorage struct {
+	m       sync.Mutex
+	data    []byte
+	writes  []writeCall
+	reads   int
+	blockCh chan struct{}
+}
+
+func (ms *memStorage) ReadAt(p []byte, off int64) (int, error) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+	ms.reads++
+	return copy(p, ms.data[off:]), nil
+}
+
+func (ms *memStorage) WriteAt(p []byte, off int64) (int, error) {
+	if ms.blockCh != nil {
+		<-ms.blockCh
+	}
+	ms.m.Lock()
+	defer ms.m.Unlock()
+	ms.writes = append(ms.writes, writeCall{off: off, length: len(p)})
+	return copy(ms.data[off:], p), nil
+}
+
+func TestDiskCoalescesAdjacentPieces(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	pieceLen := 4
+	ms := &memStorage{data: make([]byte, 4*pieceLen), blockCh: make(chan struct{})}
+	pool := newDiskPool(1, 100, 100)
+	defer pool.Close()
+
+	written := make(chan uint32, 4)
+	disk := newTorrentDisk(pool, ms, pieceLen, len(ms.data), func(p *Piece, err error) {
+		require.NoError(err)
+		written <- p.ID
+	})
+
+	require.NoError(disk.WritePiece(0, []byte("0000")))
+	require.Eventually(func() bool {
+		disk.m.Lock()
+		defer disk.m.Unlock()
+		return len(disk.writing) == 1
+	}, time.Second, time.Millisecond)
+	for id := range uint32(3) {
+		require.NoError(disk.WritePiece(id+1, []byte{byte('1' + id), byte('1' + id), byte('1' + id), byte('1' + id)}))
+	}
+	close(ms.blockCh)
+	disk.Flush()
+
+	require.Len(written, 4)
+	require.Equal([]writeCall{{off: 0, length: 4}, {off: 4, length: 12}}, ms.writes)
+	require.Equal([]byte("0000111122223333"), ms.data)
+}
+
+func TestDiskWriteBackPressure(t *testing.T) {
+	t.Parallel()
+	ms := &memStorage{data: make([]byte, 12), blockCh: make(chan struct{})}
+	pool := newDiskPool(1, 8, 0)
+	defer pool.Close()
+	disk := newTorrentDisk(pool, ms, 4, 12, func(*Piece, error) {})
+
+	require.NoError(t, disk.WritePiece(0, make([]byte, 4)))
+	require.NoError(t, disk.WritePiece(1, make([]byte, 4)))
+
+	done := make(chan struct{})
+	go func() {
+		disk.WritePiece(2, make([]byte, 4)) //nolint:errcheck
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("write must block while the write cache is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(ms.blockCh)
+	<-done
+	disk.Flush()
+}
+
+func TestDiskWriteAfterClose(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	ms := &memStorage{data: make([]byte, 4)}
+	pool := newDiskPool(1, 100, 100)
+	disk := newTorrentDisk(pool, ms, 4, 4, func(*Piece, error) {})
+	pool.Close()
+
+	require.ErrorIs(disk.WritePiece(0, []byte("0000")), errDiskPoolClosed)
+	disk.Flush()
+	require.Zero(pool.pending)
+	require.Empty(ms.writes)
+}
+
+func TestDiskReadCache(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	ms := &memStorage{data: []byte("0000111122")}
+	pool := newDiskPool(1, 100, 100)
+	defer pool.Close()
+	disk := newTorrentDisk(pool, ms, 4, len(ms.data), func(*Piece, error) {})
+
+	for range 2 {
+		data, err := disk.ReadPiece(2)
+		require.NoError(err)
+		require.Equal([]byte("22"), data)
+	}
+	require.Equal(1, ms.reads)
+}
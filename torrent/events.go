@@ -0,0 +1,210 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lksndrttm/torrent/peer"
+	"github.com/lksndrttm/torrent/tracker"
+)
+
+type EventType int
+
+const (
+	EventPieceVerified EventType = iota
+	EventPieceHashFailed
+	EventPeerConnected
+	EventPeerDisconnected
+	EventTrackerAnnounce
+	EventStateChanged
+	EventDownloadComplete
+	EventStorageError
+	EventPeerBanned
+	EventWebSeedError
+	EventsDropped
+)
+
+// maxQueuedEvents is the number of events kept for a subscriber that does
+// not read its channel.
+const maxQueuedEvents = 1024
+
+func (et EventType) String() string {
+	switch et {
+	case EventPieceVerified:
+		return "piece verified"
+	case EventPieceHashFailed:
+		return "piece hash failed"
+	case EventPeerConnected:
+		return "peer connected"
+	case EventPeerDisconnected:
+		return "peer disconnected"
+	case EventTrackerAnnounce:
+		return "tracker announce"
+	case EventStateChanged:
+		return "state changed"
+	case EventDownloadComplete:
+		return "download complete"
+	case EventStorageError:
+		return "storage error"
+	case EventPeerBanned:
+		return "peer banned"
+	case EventWebSeedError:
+		return "web seed error"
+	case EventsDropped:
+		return "events dropped"
+	default:
+		return fmt.Sprintf("event(%d)", int(et))
+	}
+}
+
+// Event describes something that happened to a torrent. Only the fields
+// related to the event type are set.
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Torrent *Torrent
+
+	// Piece is set for piece events.
+	Piece int
+	// Peer is set for peer and piece events, only the IP for EventPeerBanned.
+	Peer peer.PeerAddr
+	// WebSeed is the URL for web seed events and pieces from web seeds.
+	WebSeed string
+	// State is the new state for EventStateChanged.
+	State State
+	// Announce and Peers describe the announce for EventTrackerAnnounce.
+	Announce tracker.Event
+	Peers    int
+	// Err is set for failed announces, storage and web seed errors and the
+	// error state.
+	Err error
+	// Dropped is the number of oldest events a slow subscriber lost, it is
+	// set for EventsDropped, which has no Torrent.
+	Dropped int
+}
+
+// eventBus delivers events to subscribers. Every subscriber has its own
+// queue, so publishing never blocks. A subscriber that falls more than
+// maxQueuedEvents behind loses the oldest events and receives
+// EventsDropped before the next delivered one.
+type eventBus struct {
+	m      sync.Mutex
+	subs   map[int]*subscriber
+	nextID int
+}
+
+type subscriber struct {
+	ch      chan Event
+	done    chan struct{}
+	m       sync.Mutex
+	queue   []Event
+	dropped int
+	ready   chan struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: map[int]*subscriber{}}
+}
+
+// Subscribe returns a channel with all events published from now on and a
+// function that cancels the subscription and closes the channel.
+func (eb *eventBus) Subscribe() (<-chan Event, func()) {
+	sub := &subscriber{
+		ch:    make(chan Event),
+		done:  make(chan struct{}),
+		ready: make(chan struct{}, 1),
+	}
+
+	eb.m.Lock()
+	id := eb.nextID
+	eb.nextID++
+	eb.subs[id] = sub
+	eb.m.Unlock()
+
+	go sub.deliver()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			eb.m.Lock()
+			delete(eb.subs, id)
+			eb.m.Unlock()
+			close(sub.done)
+		})
+	}
+	return sub.ch, cancel
+}
+
+func (eb *eventBus) publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	eb.m.Lock()
+	defer eb.m.Unlock()
+	for _, sub := range eb.subs {
+		sub.m.Lock()
+		if len(sub.queue) >= maxQueuedEvents {
+			sub.queue = sub.queue[1:]
+			sub.dropped++
+		}
+		sub.queue = append(sub.queue, e)
+		sub.m.Unlock()
+
+		select {
+		case sub.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (sub *subscriber) deliver() {
+	defer close(sub.ch)
+	for {
+		sub.m.Lock()
+		if len(sub.queue) == 0 {
+			sub.m.Unlock()
+			select {
+			case <-sub.ready:
+				continue
+			case <-sub.done:
+				return
+			}
+		}
+		var e Event
+		if sub.dropped > 0 {
+			e = Event{Type: EventsDropped, Time: time.Now(), Dropped: sub.dropped}
+			sub.dropped = 0
+		} else {
+			e = sub.queue[0]
+			sub.queue = sub.queue[1:]
+		}
+		sub.m.Unlock()
+
+		select {
+		case sub.ch <- e:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// Subscribe returns a channel with the torrent events and a function that cancels the subscription.
+func (t *Torrent) Subscribe() (<-chan Event, func()) {
+	return t.events.Subscribe()
+}
+
+func (t *Torrent) publish(e Event) {
+	e.Torrent = t
+	t.events.publish(e)
+	if t.sessionEvents != nil {
+		t.sessionEvents.publish(e)
+	}
+}
+
+// Subscribe returns a channel with the events of all session torrents and a
+// function that cancels the subscription.
+func (s *Session) Subscribe() (<-chan Event, func()) {
+	return s.events.Subscribe()
+}
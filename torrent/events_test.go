@@ -0,0 +1,129 @@
+package torrent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lksndrttm/torrent/bitfield"
+	"github.com/lksndrttm/torrent/peer"
+	"github.com/lksndrttm/torrent/tracker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBusDeliversInOrder(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	eb := newEventBus()
+
+	events, cancel := eb.Subscribe()
+	// nobody reads yet, publishing must not block
+	for i := range 100 {
+		eb.publish(Event{Type: EventPieceVerified, Piece: i})
+	}
+	for i := range 100 {
+		e := <-events
+		require.Equal(i, e.Piece)
+		require.False(e.Time.IsZero())
+	}
+
+	cancel()
+	cancel()
+	_, ok := <-events
+	require.False(ok)
+	eb.publish(Event{Type: EventPieceVerified})
+}
+
+func TestEventBusDropsOldest(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	eb := newEventBus()
+
+	events, cancel := eb.Subscribe()
+	defer cancel()
+	total := maxQueuedEvents + 10
+	for i := range total {
+		eb.publish(Event{Type: EventPieceVerified, Piece: i})
+	}
+
+	received, dropped, last := 0, 0, -1
+	for last < total-1 {
+		e := <-events
+		if e.Type == EventsDropped {
+			dropped += e.Dropped
+			continue
+		}
+		require.Greater(e.Piece, last)
+		last = e.Piece
+		received++
+	}
+	require.Positive(dropped)
+	require.Equal(total, received+dropped)
+}
+
+func TestDownloadEvents(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, tdata, err := generateTestTorrent(3, 2, BlockSize, BlockSize)
+	require.NoError(err)
+	bf := bitfield.New(len(tmeta.PieceHashes))
+	for i := range tmeta.PieceHashes {
+		bf.SetPiece(i)
+	}
+	addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bf, tmeta, tdata, BlockSize))
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	s, err := NewSession(Config{})
+	require.NoError(err)
+	defer s.Close() //nolint:errcheck
+	tr := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, t.TempDir())
+	require.NoError(s.addTorrent(tr))
+
+	events, cancel := tr.Subscribe()
+	defer cancel()
+	sessionEvents, sessionCancel := s.Subscribe()
+	defer sessionCancel()
+
+	tr.Start()
+
+	got := map[EventType]int{}
+	states := []State{}
+	announces := []tracker.Event{}
+	timeout := time.After(5 * time.Second)
+	for len(states) == 0 || states[len(states)-1] == StateDownloading {
+		select {
+		case e := <-events:
+			require.Same(tr, e.Torrent)
+			got[e.Type]++
+			switch e.Type {
+			case EventStateChanged:
+				states = append(states, e.State)
+			case EventTrackerAnnounce:
+				require.NoError(e.Err)
+				announces = append(announces, e.Announce)
+			}
+		case <-timeout:
+			t.Fatalf("download not finished, events: %v", got)
+		}
+	}
+
+	require.Equal([]State{StateDownloading, StateCompleted}, states)
+	require.Equal(3, got[EventPieceVerified])
+	require.Equal(1, got[EventDownloadComplete])
+	require.Equal(1, got[EventPeerConnected])
+	require.Equal(1, got[EventPeerDisconnected])
+	require.Zero(got[EventPieceHashFailed])
+	require.Equal([]tracker.Event{tracker.EventStarted, tracker.EventCompleted, tracker.EventStopped}, announces)
+
+	select {
+	case e := <-sessionEvents:
+		require.Same(tr, e.Torrent)
+		require.Equal(EventStateChanged, e.Type)
+		require.Equal(StateDownloading, e.State)
+	case <-time.After(time.Second):
+		t.Fatal("no session event")
+	}
+}
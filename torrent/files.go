@@ -0,0 +1,473 @@
+package torrent
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	md "github.com/lksndrttm/torrent/metadata"
+)
+
+type Priority int
+
+const (
+	PrioritySkip   Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+}
+
+// File is a snapshot of a torrent file state.
+type File struct {
+	Path       string
+	Length     int
+	Offset     int
+	Priority   Priority
+	Downloaded int
+	// Pad files only align the next file and are never stored.
+	Pad bool
+}
+
+func torrentFiles(tmeta *md.TorrentMetadata) []md.FileInfo {
+	if len(tmeta.Files) == 0 {
+		return []md.FileInfo{{Path: []string{tmeta.Name}, Length: tmeta.Length}}
+	}
+	return tmeta.Files
+}
+
+// stored reports whether the file has data on disk. Pad files are zeros and
+// symlinks are created on completion.
+func stored(f md.FileInfo) bool {
+	return !f.IsPad() && !f.IsSymlink()
+}
+
+// piecePriorities calculates piece priorities from file priorities.
+// A piece gets the highest priority of the files it overlaps.
+func piecePriorities(tmeta *md.TorrentMetadata, filePriorities []Priority) []Priority {
+	prios := make([]Priority, tmeta.PieceCount())
+	for i := range prios {
+		prios[i] = PrioritySkip
+	}
+
+	for i, f := range torrentFiles(tmeta) {
+		if f.Length == 0 || !stored(f) {
+			continue
+		}
+		first := f.Offset / tmeta.PieceLength
+		last := (f.Offset + f.Length - 1) / tmeta.PieceLength
+		for p := first; p <= last && p < len(prios); p++ {
+			prios[p] = max(prios[p], filePriorities[i])
+		}
+	}
+	return prios
+}
+
+// fileStorage maps the torrent byte stream to files on disk.
+// Files are created lazily when they become wanted. Until then bytes of
+// skipped files in their first and last piece, which other files share, are
+// kept in a hidden part file. Data fetched for the rest of a skipped file,
+// like for a reader, creates the file.
+// Gaps between the piece aligned files of v2 torrents and pad files read as
+// zeros and are not stored.
+type fileStorage struct {
+	m           sync.Mutex
+	dir         string
+	pieceLength int
+	length      int
+	files       []md.FileInfo
+	handles     []*os.File
+	// parts holds the part file ranges of every stored file
+	parts    [][]partRange
+	partPath string
+	partFile *os.File
+}
+
+// partRange places the bytes of a file in its first or last piece in the
+// part file.
+type partRange struct {
+	// begin and end are torrent offsets
+	begin, end int
+	offset     int64
+}
+
+func newFileStorage(dir string, tmeta *md.TorrentMetadata, filePriorities []Priority) (*fileStorage, error) {
+	fs := &fileStorage{
+		dir:         dir,
+		pieceLength: tmeta.PieceLength,
+		length:      tmeta.Length,
+		files:       torrentFiles(tmeta),
+		partPath:    filepath.Join(dir, "."+hex.EncodeToString(tmeta.InfoHash[:])+".parts"),
+	}
+	fs.handles = make([]*os.File, len(fs.files))
+	fs.parts = make([][]partRange, len(fs.files))
+
+	var offset int64
+	for i, f := range fs.files {
+		if f.Length == 0 || !stored(f) {
+			continue
+		}
+		begin, end := f.Offset, f.Offset+f.Length
+		firstEnd := min(end, (begin/fs.pieceLength+1)*fs.pieceLength)
+		lastBegin := max(firstEnd, (end-1)/fs.pieceLength*fs.pieceLength)
+		fs.parts[i] = append(fs.parts[i], partRange{begin: begin, end: firstEnd, offset: offset})
+		offset += int64(firstEnd - begin)
+		if lastBegin < end {
+			fs.parts[i] = append(fs.parts[i], partRange{begin: lastBegin, end: end, offset: offset})
+			offset += int64(end - lastBegin)
+		}
+	}
+
+	for i, f := range fs.files {
+		if !stored(f) {
+			continue
+		}
+		// a skipped file on disk was created by data outside its boundary pieces
+		if _, err := os.Stat(fs.filePath(i)); filePriorities[i] == PrioritySkip && err != nil {
+			continue
+		}
+		if err := fs.materialize(i); err != nil {
+			fs.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
+	if err := fs.dropPart(); err != nil {
+		fs.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	return fs, nil
+}
+
+func (fs *fileStorage) filePath(i int) string {
+	return filepath.Join(fs.dir, filepath.Join(fs.files[i].Path...))
+}
+
+// openFile opens the file and reports whether it was created.
+func (fs *fileStorage) openFile(i int) (bool, error) {
+	path := fs.filePath(i)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return false, err
+	}
+	_, err := os.Stat(path)
+	created := errors.Is(err, os.ErrNotExist)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return false, err
+	}
+	fs.handles[i] = f
+	return created, nil
+}
+
+// part opens the part file. Without create a missing part file is
+// returned as nil.
+func (fs *fileStorage) part(create bool) (*os.File, error) {
+	if fs.partFile != nil {
+		return fs.partFile, nil
+	}
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	f, err := os.OpenFile(fs.partPath, flag, 0o644)
+	if errors.Is(err, os.ErrNotExist) && !create {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	fs.partFile = f
+	return f, nil
+}
+
+// dropPart removes the part file once every stored file is open, it holds
+// no data anymore then.
+func (fs *fileStorage) dropPart() error {
+	for i, f := range fs.files {
+		if f.Length > 0 && stored(f) && fs.handles[i] == nil {
+			return nil
+		}
+	}
+	if fs.partFile != nil {
+		if err := fs.partFile.Close(); err != nil {
+			return err
+		}
+		fs.partFile = nil
+	}
+	if err := os.Remove(fs.partPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// SetPriority creates a previously skipped file and moves its boundary bytes out of the part file.
+func (fs *fileStorage) SetPriority(i int, prio Priority) error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	if prio == PrioritySkip || fs.handles[i] != nil || !stored(fs.files[i]) {
+		return nil
+	}
+	if err := fs.materialize(i); err != nil {
+		return err
+	}
+	return fs.dropPart()
+}
+
+// materialize opens the file, a new file gets its bytes from the part file.
+func (fs *fileStorage) materialize(i int) error {
+	created, err := fs.openFile(i)
+	if err != nil || !created {
+		return err
+	}
+	part, err := fs.part(false)
+	if err != nil || part == nil {
+		return err
+	}
+	for _, r := range fs.parts[i] {
+		buf := make([]byte, r.end-r.begin)
+		n, err := part.ReadAt(buf, r.offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		if _, err := fs.handles[i].WriteAt(buf[:n], int64(r.begin-fs.files[i].Offset)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inPart reports whether the bytes from begin to end of file i are in its
+// part file ranges.
+func (fs *fileStorage) inPart(i, begin, end int) bool {
+	for _, r := range fs.parts[i] {
+		if begin >= r.begin && begin < r.end {
+			begin = r.end
+		}
+	}
+	return begin >= end
+}
+
+// partIO reads or writes the bytes of the span of a skipped file in the part
+// file. Bytes outside the part ranges are left as they are.
+func (fs *fileStorage) partIO(s fileSpan, p []byte, off int64, write bool) error {
+	part, err := fs.part(write)
+	if err != nil || part == nil {
+		return err
+	}
+	begin, end := int(off)+s.bufBegin, int(off)+s.bufEnd
+	for _, r := range fs.parts[s.file] {
+		rBegin, rEnd := max(begin, r.begin), min(end, r.end)
+		if rBegin >= rEnd {
+			continue
+		}
+		buf := p[rBegin-int(off) : rEnd-int(off)]
+		at := r.offset + int64(rBegin-r.begin)
+		if write {
+			_, err = part.WriteAt(buf, at)
+		} else {
+			_, err = part.ReadAt(buf, at)
+		}
+		// the part file ends at the last written range, the rest reads as zeros
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+	return nil
+}
+
+type fileSpan struct {
+	file       int
+	fileOffset int64
+	bufBegin   int
+	bufEnd     int
+}
+
+func (fs *fileStorage) spans(length int, off int64) []fileSpan {
+	spans := []fileSpan{}
+	end := off + int64(length)
+	for i, f := range fs.files {
+		fBegin, fEnd := int64(f.Offset), int64(f.Offset+f.Length)
+		if fEnd <= off || fBegin >= end || !stored(f) {
+			continue
+		}
+		sBegin, sEnd := max(off, fBegin), min(end, fEnd)
+		spans = append(spans, fileSpan{
+			file:       i,
+			fileOffset: sBegin - fBegin,
+			bufBegin:   int(sBegin - off),
+			bufEnd:     int(sEnd - off),
+		})
+	}
+	return spans
+}
+
+func (fs *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	clear(p)
+	n := 0
+	for _, s := range fs.spans(len(p), off) {
+		if fs.handles[s.file] == nil {
+			if err := fs.partIO(s, p, off, false); err != nil {
+				return n, err
+			}
+			n += s.bufEnd - s.bufBegin
+			continue
+		}
+		read, err := fs.handles[s.file].ReadAt(p[s.bufBegin:s.bufEnd], s.fileOffset)
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	if n = min(len(p), max(fs.length-int(off), 0)); n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (fs *fileStorage) WriteAt(p []byte, off int64) (int, error) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	n := 0
+	for _, s := range fs.spans(len(p), off) {
+		if fs.handles[s.file] == nil {
+			begin := int(off) + s.bufBegin
+			if fs.inPart(s.file, begin, begin+s.bufEnd-s.bufBegin) {
+				if err := fs.partIO(s, p, off, true); err != nil {
+					return n, err
+				}
+				n += s.bufEnd - s.bufBegin
+				continue
+			}
+			if err := fs.materialize(s.file); err != nil {
+				return n, err
+			}
+			if err := fs.dropPart(); err != nil {
+				return n, err
+			}
+		}
+		written, err := fs.handles[s.file].WriteAt(p[s.bufBegin:s.bufEnd], s.fileOffset)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	if n = min(len(p), max(fs.length-int(off), 0)); n < len(p) {
+		return n, fmt.Errorf("write beyond torrent length")
+	}
+	return n, nil
+}
+
+// applyAttributes creates the symlinks and sets the executable bits of the
+// files (BEP 47). Hidden files need nothing on Unix.
+func (fs *fileStorage) applyAttributes() error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	for i, f := range fs.files {
+		switch {
+		case f.IsSymlink():
+			target := filepath.Join(f.SymlinkPath...)
+			if !filepath.IsLocal(target) {
+				return fmt.Errorf("symlink %s points outside the torrent", displayPath(f))
+			}
+			// multi-file paths start with the torrent directory
+			root := fs.dir
+			if len(f.Path) > 1 {
+				root = filepath.Join(fs.dir, f.Path[0])
+			}
+			link := fs.filePath(i)
+			rel, err := filepath.Rel(filepath.Dir(link), filepath.Join(root, target))
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(link), 0o755); err != nil {
+				return err
+			}
+			if err := os.Symlink(rel, link); err != nil && !errors.Is(err, os.ErrExist) {
+				return err
+			}
+		case f.IsExecutable() && fs.handles[i] != nil:
+			if err := os.Chmod(fs.filePath(i), 0o755); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *fileStorage) Close() error {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+
+	errs := []error{}
+	for i, f := range fs.handles {
+		if f != nil {
+			errs = append(errs, f.Close())
+			fs.handles[i] = nil
+		}
+	}
+	if fs.partFile != nil {
+		errs = append(errs, fs.partFile.Close())
+		fs.partFile = nil
+	}
+	return errors.Join(errs...)
+}
+
+// acquireStorage opens the torrent storage if needed. Every successful call
+// must be paired with releaseStorage.
+func (t *Torrent) acquireStorage() (*fileStorage, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.storage == nil {
+		storage, err := newFileStorage(t.outDir, t.metadata, t.filePriorities)
+		if err != nil {
+			return nil, err
+		}
+		t.storage = storage
+	}
+	t.storageRefs++
+	return t.storage, nil
+}
+
+// releaseStorage closes the storage when nobody uses it anymore.
+func (t *Torrent) releaseStorage() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.storageRefs--
+	if t.storageRefs > 0 {
+		return nil
+	}
+	err := t.storage.Close()
+	t.storage = nil
+	return err
+}
+
+func displayPath(f md.FileInfo) string {
+	return strings.Join(f.Path, "/")
+}
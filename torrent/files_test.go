@@ -0,0 +1,250 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lksndrttm/torrent/bitfield"
+	md "github.com/lksndrttm/torrent/metadata"
+	"github.com/lksndrttm/torrent/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func multiFileTestMetadata(data []byte, pieceLength int, fileLengths ...int) *md.TorrentMetadata {
+	tmeta := &md.TorrentMetadata{
+		Name:        "multi",
+		PieceLength: pieceLength,
+		Length:      len(data),
+	}
+	for i := 0; i < len(data); i += pieceLength {
+		tmeta.PieceHashes = append(tmeta.PieceHashes, sha1.Sum(data[i:min(i+pieceLength, len(data))]))
+	}
+	offset := 0
+	for i, l := range fileLengths {
+		name := string(rune('a' + i))
+		tmeta.Files = append(tmeta.Files, md.FileInfo{Path: []string{"multi", name}, Length: l, Offset: offset})
+		offset += l
+	}
+	return tmeta
+}
+
+func TestPiecePriorities(t *testing.T) {
+	t.Parallel()
+	tmeta := multiFileTestMetadata(make([]byte, 10), 4, 3, 3, 4)
+
+	prios := piecePriorities(tmeta, []Priority{PriorityNormal, PrioritySkip, PriorityHigh})
+
+	require.Equal(t, []Priority{PriorityNormal, PriorityHigh, PriorityHigh}, prios)
+}
+
+func TestFileStorageSkippedFileGoesToPartFile(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	dir := t.TempDir()
+
+	data := []byte("aaabbbcccc")
+	tmeta := multiFileTestMetadata(data, 4, 3, 3, 4)
+	fs, err := newFileStorage(dir, tmeta, []Priority{PriorityNormal, PrioritySkip, PriorityNormal})
+	require.NoError(err)
+	defer fs.Close() //nolint:errcheck
+
+	_, err = fs.WriteAt(data[:4], 0)
+	require.NoError(err)
+
+	_, err = os.Stat(filepath.Join(dir, "multi", "b"))
+	require.True(os.IsNotExist(err))
+
+	buf := make([]byte, 4)
+	_, err = fs.ReadAt(buf, 0)
+	require.NoError(err)
+	require.Equal(data[:4], buf)
+
+	require.NoError(fs.SetPriority(1, PriorityNormal))
+	content, err := os.ReadFile(filepath.Join(dir, "multi", "b"))
+	require.NoError(err)
+	require.Equal([]byte("b"), content)
+}
+
+func TestFileStoragePartFile(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	dir := t.TempDir()
+
+	data := append(append([]byte("aaa"), bytes.Repeat([]byte("b"), 100)...), "ccc"...)
+	tmeta := multiFileTestMetadata(data, 4, 3, 100, 3)
+	prios := []Priority{PriorityNormal, PrioritySkip, PriorityNormal}
+	fs, err := newFileStorage(dir, tmeta, prios)
+	require.NoError(err)
+
+	// the boundary pieces of b
+	_, err = fs.WriteAt(data[:4], 0)
+	require.NoError(err)
+	_, err = fs.WriteAt(data[100:], 100)
+	require.NoError(err)
+	require.NoError(fs.Close())
+
+	partPath := filepath.Join(dir, "."+hex.EncodeToString(tmeta.InfoHash[:])+".parts")
+	info, err := os.Stat(partPath)
+	require.NoError(err)
+	require.LessOrEqual(info.Size(), int64(8), "only boundary bytes are stored")
+
+	fs, err = newFileStorage(dir, tmeta, prios)
+	require.NoError(err)
+	defer fs.Close() //nolint:errcheck
+	buf := make([]byte, 6)
+	_, err = fs.ReadAt(buf, 100)
+	require.NoError(err)
+	require.Equal(data[100:], buf)
+
+	require.NoError(fs.SetPriority(1, PriorityNormal))
+	_, err = os.Stat(partPath)
+	require.True(os.IsNotExist(err), "part file without data is removed")
+	content, err := os.ReadFile(filepath.Join(dir, "multi", "b"))
+	require.NoError(err)
+	require.Equal(data[3:4], content[:1])
+	require.Equal(data[100:103], content[97:])
+}
+
+func TestFileStorageSkippedFileMiddle(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	dir := t.TempDir()
+
+	data := append(append([]byte("aaa"), bytes.Repeat([]byte("b"), 100)...), "ccc"...)
+	tmeta := multiFileTestMetadata(data, 4, 3, 100, 3)
+	fs, err := newFileStorage(dir, tmeta, []Priority{PriorityNormal, PrioritySkip, PriorityNormal})
+	require.NoError(err)
+	defer fs.Close() //nolint:errcheck
+
+	// a piece inside b is only fetched for a reader, it creates the file
+	_, err = fs.WriteAt(data[40:44], 40)
+	require.NoError(err)
+	content, err := os.ReadFile(filepath.Join(dir, "multi", "b"))
+	require.NoError(err)
+	require.Equal(data[40:44], content[37:])
+}
+
+func TestDownloadSkippedFile(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	pieceCount, blocksInPiece := 4, 1
+	data := generateTestTorrentData(pieceCount, blocksInPiece, BlockSize, BlockSize)
+	fileLengths := []int{10, 3*BlockSize - 20, BlockSize + 10}
+	tmeta := multiFileTestMetadata(data, BlockSize, fileLengths...)
+
+	bf := bitfield.Bitfield{255}
+	addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bf, tmeta, data, BlockSize))
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	outDir := t.TempDir()
+	testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, outDir)
+	require.NoError(testTorrent.SetFilePriority(1, PrioritySkip))
+
+	testTorrent.Download()
+
+	_, err = os.Stat(filepath.Join(outDir, "multi", "b"))
+	require.True(os.IsNotExist(err))
+
+	a, err := os.ReadFile(filepath.Join(outDir, "multi", "a"))
+	require.NoError(err)
+	require.True(bytes.Equal(data[:fileLengths[0]], a))
+
+	c, err := os.ReadFile(filepath.Join(outDir, "multi", "c"))
+	require.NoError(err)
+	require.True(bytes.Equal(data[len(data)-fileLengths[2]:], c))
+
+	require.False(testTorrent.picker.Have(1))
+
+	files := testTorrent.Files()
+	require.Equal(fileLengths[0], files[0].Downloaded)
+	require.Equal(fileLengths[2], files[2].Downloaded)
+	require.Equal(PrioritySkip, files[1].Priority)
+}
+
+func TestDownloadFileAttributes(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	data := generateTestTorrentData(4, 1, BlockSize, BlockSize)
+	fileLengths := []int{BlockSize + 10, BlockSize - 10, 2 * BlockSize, 0}
+	// the pad file holds zeros
+	clear(data[fileLengths[0] : 2*BlockSize])
+	tmeta := multiFileTestMetadata(data, BlockSize, fileLengths...)
+	tmeta.Files[1].Path = []string{"multi", ".pad", "16374"}
+	tmeta.Files[1].Attr = "p"
+	tmeta.Files[2].Attr = "x"
+	tmeta.Files[3].Attr = "l"
+	tmeta.Files[3].SymlinkPath = []string{"a"}
+
+	addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bitfield.Bitfield{255}, tmeta, data, BlockSize))
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	outDir := t.TempDir()
+	testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, outDir)
+	testTorrent.Download()
+	require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+
+	_, err = os.Stat(filepath.Join(outDir, "multi", ".pad"))
+	require.True(os.IsNotExist(err), "pad files are not stored")
+	require.True(testTorrent.Files()[1].Pad)
+
+	info, err := os.Stat(filepath.Join(outDir, "multi", "c"))
+	require.NoError(err)
+	require.NotZero(info.Mode() & 0o100)
+
+	target, err := os.Readlink(filepath.Join(outDir, "multi", "d"))
+	require.NoError(err)
+	require.Equal("a", target)
+	a, err := os.ReadFile(filepath.Join(outDir, "multi", "d"))
+	require.NoError(err)
+	require.Equal(data[:fileLengths[0]], a)
+}
+
+func TestFileStorageGaps(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	dir := t.TempDir()
+
+	// v2 files start at piece boundaries, the gap is not stored
+	tmeta := &md.TorrentMetadata{
+		Name:        "v2",
+		PieceLength: 4,
+		Length:      7,
+		Files: []md.FileInfo{
+			{Path: []string{"v2", "a"}, Length: 2, Offset: 0},
+			{Path: []string{"v2", "b"}, Length: 3, Offset: 4},
+		},
+	}
+	fs, err := newFileStorage(dir, tmeta, []Priority{PriorityNormal, PriorityNormal})
+	require.NoError(err)
+	defer fs.Close() //nolint:errcheck
+
+	_, err = fs.WriteAt([]byte("aa\x00\x00bbb"), 0)
+	require.NoError(err)
+	buf := []byte("xxxxxxx")
+	n, err := fs.ReadAt(buf, 0)
+	require.NoError(err)
+	require.Equal(7, n)
+	require.Equal([]byte("aa\x00\x00bbb"), buf)
+
+	content, err := os.ReadFile(filepath.Join(dir, "v2", "a"))
+	require.NoError(err)
+	require.Equal([]byte("aa"), content)
+
+	_, err = fs.WriteAt([]byte("bbbb"), 4)
+	require.Error(err)
+	_, err = fs.ReadAt(make([]byte, 4), 4)
+	require.ErrorIs(err, io.EOF)
+}
@@ -0,0 +1,442 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lksndrttm/torrent/peer"
+)
+
+const (
+	defaultMaxConnections        = 50
+	defaultMaxHalfOpen           = 8
+	defaultSessionMaxConnections = 200
+	defaultSessionMaxHalfOpen    = 20
+
+	// a peer is given up after maxPeerFailures attempts in a row without data
+	maxPeerFailures = 5
+	retryBackoff    = time.Second
+	maxRetryBackoff = 5 * time.Minute
+)
+
+type PeerSource int
+
+const (
+	SourceTracker PeerSource = iota
+	SourceIncoming
+)
+
+// allowedPrivate reports whether private torrents take peers from the
+// source. BEP 27 allows only the torrent's trackers, DHT, PEX and local
+// peer discovery must not be used.
+func (s PeerSource) allowedPrivate() bool {
+	return s == SourceTracker || s == SourceIncoming
+}
+
+func (s PeerSource) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceIncoming:
+		return "incoming"
+	default:
+		return fmt.Sprintf("source(%d)", int(s))
+	}
+}
+
+// KnownPeer describes a peer of the torrent peer pool.
+type KnownPeer struct {
+	Addr        peer.PeerAddr
+	Source      PeerSource
+	Connected   bool
+	Failures    int
+	LastFailure time.Time
+	// HashFailures counts pieces from the peer that failed the hash check.
+	HashFailures int
+	// Downloaded counts the data received from the peer over all connections.
+	Downloaded int
+}
+
+type connState int
+
+const (
+	connIdle connState = iota
+	connConnecting
+	connConnected
+)
+
+type knownPeer struct {
+	KnownPeer
+	state       connState
+	nextAttempt time.Time
+	// order is the position in which the peer was added, it breaks ties
+	order int
+	// id is the peer ID from the last handshake, zero before the first one
+	id [20]byte
+}
+
+func (kp *knownPeer) dialable(now time.Time) bool {
+	return kp.Source != SourceIncoming && kp.state == connIdle &&
+		kp.Failures < maxPeerFailures && !now.Before(kp.nextAttempt)
+}
+
+// connLimits counts connections against limits. The limits of a session are
+// shared by the pools of all its torrents. Methods of a nil connLimits
+// allow everything.
+type connLimits struct {
+	m           sync.Mutex
+	maxConns    int
+	maxHalfOpen int
+	conns       int
+	halfOpen    int
+	changed     chan struct{}
+}
+
+func newConnLimits(maxConns, maxHalfOpen int) *connLimits {
+	return &connLimits{maxConns: maxConns, maxHalfOpen: maxHalfOpen, changed: make(chan struct{})}
+}
+
+// notify must be called with cl.m held.
+func (cl *connLimits) notify() {
+	close(cl.changed)
+	cl.changed = make(chan struct{})
+}
+
+// Changed returns a channel that is closed when a slot is freed.
+func (cl *connLimits) Changed() <-chan struct{} {
+	if cl == nil {
+		return nil
+	}
+	cl.m.Lock()
+	defer cl.m.Unlock()
+	return cl.changed
+}
+
+func (cl *connLimits) tryOpen() bool {
+	if cl == nil {
+		return true
+	}
+	cl.m.Lock()
+	defer cl.m.Unlock()
+	if cl.halfOpen >= cl.maxHalfOpen || cl.conns+cl.halfOpen >= cl.maxConns {
+		return false
+	}
+	cl.halfOpen++
+	return true
+}
+
+func (cl *connLimits) tryAccept() bool {
+	if cl == nil {
+		return true
+	}
+	cl.m.Lock()
+	defer cl.m.Unlock()
+	if cl.conns+cl.halfOpen >= cl.maxConns {
+		return false
+	}
+	cl.conns++
+	return true
+}
+
+func (cl *connLimits) opened() {
+	if cl == nil {
+		return
+	}
+	cl.m.Lock()
+	defer cl.m.Unlock()
+	cl.halfOpen--
+	cl.conns++
+}
+
+func (cl *connLimits) closed(halfOpen bool) {
+	if cl == nil {
+		return
+	}
+	cl.m.Lock()
+	defer cl.m.Unlock()
+	if halfOpen {
+		cl.halfOpen--
+	} else {
+		cl.conns--
+	}
+	cl.notify()
+}
+
+func (cl *connLimits) setLimits(maxConns, maxHalfOpen int) {
+	cl.m.Lock()
+	defer cl.m.Unlock()
+	cl.maxConns = maxConns
+	cl.maxHalfOpen = maxHalfOpen
+	cl.notify()
+}
+
+// peerPool keeps the known peers of a torrent and decides which of them to
+// connect to. Failed peers are retried with a growing backoff, peers that
+// delivered data are preferred.
+type peerPool struct {
+	limits *connLimits
+	// allow reports whether the peer may be dialed, banned peers are skipped
+	allow func(peer.PeerAddr) bool
+	// private pools only add peers from sources allowed for private torrents
+	private bool
+
+	m       sync.Mutex
+	session *connLimits
+	peers   map[string]*knownPeer
+}
+
+func newPeerPool(allow func(peer.PeerAddr) bool) *peerPool {
+	return &peerPool{
+		limits: newConnLimits(defaultMaxConnections, defaultMaxHalfOpen),
+		allow:  allow,
+		peers:  map[string]*knownPeer{},
+	}
+}
+
+func (pp *peerPool) setSession(session *connLimits) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	pp.session = session
+}
+
+func (pp *peerPool) sessionLimits() *connLimits {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	return pp.session
+}
+
+func (pp *peerPool) Add(addrs []peer.PeerAddr, source PeerSource) {
+	if pp.private && !source.allowedPrivate() {
+		return
+	}
+	pp.m.Lock()
+	for _, addr := range addrs {
+		if _, ok := pp.peers[addr.String()]; !ok {
+			pp.peers[addr.String()] = &knownPeer{KnownPeer: KnownPeer{Addr: addr, Source: source}, order: len(pp.peers)}
+		}
+	}
+	pp.m.Unlock()
+
+	pp.limits.m.Lock()
+	pp.limits.notify()
+	pp.limits.m.Unlock()
+}
+
+// next reserves a half-open connection to the best peer to dial.
+func (pp *peerPool) next(now time.Time) (peer.PeerAddr, bool) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+
+	// the other address of a connected dual-stack peer is not dialed
+	busy := map[[20]byte]bool{}
+	for _, kp := range pp.peers {
+		if kp.state != connIdle && kp.id != [20]byte{} {
+			busy[kp.id] = true
+		}
+	}
+
+	var best *knownPeer
+	for _, kp := range pp.peers {
+		if !kp.dialable(now) || !pp.allow(kp.Addr) || busy[kp.id] {
+			continue
+		}
+		if best == nil || better(kp, best) {
+			best = kp
+		}
+	}
+	if best == nil {
+		return peer.PeerAddr{}, false
+	}
+
+	if !pp.limits.tryOpen() {
+		return peer.PeerAddr{}, false
+	}
+	if !pp.session.tryOpen() {
+		pp.limits.closed(true)
+		return peer.PeerAddr{}, false
+	}
+	best.state = connConnecting
+	return best.Addr, true
+}
+
+// better reports whether a should be dialed before b. Among otherwise equal
+// peers IPv6 addresses come first, a peer reachable over both families is
+// then connected over IPv6 and the IPv4 connection is dropped as a duplicate.
+// Remaining ties are dialed in the order the peers were added.
+func better(a, b *knownPeer) bool {
+	if a.Downloaded != b.Downloaded {
+		return a.Downloaded > b.Downloaded
+	}
+	if a.Failures != b.Failures {
+		return a.Failures < b.Failures
+	}
+	if a.Addr.IsIPv6() != b.Addr.IsIPv6() {
+		return a.Addr.IsIPv6()
+	}
+	return a.order < b.order
+}
+
+func (pp *peerPool) connected(addr peer.PeerAddr) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	if kp, ok := pp.peers[addr.String()]; ok {
+		kp.state = connConnected
+	}
+	pp.limits.opened()
+	pp.session.opened()
+}
+
+// identify records the peer ID of a connected peer.
+func (pp *peerPool) identify(addr peer.PeerAddr, id [20]byte) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	if kp, ok := pp.peers[addr.String()]; ok {
+		kp.id = id
+	}
+}
+
+// duplicate releases the slot of a connection to a peer that is already
+// connected over another address. It is not a failure of the address.
+func (pp *peerPool) duplicate(addr peer.PeerAddr) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	if kp, ok := pp.peers[addr.String()]; ok {
+		kp.state = connIdle
+		pp.forgetIncoming(kp)
+	}
+	pp.limits.closed(false)
+	pp.session.closed(false)
+}
+
+// forgetIncoming removes an idle peer that connected to us. Its address
+// has an ephemeral port that is never dialed, keeping it would only grow
+// the pool. Bans are kept by IP in the ban list.
+func (pp *peerPool) forgetIncoming(kp *knownPeer) {
+	if kp.Source == SourceIncoming && kp.state == connIdle {
+		delete(pp.peers, kp.Addr.String())
+	}
+}
+
+// failed releases the half-open slot of a connection that could not be established.
+func (pp *peerPool) failed(addr peer.PeerAddr, now time.Time) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	if kp, ok := pp.peers[addr.String()]; ok {
+		kp.state = connIdle
+		kp.fail(now)
+	}
+	pp.limits.closed(true)
+	pp.session.closed(true)
+}
+
+// accept registers an inbound connection. It reports false when the
+// connection limits are reached or the peer is already connected.
+func (pp *peerPool) accept(addr peer.PeerAddr) bool {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	kp, ok := pp.peers[addr.String()]
+	if ok && kp.state != connIdle {
+		return false
+	}
+
+	if !pp.limits.tryAccept() {
+		return false
+	}
+	if !pp.session.tryAccept() {
+		pp.limits.closed(false)
+		return false
+	}
+	if !ok {
+		kp = &knownPeer{KnownPeer: KnownPeer{Addr: addr, Source: SourceIncoming}, order: len(pp.peers)}
+		pp.peers[addr.String()] = kp
+	}
+	kp.state = connConnected
+	return true
+}
+
+// closed releases the slot of an established connection. Peers that
+// delivered data are retried soon, others back off.
+func (pp *peerPool) closed(addr peer.PeerAddr, downloaded int, now time.Time) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	if kp, ok := pp.peers[addr.String()]; ok {
+		kp.state = connIdle
+		kp.Downloaded += downloaded
+		if downloaded > 0 {
+			kp.Failures = 0
+			kp.nextAttempt = now.Add(retryBackoff)
+		} else {
+			kp.fail(now)
+		}
+		pp.forgetIncoming(kp)
+	}
+	pp.limits.closed(false)
+	pp.session.closed(false)
+}
+
+func (pp *peerPool) hashFailed(addr peer.PeerAddr) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	if kp, ok := pp.peers[addr.String()]; ok {
+		kp.HashFailures++
+	}
+}
+
+func (kp *knownPeer) fail(now time.Time) {
+	kp.Failures++
+	kp.LastFailure = now
+	kp.nextAttempt = now.Add(min(retryBackoff<<(kp.Failures-1), maxRetryBackoff))
+}
+
+// nextRetry returns the time until the next peer in backoff may be dialed.
+func (pp *peerPool) nextRetry(now time.Time) (time.Duration, bool) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	var next time.Time
+	for _, kp := range pp.peers {
+		if kp.Source == SourceIncoming || kp.state != connIdle || kp.Failures >= maxPeerFailures || !pp.allow(kp.Addr) {
+			continue
+		}
+		if next.IsZero() || kp.nextAttempt.Before(next) {
+			next = kp.nextAttempt
+		}
+	}
+	if next.IsZero() {
+		return 0, false
+	}
+	return max(next.Sub(now), 0), true
+}
+
+// exhausted reports whether no peer is connected and none is left to dial.
+func (pp *peerPool) exhausted() bool {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	for _, kp := range pp.peers {
+		if kp.state != connIdle {
+			return false
+		}
+		if kp.Source != SourceIncoming && kp.Failures < maxPeerFailures && pp.allow(kp.Addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (pp *peerPool) Len() int {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	return len(pp.peers)
+}
+
+func (pp *peerPool) KnownPeers() []KnownPeer {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	peers := make([]KnownPeer, 0, len(pp.peers))
+	for _, kp := range pp.peers {
+		p := kp.KnownPeer
+		p.Connected = kp.state == connConnected
+		peers = append(peers, p)
+	}
+	return peers
+}
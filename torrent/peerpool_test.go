@@ -0,0 +1,363 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lksndrttm/torrent/bitfield"
+	md "github.com/lksndrttm/torrent/metadata"
+	"github.com/lksndrttm/torrent/peer"
+	"github.com/lksndrttm/torrent/tracker"
+	"github.com/stretchr/testify/require"
+)
+
+func testPeerAddrs(t *testing.T, addrs ...string) []peer.PeerAddr {
+	peers := []peer.PeerAddr{}
+	for _, a := range addrs {
+		addr, err := peer.ParsePeerAddr(a)
+		require.NoError(t, err)
+		peers = append(peers, addr)
+	}
+	return peers
+}
+
+func TestPeerPoolPrefersPeersThatDelivered(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	now := time.Now()
+	pp := newPeerPool(func(peer.PeerAddr) bool { return true })
+	pp.Add(testPeerAddrs(t, "10.0.0.1:1", "10.0.0.2:1"), SourceTracker)
+
+	for range 2 {
+		addr, ok := pp.next(now)
+		require.True(ok)
+		pp.connected(addr)
+		downloaded := 0
+		if addr.String() == "10.0.0.2:1" {
+			downloaded = 100
+		}
+		pp.closed(addr, downloaded, now)
+	}
+	_, ok := pp.next(now)
+	require.False(ok, "peers back off after disconnecting")
+
+	addr, ok := pp.next(now.Add(time.Minute))
+	require.True(ok)
+	require.Equal("10.0.0.2:1", addr.String())
+}
+
+func TestPeerPoolPrefersIPv6(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	pp := newPeerPool(func(peer.PeerAddr) bool { return true })
+	pp.Add(testPeerAddrs(t, "10.0.0.1:1", "[2001:db8::1]:1", "10.0.0.2:1"), SourceTracker)
+
+	addr, ok := pp.next(time.Now())
+	require.True(ok)
+	require.Equal("[2001:db8::1]:1", addr.String())
+}
+
+func TestAddPeerRejectsDuplicateID(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, _, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	tr := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+
+	addrs := testPeerAddrs(t, "[::1]:1", "127.0.0.1:1")
+	p6 := &peer.Peer{Addr: addrs[0], ID: [20]byte{1}, Bitfield: bitfield.New(2)}
+	p4 := &peer.Peer{Addr: addrs[1], ID: [20]byte{1}, Bitfield: bitfield.New(2)}
+
+	_, ok := tr.addPeer(p6, false)
+	require.True(ok)
+	_, ok = tr.addPeer(p4, false)
+	require.False(ok, "same peer over the other family")
+
+	tr.removePeer(p6)
+	_, ok = tr.addPeer(p4, false)
+	require.True(ok)
+}
+
+func TestPeerPoolDuplicateNotFailure(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	now := time.Now()
+	pp := newPeerPool(func(peer.PeerAddr) bool { return true })
+	addrs := testPeerAddrs(t, "[2001:db8::1]:1", "10.0.0.1:1")
+	pp.Add(addrs, SourceTracker)
+	id := [20]byte{1}
+
+	// both addresses are dialed before the peer ID is known
+	for _, addr := range addrs {
+		d, ok := pp.next(now)
+		require.True(ok)
+		require.Equal(addr, d)
+		pp.connected(d)
+		pp.identify(d, id)
+	}
+	pp.duplicate(addrs[1])
+
+	for _, kp := range pp.KnownPeers() {
+		require.Zero(kp.Failures, kp.Addr.String())
+	}
+	_, ok := pp.next(now)
+	require.False(ok, "the IPv4 address of the connected peer is skipped")
+
+	pp.closed(addrs[0], 10, now)
+	d, ok := pp.next(now)
+	require.True(ok)
+	require.Equal(addrs[1], d)
+}
+
+func TestPeerPoolForgetsIncoming(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	now := time.Now()
+	pp := newPeerPool(func(peer.PeerAddr) bool { return true })
+	addrs := testPeerAddrs(t, "10.0.0.1:50000", "10.0.0.2:50000", "10.0.0.3:1")
+	pp.Add(addrs[2:], SourceTracker)
+
+	require.True(pp.accept(addrs[0]))
+	require.Equal(2, pp.Len())
+	pp.closed(addrs[0], 10, now)
+	require.Equal(1, pp.Len())
+
+	require.True(pp.accept(addrs[1]))
+	pp.duplicate(addrs[1])
+	require.Equal(1, pp.Len())
+
+	// known addresses stay when they connect to us
+	require.True(pp.accept(addrs[2]))
+	pp.closed(addrs[2], 0, now)
+	kp := pp.KnownPeers()
+	require.Len(kp, 1)
+	require.Equal(SourceTracker, kp[0].Source)
+}
+
+func TestPeerPoolBackoff(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	now := time.Now()
+	pp := newPeerPool(func(peer.PeerAddr) bool { return true })
+	pp.Add(testPeerAddrs(t, "10.0.0.1:1"), SourceTracker)
+
+	for i := range maxPeerFailures {
+		require.False(pp.exhausted())
+		addr, ok := pp.next(now)
+		require.True(ok)
+		pp.failed(addr, now)
+
+		wait, ok := pp.nextRetry(now)
+		if i == maxPeerFailures-1 {
+			require.False(ok)
+			break
+		}
+		require.True(ok)
+		require.Equal(retryBackoff<<i, wait)
+		_, ok = pp.next(now)
+		require.False(ok)
+		now = now.Add(wait)
+	}
+	require.True(pp.exhausted())
+
+	kp := pp.KnownPeers()
+	require.Len(kp, 1)
+	require.Equal(maxPeerFailures, kp[0].Failures)
+	require.Equal(SourceTracker, kp[0].Source)
+}
+
+func TestPeerPoolLimits(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	now := time.Now()
+	session := newConnLimits(3, 2)
+	pp := newPeerPool(func(peer.PeerAddr) bool { return true })
+	pp.limits.setLimits(2, 1)
+	pp.setSession(session)
+	pp.Add(testPeerAddrs(t, "10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"), SourceTracker)
+
+	a, ok := pp.next(now)
+	require.True(ok)
+	_, ok = pp.next(now)
+	require.False(ok, "half-open limit")
+	pp.connected(a)
+
+	b, ok := pp.next(now)
+	require.True(ok)
+	pp.connected(b)
+	_, ok = pp.next(now)
+	require.False(ok, "connection limit")
+	require.False(pp.accept(testPeerAddrs(t, "10.0.0.9:1")[0]))
+
+	other := newPeerPool(func(peer.PeerAddr) bool { return true })
+	other.setSession(session)
+	other.Add(testPeerAddrs(t, "10.0.1.1:1", "10.0.1.2:1"), SourceTracker)
+	c, ok := other.next(now)
+	require.True(ok)
+	other.connected(c)
+	_, ok = other.next(now)
+	require.False(ok, "session connection limit")
+
+	changed := pp.limits.Changed()
+	pp.closed(a, 10, now)
+	require.Eventually(func() bool {
+		select {
+		case <-changed:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, time.Millisecond)
+	d, ok := pp.next(now)
+	require.True(ok)
+	require.Equal("10.0.0.3:1", d.String())
+}
+
+func TestDownloadRetriesFailedPeer(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, tdata, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	handler := newMockPeerHandler(bitfield.Bitfield{255}, tmeta, tdata, BlockSize)
+	var attempts atomic.Int32
+	addr, cleanup, err := startMockTCPPeer(func(con net.Conn) {
+		// the first connection is dropped right away
+		if attempts.Add(1) > 1 {
+			handler(con)
+		}
+	})
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, t.TempDir())
+	testTorrent.Download()
+	require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+	require.Equal(int32(2), attempts.Load())
+
+	kp := testTorrent.KnownPeers()
+	require.Len(kp, 1)
+	require.Equal(len(tdata), kp[0].Downloaded)
+}
+
+// reannounceTracker returns no peers on the first announce.
+type reannounceTracker struct {
+	interval  time.Duration
+	peers     []peer.PeerAddr
+	announces atomic.Int32
+}
+
+func (rt *reannounceTracker) Announce(ctx context.Context, tmeta *md.TorrentMetadata, peerID [20]byte, params tracker.AnnounceParams) ([]peer.PeerAddr, error) {
+	if rt.announces.Add(1) == 1 {
+		return nil, nil
+	}
+	return rt.peers, nil
+}
+
+func (rt *reannounceTracker) Interval() time.Duration {
+	return rt.interval
+}
+
+func TestDownloadReannounces(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		inbound  bool
+		interval time.Duration
+	}{
+		// without inbound connections the empty pool asks the tracker again
+		{name: "pool exhausted"},
+		{name: "interval", inbound: true, interval: 10 * time.Millisecond},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			tmeta, tdata, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+			require.NoError(err)
+			addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bitfield.Bitfield{255}, tmeta, tdata, BlockSize))
+			defer cleanup()
+			require.NoError(err)
+			peerAddr, err := peer.ParsePeerAddr(addr)
+			require.NoError(err)
+
+			tr := &reannounceTracker{interval: tst.interval, peers: []peer.PeerAddr{peerAddr}}
+			testTorrent := newTestTorrent(tmeta, tr, t.TempDir())
+			testTorrent.inbound = tst.inbound
+			testTorrent.Download()
+			require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+			require.GreaterOrEqual(tr.announces.Load(), int32(2))
+		})
+	}
+}
+
+func TestPeerPoolPrivate(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, _, err := generateTestTorrent(1, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	tmeta.Private = true
+	testTorrent := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+	require.True(testTorrent.Private())
+
+	// sources like DHT or PEX are not allowed for private torrents
+	testTorrent.pool.Add(testPeerAddrs(t, "10.0.0.1:1"), PeerSource(-1))
+	require.Zero(testTorrent.pool.Len())
+	testTorrent.pool.Add(testPeerAddrs(t, "10.0.0.2:1"), SourceTracker)
+	require.Equal(1, testTorrent.pool.Len())
+}
+
+func TestPrivateTorrentAnnounces(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	var m sync.Mutex
+	var queries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		queries = append(queries, r.URL.Query())
+		m.Unlock()
+		w.Write([]byte("d8:intervali900e5:peers0:10:tracker id3:abce")) //nolint:errcheck
+	}))
+	defer server.Close()
+
+	tmeta, _, err := generateTestTorrent(1, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	tmeta.Private = true
+	tmeta.Announce = server.URL
+	tr := tracker.New(tmeta.Announce)
+	testTorrent := newTestTorrent(tmeta, tr, t.TempDir())
+	testTorrent.transfer.uploaded = 123
+	// the empty pool is announced again right away, like on the interval
+	testTorrent.Download()
+	require.ErrorIs(testTorrent.Err(), ErrNoPeers)
+
+	m.Lock()
+	defer m.Unlock()
+	require.Len(queries, 3)
+	for i, event := range []string{"started", "", "stopped"} {
+		q := queries[i]
+		require.Equal(event, q.Get("event"))
+		require.Equal("123", q.Get("uploaded"))
+		// like a session without listeners
+		require.Equal("0", q.Get("port"))
+		require.Equal(fmt.Sprintf("%08x", tr.Key), q.Get("key"))
+		if i > 0 {
+			require.Equal("abc", q.Get("trackerid"))
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package torrent
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/lksndrttm/torrent/bitfield"
+)
+
+const defaultSequentialLookahead = 4
+
+// priorityNow is used for pieces in a reader readahead window. Such pieces
+// are downloaded first, even if they belong to skipped files.
+const priorityNow = PriorityHigh + 1
+
+type pieceRange struct {
+	first int
+	last  int
+}
+
+// piecePicker decides which piece should be downloaded next.
+// Pieces are picked by priority, then rarest first, then by index.
+// In sequential mode pieces are picked in index order from a small window
+// that starts at the first missing piece.
+type piecePicker struct {
+	m            sync.Mutex
+	priorities   []Priority
+	have         []bool
+	inFlight     []bool
+	availability []int
+	readahead    map[int]pieceRange
+	sequential   bool
+	lookahead    int
+	changed      chan struct{}
+}
+
+func newPiecePicker(priorities []Priority) *piecePicker {
+	return &piecePicker{
+		priorities:   priorities,
+		have:         make([]bool, len(priorities)),
+		inFlight:     make([]bool, len(priorities)),
+		availability: make([]int, len(priorities)),
+		readahead:    map[int]pieceRange{},
+		changed:      make(chan struct{}),
+	}
+}
+
+// notify wakes up everyone waiting on changed. Must be called with the lock held.
+func (pp *piecePicker) notify() {
+	close(pp.changed)
+	pp.changed = make(chan struct{})
+}
+
+// Changed returns a channel that is closed on the next picker state change.
+func (pp *piecePicker) Changed() <-chan struct{} {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	return pp.changed
+}
+
+// priority returns the piece priority with reader readahead windows taken into account.
+func (pp *piecePicker) priority(id int) Priority {
+	for _, r := range pp.readahead {
+		if id >= r.first && id <= r.last {
+			return priorityNow
+		}
+	}
+	return pp.priorities[id]
+}
+
+func (pp *piecePicker) wanted(id int) bool {
+	return !pp.have[id] && !pp.inFlight[id] && pp.priority(id) != PrioritySkip
+}
+
+func (pp *piecePicker) better(a, b int) bool {
+	if pa, pb := pp.priority(a), pp.priority(b); pa != pb {
+		return pa > pb
+	}
+	return pp.availability[a] < pp.availability[b]
+}
+
+// Pick selects a piece available in bf and marks it as in flight.
+func (pp *piecePicker) Pick(bf bitfield.Bitfield) (uint32, bool) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+
+	if pp.sequential {
+		return pp.pickSequential(bf)
+	}
+
+	best := -1
+	for id := range pp.priorities {
+		if !pp.wanted(id) || !bf.HavePiece(id) {
+			continue
+		}
+		if best < 0 || pp.better(id, best) {
+			best = id
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+
+	pp.inFlight[best] = true
+	return uint32(best), true
+}
+
+func (pp *piecePicker) pickSequential(bf bitfield.Bitfield) (uint32, bool) {
+	for id := range pp.priorities {
+		if pp.wanted(id) && bf.HavePiece(id) && pp.priority(id) == priorityNow {
+			pp.inFlight[id] = true
+			return uint32(id), true
+		}
+	}
+
+	window := 0
+	for id := range pp.priorities {
+		if pp.have[id] || pp.priority(id) == PrioritySkip {
+			continue
+		}
+		if window >= pp.lookahead {
+			break
+		}
+		window++
+		if !pp.inFlight[id] && bf.HavePiece(id) {
+			pp.inFlight[id] = true
+			return uint32(id), true
+		}
+	}
+	return 0, false
+}
+
+// SetSequential switches between sequential and the normal picking strategy.
+func (pp *piecePicker) SetSequential(sequential bool, lookahead int) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	if lookahead <= 0 {
+		lookahead = defaultSequentialLookahead
+	}
+	pp.sequential = sequential
+	pp.lookahead = lookahead
+	pp.notify()
+}
+
+// Release returns a piece that failed to download back to the picker.
+func (pp *piecePicker) Release(id uint32) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	pp.inFlight[id] = false
+	pp.notify()
+}
+
+// Done marks a piece as downloaded and stored.
+func (pp *piecePicker) Done(id uint32) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	pp.inFlight[id] = false
+	pp.have[id] = true
+	pp.notify()
+}
+
+func (pp *piecePicker) Have(id int) bool {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	return pp.have[id]
+}
+
+// Complete reports whether all wanted pieces are downloaded.
+func (pp *piecePicker) Complete() bool {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	for id := range pp.priorities {
+		if pp.priority(id) != PrioritySkip && !pp.have[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// Missing returns the wanted pieces that are not downloaded yet.
+func (pp *piecePicker) Missing() []int {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	missing := []int{}
+	for id := range pp.priorities {
+		if pp.priority(id) != PrioritySkip && !pp.have[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing
+}
+
+func (pp *piecePicker) SetPriorities(priorities []Priority) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	copy(pp.priorities, priorities)
+	pp.notify()
+}
+
+// SetReadahead raises the priority of pieces from first to last for the reader with the given id.
+func (pp *piecePicker) SetReadahead(readerID int, first, last int) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	if r, ok := pp.readahead[readerID]; ok && r.first == first && r.last == last {
+		return
+	}
+	pp.readahead[readerID] = pieceRange{first: first, last: last}
+	pp.notify()
+}
+
+func (pp *piecePicker) ClearReadahead(readerID int) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	delete(pp.readahead, readerID)
+	pp.notify()
+}
+
+func (pp *piecePicker) AddPeer(bf bitfield.Bitfield) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	for id := range pp.availability {
+		if bf.HavePiece(id) {
+			pp.availability[id]++
+		}
+	}
+	pp.notify()
+}
+
+func (pp *piecePicker) RemovePeer(bf bitfield.Bitfield) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	for id := range pp.availability {
+		if bf.HavePiece(id) {
+			pp.availability[id]--
+		}
+	}
+}
+
+// PeerHave updates the piece availability after a have message.
+func (pp *piecePicker) PeerHave(id int) {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	if id < 0 || id >= len(pp.availability) {
+		return
+	}
+	pp.availability[id]++
+	pp.notify()
+}
+
+// Bitfield returns the bitfield of downloaded pieces.
+func (pp *piecePicker) Bitfield() bitfield.Bitfield {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	bf := bitfield.New(len(pp.have))
+	for id, have := range pp.have {
+		if have {
+			bf.SetPiece(id)
+		}
+	}
+	return bf
+}
+
+// HaveCount returns the number of downloaded pieces.
+func (pp *piecePicker) HaveCount() int {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	n := 0
+	for _, have := range pp.have {
+		if have {
+			n++
+		}
+	}
+	return n
+}
+
+// Availability returns the number of complete copies among the connected
+// peers. The fraction is the share of pieces available more often than the
+// rarest piece.
+func (pp *piecePicker) Availability() float64 {
+	pp.m.Lock()
+	defer pp.m.Unlock()
+	if len(pp.availability) == 0 {
+		return 0
+	}
+	rarest := slices.Min(pp.availability)
+	more := 0
+	for _, a := range pp.availability {
+		if a > rarest {
+			more++
+		}
+	}
+	return float64(rarest) + float64(more)/float64(len(pp.availability))
+}
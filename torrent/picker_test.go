@@ -0,0 +1,68 @@
+package torrent
+
+import (
+	"testing"
+
+	"github.com/lksndrttm/torrent/bitfield"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPickerPrefersPriorityThenRarest(t *testing.T) {
+	t.Parallel()
+	pp := newPiecePicker([]Priority{PriorityNormal, PriorityNormal, PriorityHigh, PrioritySkip})
+	pp.AddPeer(bitfield.Bitfield{0b11110000})
+	pp.AddPeer(bitfield.Bitfield{0b10000000})
+
+	bf := bitfield.Bitfield{255}
+	picked := []uint32{}
+	for {
+		id, ok := pp.Pick(bf)
+		if !ok {
+			break
+		}
+		picked = append(picked, id)
+	}
+
+	require.Equal(t, []uint32{2, 1, 0}, picked)
+}
+
+func TestPickerSequential(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	pp := newPiecePicker(make([]Priority, 6))
+	pp.SetSequential(true, 2)
+	bf := bitfield.Bitfield{255}
+
+	id, ok := pp.Pick(bf)
+	require.True(ok)
+	require.Equal(uint32(0), id)
+	id, ok = pp.Pick(bf)
+	require.True(ok)
+	require.Equal(uint32(1), id)
+
+	_, ok = pp.Pick(bf)
+	require.False(ok, "lookahead window is full")
+
+	pp.Release(0)
+	id, ok = pp.Pick(bitfield.Bitfield{0b01111111})
+	require.False(ok, "peer without the first piece must not move the window")
+	require.Zero(id)
+
+	pp.Done(1)
+	id, ok = pp.Pick(bitfield.Bitfield{0b01111111})
+	require.True(ok)
+	require.Equal(uint32(2), id)
+}
+
+func TestPickerAvailability(t *testing.T) {
+	t.Parallel()
+	pp := newPiecePicker(make([]Priority, 4))
+	require.Zero(t, pp.Availability())
+
+	pp.AddPeer(bitfield.Bitfield{0b11110000})
+	pp.AddPeer(bitfield.Bitfield{0b11000000})
+	require.InDelta(t, 1.5, pp.Availability(), 0.001)
+
+	pp.RemovePeer(bitfield.Bitfield{0b11110000})
+	require.InDelta(t, 0.5, pp.Availability(), 0.001)
+}
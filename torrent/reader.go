@@ -0,0 +1,204 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const defaultReadahead = 5 * 1024 * 1024
+
+var (
+	errReaderClosed = errors.New("reader closed")
+	errNotRunning   = errors.New("torrent not running")
+)
+
+// Reader reads the torrent byte stream or a single file of it while it is
+// being downloaded. Reads block until the needed pieces are verified and
+// pieces around the read position are downloaded first.
+type Reader struct {
+	t         *Torrent
+	id        int
+	offset    int64
+	length    int64
+	pos       int64
+	readahead int64
+	storage   *fileStorage
+	m         sync.Mutex
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewReader returns a reader over the whole torrent byte stream.
+func (t *Torrent) NewReader() *Reader {
+	return t.newReader(0, int64(t.metadata.Length))
+}
+
+// NewFileReader returns a reader over the file with the given index.
+func (t *Torrent) NewFileReader(index int) (*Reader, error) {
+	files := torrentFiles(t.metadata)
+	if index < 0 || index >= len(files) {
+		return nil, fmt.Errorf("file index %d out of range", index)
+	}
+	return t.newReader(int64(files[index].Offset), int64(files[index].Length)), nil
+}
+
+func (t *Torrent) newReader(offset, length int64) *Reader {
+	t.m.Lock()
+	t.lastReaderID++
+	id := t.lastReaderID
+	t.m.Unlock()
+
+	return &Reader{
+		t:         t,
+		id:        id,
+		offset:    offset,
+		length:    length,
+		readahead: defaultReadahead,
+		closed:    make(chan struct{}),
+	}
+}
+
+// SetReadahead sets how many bytes after the read position are downloaded with the highest priority.
+func (r *Reader) SetReadahead(bytes int64) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.readahead = bytes
+}
+
+func (r *Reader) pieceOf(pos int64) int {
+	return int((r.offset + pos) / int64(r.t.metadata.PieceLength))
+}
+
+func (r *Reader) updateReadahead() {
+	end := min(r.length, r.pos+max(r.readahead, 1))
+	r.t.picker.SetReadahead(r.id, r.pieceOf(r.pos), r.pieceOf(end-1))
+}
+
+// waitPiece blocks until the piece is downloaded or the reader is closed.
+// A completed torrent is started again to fetch the piece, a paused,
+// stopped or failed torrent fetches nothing and fails the wait.
+func (r *Reader) waitPiece(id int) error {
+	for {
+		changed := r.t.picker.Changed()
+		if r.t.picker.Have(id) {
+			return nil
+		}
+
+		t := r.t
+		t.m.Lock()
+		state, done, err := t.state, t.done, t.err
+		t.m.Unlock()
+		switch state {
+		case StateCompleted:
+			// the readahead made a skipped piece wanted
+			t.Start()
+			continue
+		case StatePaused, StateStopped:
+			return fmt.Errorf("%w: %s", errNotRunning, state)
+		case StateError:
+			return fmt.Errorf("%w: %w", errNotRunning, err)
+		}
+
+		select {
+		case <-changed:
+		case <-done:
+		case <-r.closed:
+			return errReaderClosed
+		}
+	}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	var pieceID int
+	for {
+		select {
+		case <-r.closed:
+			return 0, errReaderClosed
+		default:
+		}
+
+		if r.pos >= r.length {
+			return 0, io.EOF
+		}
+		if len(p) == 0 {
+			return 0, nil
+		}
+
+		if r.storage == nil {
+			storage, err := r.t.acquireStorage()
+			if err != nil {
+				return 0, err
+			}
+			r.storage = storage
+		}
+
+		r.updateReadahead()
+
+		pieceID = r.pieceOf(r.pos)
+		if r.t.picker.Have(pieceID) {
+			break
+		}
+		// Seek and SetReadahead must not wait for the piece, the position
+		// is checked again afterwards
+		r.m.Unlock()
+		err := r.waitPiece(pieceID)
+		r.m.Lock()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, pieceEnd := calcPieceBoundaries(uint32(pieceID), r.t.metadata)
+	n := min(int64(len(p)), r.length-r.pos, int64(pieceEnd)-(r.offset+r.pos))
+
+	read, err := r.storage.ReadAt(p[:n], r.offset+r.pos)
+	r.pos += int64(read)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return read, err
+	}
+	return read, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.length + offset
+	default:
+		return r.pos, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return r.pos, fmt.Errorf("negative position %d", pos)
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *Reader) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.closed)
+
+		r.m.Lock()
+		defer r.m.Unlock()
+
+		r.t.picker.ClearReadahead(r.id)
+		if r.storage != nil {
+			err = r.t.releaseStorage()
+			r.storage = nil
+		}
+	})
+	return err
+}
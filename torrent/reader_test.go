@@ -0,0 +1,155 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/lksndrttm/torrent/bitfield"
+	"github.com/lksndrttm/torrent/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadaheadPiecesPickedFirst(t *testing.T) {
+	t.Parallel()
+	pp := newPiecePicker([]Priority{PriorityHigh, PriorityNormal, PrioritySkip, PriorityNormal})
+	bf := bitfield.Bitfield{255}
+
+	pp.SetReadahead(1, 2, 2)
+	id, ok := pp.Pick(bf)
+	require.True(t, ok)
+	require.Equal(t, uint32(2), id)
+
+	pp.ClearReadahead(1)
+	id, ok = pp.Pick(bf)
+	require.True(t, ok)
+	require.Equal(t, uint32(0), id)
+}
+
+func TestReaderReadsWhileDownloading(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, tdata, err := generateTestTorrent(3, 2, BlockSize, BlockSize/2)
+	require.NoError(err)
+
+	bf := bitfield.Bitfield{255}
+	addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bf, tmeta, tdata, BlockSize))
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, t.TempDir())
+
+	r := testTorrent.NewReader()
+	defer r.Close() //nolint:errcheck
+	r.SetReadahead(BlockSize)
+
+	testTorrent.Start()
+
+	offset := int64(BlockSize + 100)
+	pos, err := r.Seek(offset, io.SeekStart)
+	require.NoError(err)
+	require.Equal(offset, pos)
+
+	data, err := io.ReadAll(r)
+	require.NoError(err)
+	require.Equal(tdata[offset:], data)
+
+	_, err = r.Seek(-10, io.SeekEnd)
+	require.NoError(err)
+	data, err = io.ReadAll(r)
+	require.NoError(err)
+	require.Equal(tdata[len(tdata)-10:], data)
+}
+
+func TestReaderTorrentNotRunning(t *testing.T) {
+	t.Parallel()
+	tmeta, _, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+	require.NoError(t, err)
+	testTorrent := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+
+	r := testTorrent.NewReader()
+	defer r.Close() //nolint:errcheck
+	_, err = r.Read(make([]byte, 10))
+	require.ErrorIs(t, err, errNotRunning)
+}
+
+func TestReaderWaitReleasesLock(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, tdata, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	// the peer has no pieces, so the read waits until the torrent stops
+	addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bitfield.Bitfield{0}, tmeta, tdata, BlockSize))
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, t.TempDir())
+	testTorrent.Start()
+	r := testTorrent.NewReader()
+	defer r.Close() //nolint:errcheck
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		readErr <- err
+	}()
+	require.Eventually(func() bool {
+		testTorrent.picker.m.Lock()
+		defer testTorrent.picker.m.Unlock()
+		_, ok := testTorrent.picker.readahead[r.id]
+		return ok
+	}, time.Second, time.Millisecond)
+
+	seeked := make(chan struct{})
+	go func() {
+		r.Seek(BlockSize, io.SeekStart) //nolint:errcheck
+		r.SetReadahead(BlockSize)
+		close(seeked)
+	}()
+	select {
+	case <-seeked:
+	case <-time.After(time.Second):
+		t.Fatal("Seek waits for the piece")
+	}
+
+	require.NoError(testTorrent.Stop(context.Background()))
+	select {
+	case err := <-readErr:
+		require.ErrorIs(err, errNotRunning)
+	case <-time.After(time.Second):
+		t.Fatal("Read keeps waiting on a stopped torrent")
+	}
+}
+
+func TestReaderRestartsCompletedTorrent(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	data := generateTestTorrentData(4, 1, BlockSize, BlockSize)
+	tmeta := multiFileTestMetadata(data, BlockSize, BlockSize, 2*BlockSize, BlockSize)
+	addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bitfield.Bitfield{255}, tmeta, data, BlockSize))
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, t.TempDir())
+	require.NoError(testTorrent.SetFilePriority(1, PrioritySkip))
+	testTorrent.Download()
+	require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+
+	// the skipped file is fetched for the reader
+	r, err := testTorrent.NewFileReader(1)
+	require.NoError(err)
+	defer r.Close() //nolint:errcheck
+	got, err := io.ReadAll(r)
+	require.NoError(err)
+	require.Equal(data[BlockSize:3*BlockSize], got)
+}
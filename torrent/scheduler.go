@@ -0,0 +1,150 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Clock is the time source of the bandwidth scheduler.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+const defaultProfileName = "default"
+
+// BandwidthProfile sets the session rate limits during a weekly time window.
+type BandwidthProfile struct {
+	Name string
+	// Days the window starts on, every day if empty.
+	Days []time.Weekday
+	// From and To are times of day like "08:00". A window ending before it
+	// starts lasts until the next day, equal times mean the whole day.
+	From string
+	To   string
+	// Limits in bytes per second, zero means unlimited.
+	UploadLimit   int
+	DownloadLimit int
+}
+
+type scheduledProfile struct {
+	BandwidthProfile
+	days     [7]bool
+	from, to int
+}
+
+func (sp *scheduledProfile) active(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case sp.from < sp.to:
+		return sp.days[day] && minute >= sp.from && minute < sp.to
+	case minute >= sp.from:
+		return sp.days[day]
+	case minute < sp.to:
+		return sp.days[(day+6)%7]
+	default:
+		return false
+	}
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// scheduler switches the session limits between profiles. The first active
+// profile wins, the fallback profile is used outside of all windows.
+type scheduler struct {
+	profiles []scheduledProfile
+	fallback BandwidthProfile
+	clock    Clock
+	apply    func(BandwidthProfile)
+
+	m      sync.Mutex
+	active string
+}
+
+func newScheduler(profiles []BandwidthProfile, fallback BandwidthProfile, clock Clock, apply func(BandwidthProfile)) (*scheduler, error) {
+	s := &scheduler{fallback: fallback, clock: clock, apply: apply}
+	names := map[string]bool{fallback.Name: true}
+	for _, p := range profiles {
+		if p.Name == "" || names[p.Name] {
+			return nil, fmt.Errorf("bandwidth profile name %q is empty or not unique", p.Name)
+		}
+		names[p.Name] = true
+
+		sp := scheduledProfile{BandwidthProfile: p}
+		var err error
+		if sp.from, err = parseTimeOfDay(p.From); err != nil {
+			return nil, fmt.Errorf("bandwidth profile %q: %w", p.Name, err)
+		}
+		if sp.to, err = parseTimeOfDay(p.To); err != nil {
+			return nil, fmt.Errorf("bandwidth profile %q: %w", p.Name, err)
+		}
+		if sp.from == sp.to {
+			sp.from, sp.to = 0, 24*60
+		}
+		for _, d := range p.Days {
+			if d < time.Sunday || d > time.Saturday {
+				return nil, fmt.Errorf("bandwidth profile %q: invalid weekday %d", p.Name, d)
+			}
+			sp.days[d] = true
+		}
+		if len(p.Days) == 0 {
+			sp.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		s.profiles = append(s.profiles, sp)
+	}
+	return s, nil
+}
+
+func (s *scheduler) profileAt(t time.Time) BandwidthProfile {
+	for _, sp := range s.profiles {
+		if sp.active(t) {
+			return sp.BandwidthProfile
+		}
+	}
+	return s.fallback
+}
+
+// update applies the profile for the current time if it differs from the active one.
+func (s *scheduler) update() {
+	p := s.profileAt(s.clock.Now())
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if p.Name == s.active {
+		return
+	}
+	s.active = p.Name
+	s.apply(p)
+}
+
+func (s *scheduler) Active() string {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.active
+}
+
+// run checks the profiles at every minute until stop is closed.
+func (s *scheduler) run(stop <-chan struct{}) {
+	for {
+		s.update()
+		now := s.clock.Now()
+		select {
+		case <-s.clock.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+		case <-stop:
+			return
+		}
+	}
+}
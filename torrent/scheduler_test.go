@@ -0,0 +1,146 @@
+package torrent
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	m       sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.m.Lock()
+	defer fc.m.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.m.Lock()
+	defer fc.m.Unlock()
+	ch := make(chan time.Time, 1)
+	fc.waiters = append(fc.waiters, fakeWaiter{at: fc.now.Add(d), ch: ch})
+	return ch
+}
+
+func (fc *fakeClock) Waiters() int {
+	fc.m.Lock()
+	defer fc.m.Unlock()
+	return len(fc.waiters)
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.m.Lock()
+	defer fc.m.Unlock()
+	fc.now = fc.now.Add(d)
+	waiters := fc.waiters[:0]
+	for _, w := range fc.waiters {
+		if w.at.After(fc.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- fc.now
+	}
+	fc.waiters = waiters
+}
+
+var testSchedule = []BandwidthProfile{
+	{
+		Name:          "office",
+		Days:          []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+		From:          "08:00",
+		To:            "18:00",
+		UploadLimit:   1 << 20,
+		DownloadLimit: 2 << 20,
+	},
+	{
+		Name: "weekend night",
+		Days: []time.Weekday{time.Friday},
+		From: "22:00",
+		To:   "06:00",
+	},
+}
+
+func TestSchedulerProfileAt(t *testing.T) {
+	t.Parallel()
+	s, err := newScheduler(testSchedule, BandwidthProfile{Name: defaultProfileName}, systemClock{}, func(BandwidthProfile) {})
+	require.NoError(t, err)
+
+	tests := []struct {
+		at       string
+		expected string
+	}{
+		{at: "2026-10-19 09:00", expected: "office"}, // Monday
+		{at: "2026-10-19 07:59", expected: defaultProfileName},
+		{at: "2026-10-19 18:00", expected: defaultProfileName},
+		{at: "2026-10-23 23:00", expected: "weekend night"}, // Friday
+		{at: "2026-10-24 05:59", expected: "weekend night"},
+		{at: "2026-10-24 06:00", expected: defaultProfileName},
+		{at: "2026-10-25 03:00", expected: defaultProfileName},
+		{at: "2026-10-24 10:00", expected: defaultProfileName},
+	}
+	for _, tst := range tests {
+		at, err := time.ParseInLocation("2006-01-02 15:04", tst.at, time.Local)
+		require.NoError(t, err)
+		require.Equal(t, tst.expected, s.profileAt(at).Name, tst.at)
+	}
+}
+
+func TestSchedulerInvalidProfiles(t *testing.T) {
+	t.Parallel()
+	tests := [][]BandwidthProfile{
+		{{Name: "a", From: "8:00am", To: "18:00"}},
+		{{Name: "a", From: "08:00", To: "25:00"}},
+		{{From: "08:00", To: "18:00"}},
+		{{Name: "a", From: "08:00", To: "18:00"}, {Name: "a", From: "18:00", To: "20:00"}},
+		{{Name: "a", From: "08:00", To: "18:00", Days: []time.Weekday{7}}},
+	}
+	for _, profiles := range tests {
+		_, err := NewSession(Config{Schedule: profiles})
+		require.Error(t, err)
+	}
+}
+
+func TestSessionBandwidthSchedule(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	start, err := time.ParseInLocation("2006-01-02 15:04:05", "2026-10-19 07:59:30", time.Local)
+	require.NoError(err)
+	clock := &fakeClock{now: start}
+
+	s, err := NewSession(Config{UploadLimit: 100, Schedule: testSchedule, Clock: clock})
+	require.NoError(err)
+	defer s.Close() //nolint:errcheck
+
+	stats := s.Stats()
+	require.Equal(defaultProfileName, stats.BandwidthProfile)
+	require.Equal(100, stats.UploadLimit)
+	require.Zero(stats.DownloadLimit)
+
+	require.Eventually(func() bool { return clock.Waiters() == 1 }, time.Second, time.Millisecond)
+	clock.Advance(30 * time.Second)
+	require.Eventually(func() bool {
+		return s.Stats().BandwidthProfile == "office"
+	}, time.Second, time.Millisecond)
+	stats = s.Stats()
+	require.Equal(1<<20, stats.UploadLimit)
+	require.Equal(2<<20, stats.DownloadLimit)
+
+	require.Eventually(func() bool { return clock.Waiters() == 1 }, time.Second, time.Millisecond)
+	clock.Advance(10 * time.Hour)
+	require.Eventually(func() bool {
+		return s.Stats().BandwidthProfile == defaultProfileName
+	}, time.Second, time.Millisecond)
+	require.Equal(100, s.Stats().UploadLimit)
+}
@@ -0,0 +1,547 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lksndrttm/torrent/ipfilter"
+	m "github.com/lksndrttm/torrent/messages"
+	md "github.com/lksndrttm/torrent/metadata"
+	"github.com/lksndrttm/torrent/mse"
+	"github.com/lksndrttm/torrent/peer"
+	"github.com/lksndrttm/torrent/proxy"
+	"github.com/lksndrttm/torrent/ratelimit"
+	"github.com/lksndrttm/torrent/tracker"
+	"github.com/lksndrttm/torrent/utp"
+)
+
+const (
+	handshakeTimeout    = 10 * time.Second
+	sessionCloseTimeout = 10 * time.Second
+)
+
+// ErrSessionClosed is returned when a torrent is added to a closed session.
+var ErrSessionClosed = errors.New("session closed")
+
+// Config holds settings shared by all torrents of a session.
+type Config struct {
+	// ListenAddr is the address for inbound peer connections. Inbound
+	// connections are disabled when empty. Without a host like ":6881" the
+	// session listens on IPv4 and, if available, IPv6.
+	ListenAddr string
+	// IPv6 is announced to trackers so peers can reach us over IPv6 even if
+	// the tracker is contacted over IPv4.
+	IPv6           net.IP
+	DiskWorkers    int
+	WriteCacheSize int
+	ReadCacheSize  int
+	// UploadLimit and DownloadLimit limit the rates of all torrents in bytes
+	// per second. Zero means unlimited.
+	UploadLimit   int
+	DownloadLimit int
+	// Schedule switches the rate limits by time of day. Outside of all
+	// profiles UploadLimit and DownloadLimit apply.
+	Schedule []BandwidthProfile
+	// Clock drives the schedule, the system clock is used when nil.
+	Clock Clock
+	// MaxConnections and MaxHalfOpen limit the peer connections of all torrents.
+	MaxConnections int
+	MaxHalfOpen    int
+	// An IP that sent BanThreshold pieces failing the hash check is banned for BanDuration.
+	BanThreshold int
+	BanDuration  time.Duration
+	// IPFilter blocks peer addresses of all torrents, nil allows all.
+	IPFilter *ipfilter.Filter
+	// Encryption is the message stream encryption policy for inbound and
+	// outgoing connections, plaintext only by default.
+	Encryption mse.Policy
+	// Transport selects TCP and uTP for outgoing connections. Unless it is
+	// TCP only, uTP connections are also accepted on the UDP port of the
+	// listen address.
+	Transport peer.Transport
+	// Proxy carries peer connections and tracker announces. uTP runs over
+	// a SOCKS5 UDP association and is not used with HTTP proxies.
+	Proxy *proxy.Dialer
+	// ProxyOnly disables inbound connections, so no traffic bypasses the
+	// proxy. ListenAddr is ignored.
+	ProxyOnly bool
+}
+
+func (c *Config) setDefaults() {
+	if c.DiskWorkers <= 0 {
+		c.DiskWorkers = defaultDiskWorkers
+	}
+	if c.WriteCacheSize <= 0 {
+		c.WriteCacheSize = defaultWriteCacheSize
+	}
+	if c.ReadCacheSize <= 0 {
+		c.ReadCacheSize = defaultReadCacheSize
+	}
+	if c.Clock == nil {
+		c.Clock = systemClock{}
+	}
+	if c.MaxConnections <= 0 {
+		c.MaxConnections = defaultSessionMaxConnections
+	}
+	if c.MaxHalfOpen <= 0 {
+		c.MaxHalfOpen = defaultSessionMaxHalfOpen
+	}
+	if c.BanThreshold <= 0 {
+		c.BanThreshold = defaultBanThreshold
+	}
+	if c.BanDuration <= 0 {
+		c.BanDuration = defaultBanDuration
+	}
+}
+
+// Session runs many torrents that share one peer ID, one listen port and one disk pool.
+type Session struct {
+	config Config
+	peerID [20]byte
+	// listeners are the IPv4 and IPv6 listeners, both on the same port
+	listeners []net.Listener
+	utp       *utp.Socket
+	diskPool  *diskPool
+	events    *eventBus
+	wg        sync.WaitGroup
+
+	uploadLimit   *ratelimit.Limiter
+	downloadLimit *ratelimit.Limiter
+	scheduler     *scheduler
+	stop          chan struct{}
+	closeOnce     sync.Once
+	conns         *connLimits
+	bans          *banList
+
+	m        sync.Mutex
+	torrents map[[20]byte]*Torrent
+	closed   bool
+}
+
+func NewSession(config Config) (*Session, error) {
+	config.setDefaults()
+
+	s := &Session{
+		config:   config,
+		peerID:   generatePeerID(),
+		events:   newEventBus(),
+		torrents: map[[20]byte]*Torrent{},
+
+		uploadLimit:   ratelimit.New(config.UploadLimit, nil),
+		downloadLimit: ratelimit.New(config.DownloadLimit, nil),
+		stop:          make(chan struct{}),
+		conns:         newConnLimits(config.MaxConnections, config.MaxHalfOpen),
+		bans:          newBanList(config.BanThreshold, config.BanDuration),
+	}
+	s.bans.setOnBan(func(ip net.IP) {
+		for _, t := range s.Torrents() {
+			t.kick(ip)
+		}
+	})
+
+	fallback := BandwidthProfile{
+		Name:          defaultProfileName,
+		UploadLimit:   config.UploadLimit,
+		DownloadLimit: config.DownloadLimit,
+	}
+	sched, err := newScheduler(config.Schedule, fallback, config.Clock, func(p BandwidthProfile) {
+		s.SetRateLimits(p.UploadLimit, p.DownloadLimit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.scheduler = sched
+
+	if config.ListenAddr != "" && !config.ProxyOnly {
+		listeners, err := listen(config.ListenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("session listen error: %w", err)
+		}
+		s.listeners = listeners
+		for _, ln := range listeners {
+			s.wg.Add(1)
+			go s.acceptLoop(ln)
+		}
+	}
+	if s.useUTP() {
+		if err := s.listenUTP(); err != nil {
+			for _, ln := range s.listeners {
+				ln.Close() //nolint:errcheck
+			}
+			return nil, fmt.Errorf("session utp listen error: %w", err)
+		}
+	}
+
+	s.diskPool = newDiskPool(config.DiskWorkers, config.WriteCacheSize, config.ReadCacheSize)
+
+	s.scheduler.update()
+	if len(config.Schedule) > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.scheduler.run(s.stop)
+		}()
+	}
+
+	return s, nil
+}
+
+// listen opens a listener for the address. For an address without a host
+// separate IPv4 and IPv6 listeners are opened on the same port, a missing
+// IPv6 stack is not an error.
+func listen(addr string) ([]net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	ln4, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	port := ln4.Addr().(*net.TCPAddr).Port
+	ln6, err := net.Listen("tcp6", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		return []net.Listener{ln4}, nil
+	}
+	return []net.Listener{ln4, ln6}, nil
+}
+
+// useUTP reports if the transport includes uTP and the proxy can relay it.
+func (s *Session) useUTP() bool {
+	if s.config.Transport == peer.TransportTCP {
+		return false
+	}
+	return s.config.Proxy == nil || s.config.Proxy.Type == proxy.SOCKS5
+}
+
+// listenUTP opens the uTP socket on the UDP port matching the TCP listen
+// port. Without inbound connections the socket is only used to dial, with
+// a proxy it runs over the proxy's UDP relay.
+func (s *Session) listenUTP() error {
+	if s.config.Proxy != nil {
+		// a proxy that never answers the UDP association must not hang the session
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+		defer cancel()
+		pc, err := s.config.Proxy.ListenPacket(ctx)
+		if err != nil {
+			return err
+		}
+		s.utp = utp.NewSocket(pc, false)
+		return nil
+	}
+	if len(s.listeners) == 0 {
+		pc, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return err
+		}
+		s.utp = utp.NewSocket(pc, false)
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(s.config.ListenAddr)
+	if err != nil {
+		return err
+	}
+	sock, err := utp.Listen("udp", net.JoinHostPort(host, strconv.Itoa(int(s.port()))))
+	if err != nil {
+		return err
+	}
+	s.utp = sock
+	s.wg.Add(1)
+	go s.acceptLoop(sock)
+	return nil
+}
+
+func generatePeerID() [20]byte {
+	const chars = "0123456789abcdefghijklmnopqrstuvwxyz"
+	var id [20]byte
+	n := copy(id[:], "-xx2940-")
+	for i := n; i < len(id); i++ {
+		id[i] = chars[rand.IntN(len(chars))]
+	}
+	return id
+}
+
+func (s *Session) PeerID() [20]byte {
+	return s.peerID
+}
+
+// Addr returns the listen address or nil if inbound connections are
+// disabled. With several listeners the IPv4 one is returned.
+func (s *Session) Addr() net.Addr {
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// Addrs returns the addresses of all listeners.
+func (s *Session) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, ln := range s.listeners {
+		addrs[i] = ln.Addr()
+	}
+	return addrs
+}
+
+// port is the announced port, zero without listeners like with ProxyOnly.
+// A standalone Torrent announces zero too, see tracker.Tracker.Port.
+func (s *Session) port() uint16 {
+	if addr, ok := s.Addr().(*net.TCPAddr); ok {
+		return uint16(addr.Port)
+	}
+	return 0
+}
+
+// AddTorrent loads a torrent file and registers the torrent in the session.
+// The torrent is not started.
+func (s *Session) AddTorrent(torrentFilePath, outDir string) (*Torrent, error) {
+	tmeta, err := md.ParseTorrentFile(torrentFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMetadataInvalid, err)
+	}
+
+	t := newTorrent(tmeta, s.newTracker(tmeta.Announce), outDir)
+	if err := s.addTorrent(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// newTracker returns a tracker that announces the session port, through the
+// proxy if one is configured.
+func (s *Session) newTracker(announce string) *tracker.Tracker {
+	tr := tracker.New(announce)
+	tr.Port = s.port()
+	tr.IPv6 = s.config.IPv6
+	if s.config.Proxy != nil {
+		tr.Client = s.config.Proxy.HTTPClient()
+	}
+	return tr
+}
+
+func (s *Session) addTorrent(t *Torrent) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.closed {
+		return ErrSessionClosed
+	}
+	if _, ok := s.torrents[t.InfoHash()]; ok {
+		return fmt.Errorf("torrent %x already added", t.InfoHash())
+	}
+	t.peerID = s.peerID
+	t.diskPool = s.diskPool
+	t.inbound = len(s.listeners) > 0
+	t.sessionEvents = s.events
+	t.uploadLimit.SetParent(s.uploadLimit)
+	t.downloadLimit.SetParent(s.downloadLimit)
+	t.pool.setSession(s.conns)
+	t.bans = s.bans
+	t.filter = s.config.IPFilter
+	t.dialer = peer.Dialer{
+		Timeout:    connectTimeout,
+		Encryption: s.config.Encryption,
+		Transport:  s.config.Transport,
+		UTP:        s.utp,
+	}
+	if s.config.Proxy != nil {
+		t.dialer.Proxy = s.config.Proxy
+		t.httpClient = s.config.Proxy.HTTPClient()
+	}
+	s.torrents[t.InfoHash()] = t
+	return nil
+}
+
+// RemoveTorrent stops the torrent and removes it from the session.
+func (s *Session) RemoveTorrent(ctx context.Context, infoHash [20]byte) error {
+	s.m.Lock()
+	t, ok := s.torrents[infoHash]
+	delete(s.torrents, infoHash)
+	s.m.Unlock()
+
+	if !ok {
+		return fmt.Errorf("torrent %x not found", infoHash)
+	}
+	return t.Stop(ctx)
+}
+
+// SetRateLimits changes the session rate limits in bytes per second. Zero
+// means unlimited. With a schedule the limits are replaced on the next profile change.
+func (s *Session) SetRateLimits(upload, download int) {
+	s.uploadLimit.SetRate(upload)
+	s.downloadLimit.SetRate(download)
+}
+
+// BanIP closes the connections to the IP in all torrents and refuses new
+// ones for d, zero d bans permanently.
+func (s *Session) BanIP(ip net.IP, d time.Duration) {
+	s.bans.Ban(ip, d, time.Now())
+}
+
+func (s *Session) UnbanIP(ip net.IP) {
+	s.bans.Unban(ip)
+}
+
+// BannedIPs returns the active bans.
+func (s *Session) BannedIPs() []BannedIP {
+	return s.bans.Bans(time.Now())
+}
+
+func (s *Session) Torrents() []*Torrent {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	torrents := make([]*Torrent, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		torrents = append(torrents, t)
+	}
+	return torrents
+}
+
+// infoHashes returns the info hashes peers may ask for, hybrid torrents are
+// also reachable by the truncated v2 info hash.
+func (s *Session) infoHashes() [][20]byte {
+	s.m.Lock()
+	defer s.m.Unlock()
+	hashes := slices.Collect(maps.Keys(s.torrents))
+	for _, t := range s.torrents {
+		if t.metadata.HasV1() && t.metadata.HasV2() {
+			hashes = append(hashes, [20]byte(t.metadata.InfoHashV2[:20]))
+		}
+	}
+	return hashes
+}
+
+func (s *Session) torrent(infoHash [20]byte) *Torrent {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if t, ok := s.torrents[infoHash]; ok {
+		return t
+	}
+	for _, t := range s.torrents {
+		if t.metadata.HasV2() && [20]byte(t.metadata.InfoHashV2[:20]) == infoHash {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *Session) acceptLoop(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		con, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		// Close waits for handshakes, the peer itself belongs to the torrent run
+		s.wg.Add(1)
+		go func() {
+			t, con, h := s.handshakeInbound(con)
+			s.wg.Done()
+			if t != nil {
+				t.acceptPeer(con, h)
+			}
+		}()
+	}
+}
+
+// handshakeInbound answers the handshake and returns the torrent with the
+// requested info hash. The connection is closed when it returns nil.
+func (s *Session) handshakeInbound(con net.Conn) (*Torrent, net.Conn, m.Handshake) {
+	if addr, err := peer.ParsePeerAddr(con.RemoteAddr().String()); err == nil && s.config.IPFilter.Blocked(addr.IP) {
+		con.Close() //nolint:errcheck
+		return nil, nil, m.Handshake{}
+	}
+
+	if err := con.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		con.Close() //nolint:errcheck
+		return nil, nil, m.Handshake{}
+	}
+
+	mcon, err := mse.Accept(con, s.config.Encryption, s.infoHashes)
+	if err != nil {
+		con.Close() //nolint:errcheck
+		return nil, nil, m.Handshake{}
+	}
+	con = mcon
+
+	h, err := m.ReadHandshake(con)
+	if err != nil {
+		con.Close() //nolint:errcheck
+		return nil, nil, m.Handshake{}
+	}
+
+	t := s.torrent(h.InfoHash)
+	if t == nil {
+		con.Close() //nolint:errcheck
+		return nil, nil, m.Handshake{}
+	}
+
+	resp := m.NewHandshake(h.InfoHash, s.peerID)
+	if t.metadata.HasV2() {
+		resp.Reserved[7] |= m.ReservedV2
+	}
+	_, err = con.Write(resp.Serialize())
+	if err != nil {
+		con.Close() //nolint:errcheck
+		return nil, nil, m.Handshake{}
+	}
+
+	return t, con, h
+}
+
+// Close stops accepting connections, stops all torrents and releases the
+// disk pool. Calls after the first do nothing.
+func (s *Session) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		err = s.close()
+	})
+	return err
+}
+
+func (s *Session) close() error {
+	s.m.Lock()
+	s.closed = true
+	s.m.Unlock()
+
+	errs := []error{}
+	for _, ln := range s.listeners {
+		errs = append(errs, ln.Close())
+	}
+	if s.utp != nil {
+		errs = append(errs, s.utp.Close())
+	}
+	close(s.stop)
+	s.wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), sessionCloseTimeout)
+	defer cancel()
+	for _, t := range s.Torrents() {
+		errs = append(errs, t.Stop(ctx))
+	}
+
+	// a torrent that did not stop in time fails its next write
+	s.diskPool.Close()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,323 @@
+package torrent
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lksndrttm/torrent/bitfield"
+	"github.com/lksndrttm/torrent/ipfilter"
+	m "github.com/lksndrttm/torrent/messages"
+	"github.com/lksndrttm/torrent/mse"
+	"github.com/lksndrttm/torrent/peer"
+	"github.com/lksndrttm/torrent/proxy"
+	"github.com/lksndrttm/torrent/proxy/proxytest"
+	"github.com/lksndrttm/torrent/tracker"
+	"github.com/lksndrttm/torrent/utp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionCloseTwice(t *testing.T) {
+	t.Parallel()
+	s, err := NewSession(Config{ListenAddr: "127.0.0.1:0"})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	require.NoError(t, s.Close())
+}
+
+func TestSessionAddAfterClose(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s, err := NewSession(Config{})
+	require.NoError(err)
+	require.NoError(s.Close())
+
+	tmeta, _, err := generateTestTorrent(1, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	require.ErrorIs(s.addTorrent(newTestTorrent(tmeta, mockTracker{}, t.TempDir())), ErrSessionClosed)
+	require.Empty(s.Torrents())
+}
+
+func TestSessionAddRemoveTorrent(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s, err := NewSession(Config{})
+	require.NoError(err)
+	defer s.Close() //nolint:errcheck
+	require.Nil(s.Addr())
+
+	tmeta, _, err := generateTestTorrent(1, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	tr := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+
+	require.NoError(s.addTorrent(tr))
+	require.Error(s.addTorrent(newTestTorrent(tmeta, mockTracker{}, t.TempDir())))
+	require.Equal([]*Torrent{tr}, s.Torrents())
+	require.Equal(s.PeerID(), tr.peerID)
+
+	require.NoError(s.RemoveTorrent(context.Background(), tmeta.InfoHash))
+	require.Error(s.RemoveTorrent(context.Background(), tmeta.InfoHash))
+	require.Empty(s.Torrents())
+}
+
+func TestSessionRoutesInboundConnections(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s, err := NewSession(Config{ListenAddr: "127.0.0.1:0"})
+	require.NoError(err)
+	defer s.Close() //nolint:errcheck
+
+	tmeta, _, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	tr := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+	require.NoError(s.addTorrent(tr))
+	tr.Start()
+
+	require.Eventually(func() bool {
+		tr.m.Lock()
+		defer tr.m.Unlock()
+		return tr.active != nil
+	}, time.Second, time.Millisecond)
+
+	// unknown info hash
+	con, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(err)
+	defer con.Close() //nolint:errcheck
+	_, err = con.Write(m.NewHandshake([20]byte{1}, [20]byte{2}).Serialize())
+	require.NoError(err)
+	_, err = m.ReadHandshake(con)
+	require.ErrorIs(err, io.EOF)
+
+	con, err = net.Dial("tcp", s.Addr().String())
+	require.NoError(err)
+	defer con.Close() //nolint:errcheck
+	require.NoError(con.SetDeadline(time.Now().Add(5 * time.Second)))
+
+	_, err = con.Write(m.NewHandshake(tmeta.InfoHash, [20]byte{2}).Serialize())
+	require.NoError(err)
+	h, err := m.ReadHandshake(con)
+	require.NoError(err)
+	require.Equal(s.PeerID(), h.PeerID)
+
+	bf, err := peer.ReceiveBitfield(con)
+	require.NoError(err)
+	require.Equal(bitfield.New(2), bf)
+
+	require.NoError(peer.SendMessage(con, m.NewBitfieldMessage(bitfield.New(2)).ToMessage()))
+	require.NoError(peer.SendMessage(con, m.InterestedMessage()))
+
+	for {
+		msg, err := peer.ReceiveMessage(con)
+		require.NoError(err)
+		if msg != nil && msg.ID == m.MsgUnchoke {
+			break
+		}
+	}
+}
+
+func TestSessionIPFilter(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	filter := ipfilter.New()
+	require.NoError(filter.AddCIDR("127.0.0.0/8"))
+	s, err := NewSession(Config{ListenAddr: "127.0.0.1:0", IPFilter: filter})
+	require.NoError(err)
+	defer s.Close() //nolint:errcheck
+
+	tmeta, _, err := generateTestTorrent(1, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	var dialed atomic.Bool
+	addr, cleanup, err := startMockTCPPeer(func(net.Conn) { dialed.Store(true) })
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	tr := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, t.TempDir())
+	require.NoError(s.addTorrent(tr))
+	require.False(tr.allowed(peerAddr))
+	tr.Start()
+	require.Eventually(func() bool {
+		tr.m.Lock()
+		defer tr.m.Unlock()
+		return tr.active != nil
+	}, time.Second, time.Millisecond)
+
+	con, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(err)
+	defer con.Close() //nolint:errcheck
+	_, err = con.Write(m.NewHandshake(tmeta.InfoHash, [20]byte{2}).Serialize())
+	require.NoError(err)
+	_, err = m.ReadHandshake(con)
+	require.Error(err)
+	require.False(dialed.Load())
+}
+
+func TestSessionDualStack(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s, err := NewSession(Config{ListenAddr: ":0"})
+	require.NoError(err)
+	defer s.Close() //nolint:errcheck
+
+	addrs := s.Addrs()
+	if len(addrs) < 2 {
+		t.Skip("IPv6 is not available")
+	}
+	port := s.Addr().(*net.TCPAddr).Port
+	require.Equal(port, addrs[1].(*net.TCPAddr).Port)
+
+	tmeta, _, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	tr := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+	require.NoError(s.addTorrent(tr))
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		con, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		require.NoError(err)
+		defer con.Close() //nolint:errcheck
+		require.NoError(con.SetDeadline(time.Now().Add(5 * time.Second)))
+
+		_, err = con.Write(m.NewHandshake(tmeta.InfoHash, [20]byte{2}).Serialize())
+		require.NoError(err)
+		h, err := m.ReadHandshake(con)
+		require.NoError(err)
+		require.Equal(s.PeerID(), h.PeerID)
+	}
+}
+
+func TestSessionEncryption(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s, err := NewSession(Config{ListenAddr: "127.0.0.1:0", Encryption: mse.Require})
+	require.NoError(err)
+	defer s.Close() //nolint:errcheck
+
+	tmeta, _, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	tr := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+	require.NoError(s.addTorrent(tr))
+	tr.Start()
+	require.Eventually(func() bool {
+		tr.m.Lock()
+		defer tr.m.Unlock()
+		return tr.active != nil
+	}, time.Second, time.Millisecond)
+
+	// plaintext is refused
+	con, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(err)
+	defer con.Close() //nolint:errcheck
+	_, err = con.Write(m.NewHandshake(tmeta.InfoHash, [20]byte{2}).Serialize())
+	require.NoError(err)
+	_, err = m.ReadHandshake(con)
+	require.Error(err)
+
+	addr, err := peer.ParsePeerAddr(s.Addr().String())
+	require.NoError(err)
+	dialer := peer.Dialer{Timeout: 5 * time.Second, Encryption: mse.Require}
+	p, err := dialer.Connect(context.Background(), addr, tmeta, [20]byte{2})
+	require.NoError(err)
+	defer p.Close()
+	require.Equal(s.PeerID(), p.ID)
+	require.True(p.Con.(*mse.Conn).Encrypted())
+}
+
+func TestSessionUTP(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s, err := NewSession(Config{ListenAddr: "127.0.0.1:0", Transport: peer.TransportPreferUTP})
+	require.NoError(err)
+	defer s.Close() //nolint:errcheck
+
+	tmeta, _, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	tr := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+	require.NoError(s.addTorrent(tr))
+	tr.Start()
+	require.Eventually(func() bool {
+		tr.m.Lock()
+		defer tr.m.Unlock()
+		return tr.active != nil
+	}, time.Second, time.Millisecond)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	client := utp.NewSocket(pc, false)
+	defer client.Close() //nolint:errcheck
+
+	// the uTP port is the TCP listen port
+	addr, err := peer.ParsePeerAddr(s.Addr().String())
+	require.NoError(err)
+	dialer := peer.Dialer{Timeout: 5 * time.Second, Transport: peer.TransportUTP, UTP: client}
+	p, err := dialer.Connect(context.Background(), addr, tmeta, [20]byte{2})
+	require.NoError(err)
+	defer p.Close()
+	require.Equal(s.PeerID(), p.ID)
+	require.IsType(&utp.Conn{}, p.Con)
+}
+
+func TestSessionProxy(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	var announced atomic.Bool
+	var port atomic.Value
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		announced.Store(true)
+		port.Store(r.URL.Query().Get("port"))
+		w.Write([]byte("d8:intervali900e5:peers0:e")) //nolint:errcheck
+	}))
+	defer web.Close()
+	server, err := proxytest.NewSOCKS5("", "")
+	require.NoError(err)
+	defer server.Close() //nolint:errcheck
+
+	s, err := NewSession(Config{
+		ListenAddr: "127.0.0.1:0",
+		Transport:  peer.TransportPreferUTP,
+		Proxy:      &proxy.Dialer{Type: proxy.SOCKS5, Addr: server.Addr()},
+		ProxyOnly:  true,
+	})
+	require.NoError(err)
+	defer s.Close() //nolint:errcheck
+	require.Empty(s.Addrs())
+	// the uTP socket runs over a UDP association
+	require.NotNil(s.utp)
+	require.EqualValues(1, server.Requests.Load())
+
+	tmeta, _, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	tmeta.Announce = web.URL
+	_, err = s.newTracker(tmeta.Announce).Announce(context.Background(), tmeta, s.PeerID(), tracker.AnnounceParams{})
+	require.NoError(err)
+	require.True(announced.Load())
+	// nothing listens for inbound connections
+	require.Equal("0", port.Load())
+	require.EqualValues(2, server.Requests.Load())
+
+	// HTTP proxies can not relay uTP
+	httpProxy, err := proxytest.NewHTTP("", "")
+	require.NoError(err)
+	defer httpProxy.Close() //nolint:errcheck
+	s2, err := NewSession(Config{
+		Transport: peer.TransportPreferUTP,
+		Proxy:     &proxy.Dialer{Type: proxy.HTTP, Addr: httpProxy.Addr()},
+	})
+	require.NoError(err)
+	defer s2.Close() //nolint:errcheck
+	require.Nil(s2.utp)
+}
@@ -0,0 +1,276 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lksndrttm/torrent/peer"
+	"github.com/lksndrttm/torrent/ratelimit"
+)
+
+// Stats is a snapshot of the torrent transfer statistics.
+type Stats struct {
+	State State
+	// Completed is the number of verified and stored bytes.
+	Completed int
+	// Downloaded and Uploaded count the piece data transferred over the wire.
+	Downloaded int
+	Uploaded   int
+	// Wasted counts received data that was discarded, including pieces that
+	// failed the hash check.
+	Wasted       int
+	DownloadRate int
+	UploadRate   int
+	// ETA is zero when it is unknown.
+	ETA time.Duration
+
+	PiecesHave  int
+	PiecesTotal int
+
+	ConnectedPeers int
+	KnownPeers     int
+	Seeds          int
+	Leechers       int
+	// Availability is the number of complete copies among connected peers.
+	Availability float64
+
+	Peers []PeerStats
+}
+
+// PeerStats describes a connected peer.
+type PeerStats struct {
+	Addr   peer.PeerAddr
+	Client string
+	// Choking reports whether the peer chokes us, Interested whether it
+	// wants data from us.
+	Choking    bool
+	Interested bool
+	Incoming   bool
+	Seed       bool
+
+	Downloaded   int
+	Uploaded     int
+	DownloadRate int
+	UploadRate   int
+	Requests     int
+	// Progress is the share of pieces the peer has.
+	Progress float64
+}
+
+// transferStats counts transferred bytes in both directions.
+type transferStats struct {
+	m          sync.Mutex
+	downloaded int
+	uploaded   int
+	wasted     int
+	downSpeed  *speedTracker
+	upSpeed    *speedTracker
+}
+
+func newTransferStats() *transferStats {
+	return &transferStats{
+		downSpeed: NewSpeedTracker(30),
+		upSpeed:   NewSpeedTracker(30),
+	}
+}
+
+func (ts *transferStats) addDownloaded(n int) {
+	ts.m.Lock()
+	ts.downloaded += n
+	ts.m.Unlock()
+	ts.downSpeed.update(n)
+}
+
+func (ts *transferStats) addUploaded(n int) {
+	ts.m.Lock()
+	ts.uploaded += n
+	ts.m.Unlock()
+	ts.upSpeed.update(n)
+}
+
+func (ts *transferStats) addWasted(n int) {
+	ts.m.Lock()
+	defer ts.m.Unlock()
+	ts.wasted += n
+}
+
+// peerState keeps the statistics of a connected peer.
+type peerState struct {
+	*transferStats
+	torrent  *transferStats
+	incoming bool
+
+	uploadLimit   *ratelimit.Limiter
+	downloadLimit *ratelimit.Limiter
+
+	// guarded by transferStats.m
+	requests   int
+	pieceBytes int
+}
+
+func newPeerState(torrent *transferStats, incoming bool) *peerState {
+	return &peerState{
+		transferStats: newTransferStats(),
+		torrent:       torrent,
+		incoming:      incoming,
+	}
+}
+
+func (ps *peerState) requested() {
+	ps.m.Lock()
+	defer ps.m.Unlock()
+	ps.requests++
+}
+
+func (ps *peerState) blockReceived(n int) {
+	ps.m.Lock()
+	ps.requests = max(ps.requests-1, 0)
+	ps.pieceBytes += n
+	ps.m.Unlock()
+
+	ps.addDownloaded(n)
+	ps.torrent.addDownloaded(n)
+}
+
+func (ps *peerState) blockSent(n int) {
+	ps.addUploaded(n)
+	ps.torrent.addUploaded(n)
+}
+
+// pieceFinished resets the piece counters. Data of a failed piece is wasted.
+func (ps *peerState) pieceFinished(ok bool) {
+	ps.m.Lock()
+	received := ps.pieceBytes
+	ps.pieceBytes = 0
+	ps.requests = 0
+	ps.m.Unlock()
+
+	if !ok {
+		ps.torrent.addWasted(received)
+	}
+}
+
+func (t *Torrent) Stats() Stats {
+	t.transfer.m.Lock()
+	s := Stats{
+		Downloaded: t.transfer.downloaded,
+		Uploaded:   t.transfer.uploaded,
+		Wasted:     t.transfer.wasted,
+	}
+	t.transfer.m.Unlock()
+
+	s.Completed = t.downloadingInfo.Downloaded()
+	s.DownloadRate = t.transfer.downSpeed.Speed()
+	s.UploadRate = t.transfer.upSpeed.Speed()
+	// skipped files are not part of the remaining bytes
+	left := 0
+	for _, id := range t.picker.Missing() {
+		begin, end := calcPieceBoundaries(uint32(id), t.metadata)
+		left += end - begin
+	}
+	if left > 0 && s.DownloadRate > 0 {
+		s.ETA = time.Duration(left/s.DownloadRate) * time.Second
+	}
+
+	s.PiecesHave = t.picker.HaveCount()
+	s.PiecesTotal = t.metadata.PieceCount()
+	s.Availability = t.picker.Availability()
+
+	s.KnownPeers = t.pool.Len()
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	s.State = t.state
+	for p, ps := range t.peers {
+		peerStats := ps.stats(p, s.PiecesTotal)
+		if peerStats.Seed {
+			s.Seeds++
+		} else {
+			s.Leechers++
+		}
+		s.Peers = append(s.Peers, peerStats)
+	}
+	s.ConnectedPeers = len(s.Peers)
+	return s
+}
+
+// stats must not race with handleMessage, which changes the peer under ps.m.
+func (ps *peerState) stats(p *peer.Peer, pieceCount int) PeerStats {
+	ps.m.Lock()
+	defer ps.m.Unlock()
+
+	have := 0
+	for id := range pieceCount {
+		if p.Bitfield.HavePiece(id) {
+			have++
+		}
+	}
+	s := PeerStats{
+		Addr:         p.Addr,
+		Client:       clientName(p.ID),
+		Choking:      p.Choking,
+		Interested:   p.Interested,
+		Incoming:     ps.incoming,
+		Seed:         pieceCount > 0 && have == pieceCount,
+		Downloaded:   ps.downloaded,
+		Uploaded:     ps.uploaded,
+		DownloadRate: ps.downSpeed.Speed(),
+		UploadRate:   ps.upSpeed.Speed(),
+		Requests:     ps.requests,
+	}
+	if pieceCount > 0 {
+		s.Progress = float64(have) / float64(pieceCount)
+	}
+	return s
+}
+
+var clientNames = map[string]string{
+	"DE": "Deluge",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"AZ": "Vuze",
+	"BT": "BitTorrent",
+	"xx": "torrent",
+}
+
+// clientName decodes Azureus style peer IDs like -qB4250-.
+func clientName(id [20]byte) string {
+	if id[0] != '-' || id[7] != '-' {
+		return "unknown"
+	}
+	code, version := string(id[1:3]), string(id[3:7])
+	name, ok := clientNames[code]
+	if !ok {
+		name = code
+	}
+	return fmt.Sprintf("%s %s", name, version)
+}
+
+// SessionStats is a snapshot of the session statistics.
+type SessionStats struct {
+	// BandwidthProfile is the name of the active schedule profile.
+	BandwidthProfile string
+	UploadLimit      int
+	DownloadLimit    int
+	UploadRate       int
+	DownloadRate     int
+	Torrents         int
+}
+
+func (s *Session) Stats() SessionStats {
+	stats := SessionStats{
+		BandwidthProfile: s.scheduler.Active(),
+		UploadLimit:      s.uploadLimit.Rate(),
+		DownloadLimit:    s.downloadLimit.Rate(),
+	}
+	for _, t := range s.Torrents() {
+		stats.UploadRate += t.transfer.upSpeed.Speed()
+		stats.DownloadRate += t.transfer.downSpeed.Speed()
+		stats.Torrents++
+	}
+	return stats
+}
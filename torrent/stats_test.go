@@ -0,0 +1,106 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lksndrttm/torrent/bitfield"
+	"github.com/lksndrttm/torrent/peer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientName(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, "qBittorrent 4250", clientName([20]byte([]byte("-qB4250-abcdefghijkl"))))
+	require.Equal(t, "ZZ 0001", clientName([20]byte([]byte("-ZZ0001-abcdefghijkl"))))
+	require.Equal(t, "unknown", clientName([20]byte{}))
+}
+
+func TestDownloadStats(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, tdata, err := generateTestTorrent(3, 2, BlockSize, BlockSize)
+	require.NoError(err)
+	addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bitfield.Bitfield{255}, tmeta, tdata, BlockSize))
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	tr := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, t.TempDir())
+	s := tr.Stats()
+	require.Equal(3, s.PiecesTotal)
+	require.Zero(s.PiecesHave)
+	require.Empty(s.Peers)
+
+	tr.Download()
+
+	s = tr.Stats()
+	require.Equal(StateCompleted, s.State)
+	require.Equal(len(tdata), s.Completed)
+	require.Equal(len(tdata), s.Downloaded)
+	require.Zero(s.Wasted)
+	require.Zero(s.ETA)
+	require.Equal(3, s.PiecesHave)
+	require.Equal(1, s.KnownPeers)
+	require.Zero(s.ConnectedPeers)
+}
+
+func TestETASkipsUnwantedPieces(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta := multiFileTestMetadata(make([]byte, 4*BlockSize), BlockSize, BlockSize, 2*BlockSize, BlockSize)
+	tr := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+	require.NoError(tr.SetFilePriority(1, PrioritySkip))
+	tr.transfer.downSpeed.history = []trackerRecord{{downloaded: BlockSize, elapsedSeconds: 1}}
+
+	tr.picker.Done(0)
+	require.Equal(time.Second, tr.Stats().ETA, "one wanted piece is left")
+	tr.picker.Done(3)
+	require.Zero(tr.Stats().ETA)
+}
+
+func TestHashFailureIsWasted(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, tdata, err := generateTestTorrent(1, 2, BlockSize, BlockSize)
+	require.NoError(err)
+	corrupted := bytes.Clone(tdata)
+	corrupted[0]++
+	addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bitfield.Bitfield{255}, tmeta, corrupted, BlockSize))
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	tr := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, t.TempDir())
+	events, cancel := tr.Subscribe()
+	defer cancel()
+	tr.Start()
+
+	var s Stats
+	require.Eventually(func() bool {
+		s = tr.Stats()
+		return s.Wasted > 0
+	}, 5*time.Second, time.Millisecond)
+	require.Zero(s.PiecesHave)
+	require.Zero(s.Completed)
+	require.GreaterOrEqual(s.Wasted, len(tdata))
+
+	for e := range events {
+		if e.Type == EventPieceHashFailed {
+			require.Zero(e.Piece)
+			require.Equal(peerAddr.String(), e.Peer.String())
+			break
+		}
+	}
+
+	ctx, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+	require.NoError(tr.Stop(ctx))
+}
@@ -1,25 +1,60 @@
 package torrent
 
 import (
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"log"
+	"net"
+	"net/http"
 	"os"
-	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/lksndrttm/torrent/ipfilter"
+	"github.com/lksndrttm/torrent/merkle"
 	m "github.com/lksndrttm/torrent/messages"
 	md "github.com/lksndrttm/torrent/metadata"
 	"github.com/lksndrttm/torrent/peer"
+	"github.com/lksndrttm/torrent/ratelimit"
 	"github.com/lksndrttm/torrent/tracker"
 )
 
 var PeerID = [20]byte([]byte("-xx2940-k8xj0xgex6xx"))
 
+type State int
+
+const (
+	StateStopped State = iota
+	StateDownloading
+	StatePaused
+	StateCompleted
+	StateError
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateDownloading:
+		return "downloading"
+	case StatePaused:
+		return "paused"
+	case StateCompleted:
+		return "completed"
+	case StateError:
+		return "error"
+	default:
+		return fmt.Sprintf("state(%d)", int(s))
+	}
+}
+
 const BlockSize = 16384
 
+const connectTimeout = 5 * time.Second
+
 type Piece struct {
 	ID   uint32
 	Data []byte
@@ -30,10 +65,12 @@ func (p *Piece) CheckIntegrity(pieceHash [20]byte) bool {
 }
 
 type pieceDownloadingInfo struct {
-	ID          uint32
-	Hash        []byte
-	Blocks      []bool
-	Data        []byte
+	ID     uint32
+	Hash   []byte
+	Blocks []bool
+	Data   []byte
+	// sources are the peers the blocks came from
+	sources     []peer.PeerAddr
 	maxPieceLen uint32
 	pieceLen    uint32
 	blocksCount uint32
@@ -44,7 +81,8 @@ type pieceDownloadingInfo struct {
 func NewPieceDownloadInfo(id uint32, maxPieceLen uint32) *pieceDownloadingInfo {
 	p := pieceDownloadingInfo{
 		ID:          id,
-		Blocks:      make([]bool, maxPieceLen/BlockSize),
+		Blocks:      make([]bool, (maxPieceLen+BlockSize-1)/BlockSize),
+		sources:     make([]peer.PeerAddr, (maxPieceLen+BlockSize-1)/BlockSize),
 		Data:        make([]byte, maxPieceLen),
 		maxPieceLen: maxPieceLen,
 	}
@@ -73,8 +111,34 @@ func (p *pieceDownloadingInfo) AddBlock(pmsg *m.PieceMessage) error {
 	return nil
 }
 
+// addPadding marks the blocks in [from, to) after the end of a v2 file as
+// received zeros.
+func (p *pieceDownloadingInfo) addPadding(from, to uint32) {
+	for b := (from + BlockSize - 1) / BlockSize; b < uint32(len(p.Blocks)); b++ {
+		p.Blocks[b] = true
+		p.blocksCount++
+	}
+	p.pieceLen += to - from
+}
+
+// setSource records the peer that sent the block at offset.
+func (p *pieceDownloadingInfo) setSource(offset uint32, addr peer.PeerAddr) {
+	p.sources[offset/BlockSize] = addr
+}
+
+// contributors returns the distinct peers that sent blocks of the piece.
+func (p *pieceDownloadingInfo) contributors() []peer.PeerAddr {
+	addrs := []peer.PeerAddr{}
+	for _, addr := range p.sources {
+		if addr.IP != nil && !slices.ContainsFunc(addrs, func(a peer.PeerAddr) bool { return a.String() == addr.String() }) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
 func (p *pieceDownloadingInfo) Completed() bool {
-	return p.blocksCount == p.maxPieceLen/BlockSize
+	return p.blocksCount == uint32(len(p.Blocks))
 }
 
 func (p *pieceDownloadingInfo) Piece() *Piece {
@@ -84,31 +148,86 @@ func (p *pieceDownloadingInfo) Piece() *Piece {
 	}
 }
 
+// hashFailedError is a piece or block that failed the hash check. It names
+// the peers whose data was checked.
+type hashFailedError struct {
+	err          error
+	contributors []peer.PeerAddr
+}
+
+func (e *hashFailedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *hashFailedError) Unwrap() error {
+	return e.err
+}
+
 var (
 	errNetwork     error = errors.New("network error")
 	errDownloading error = errors.New("downloading error")
+	errHashFailed  error = fmt.Errorf("%w: hash mismatch", errDownloading)
+)
+
+// Errors that put the torrent into StateError. The error returned by
+// Torrent.Err wraps one of them.
+var (
+	ErrTrackerUnreachable = errors.New("tracker unreachable")
+	ErrStorage            = errors.New("storage failure")
+	ErrNoPeers            = errors.New("no peers")
+	ErrMetadataInvalid    = errors.New("metadata invalid")
 )
 
-func downloadPiece(pieceID uint32, p *peer.Peer, tmeta *md.TorrentMetadata) (piece *Piece, err error) {
+// downloadPiece requests all blocks of the piece from the peer. Messages not
+// related to the piece download are passed to onMessage.
+func downloadPiece(pieceID uint32, p *peer.Peer, ps *peerState, tmeta *md.TorrentMetadata, onMessage func(*m.Message) error) (piece *Piece, err error) {
 	have := p.Bitfield.HavePiece(int(pieceID))
 	if !have {
 		return nil, fmt.Errorf("peer dont have requested piece %w", errDownloading)
 	}
 
-	pdInfo := NewPieceDownloadInfo(pieceID, uint32(tmeta.PieceLength))
+	// the last piece may be shorter and have fewer blocks
+	begin, end := calcPieceBoundaries(pieceID, tmeta)
+	pdInfo := NewPieceDownloadInfo(pieceID, uint32(end-begin))
 
 	requestTimeout := 10 * time.Second
 	backlog := 0
 	maxBacklog := 5
 
-	blocksCount := uint32(tmeta.PieceLength) / BlockSize
+	blocksCount := uint32(len(pdInfo.Blocks))
 	pieceOffset := uint32(tmeta.PieceLength) * pieceID
+	dataEnd := uint32(tmeta.Length)
+	v2, isV2 := tmeta.V2Piece(int(pieceID))
+	if isV2 && !tmeta.HasV1() {
+		// v2 peers do not serve the padding after the end of a file
+		dataEnd = pieceOffset + uint32(v2.Length)
+		blocksCount = (uint32(v2.Length) + BlockSize - 1) / BlockSize
+		pdInfo.addPadding(uint32(v2.Length), uint32(end-begin))
+	}
+
+	// the block hashes of v2 pieces allow to check every block on arrival
+	var hashReq *m.HashRequestMessage
+	var blockHashes [][32]byte
+	if isV2 && p.SupportsV2 && v2.Width > 1 {
+		if err = p.Con.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+			return nil, fmt.Errorf("cant set deadline for peer io: %w", errNetwork)
+		}
+		hashReq = &m.HashRequestMessage{
+			PiecesRoot: tmeta.Files[v2.File].PiecesRoot,
+			Index:      uint32(v2.Index * tmeta.PieceLength / BlockSize),
+			Length:     uint32(v2.Width),
+		}
+		if err := p.SendMessage(hashReq.ToMessage()); err != nil {
+			return nil, fmt.Errorf("hash request sending error: %w", errNetwork)
+		}
+	}
+
 	for pdInfo.downloaded < int(blocksCount) {
 		blockOffset := uint32(pdInfo.requested * BlockSize)
 		offset := pieceOffset + blockOffset
 		blockLength := uint32(BlockSize)
-		if offset+blockLength > uint32(tmeta.Length) {
-			blockLength = uint32(tmeta.Length) - offset
+		if offset+blockLength > dataEnd {
+			blockLength = dataEnd - offset
 		}
 
 		if err = p.Con.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
@@ -123,6 +242,7 @@ func downloadPiece(pieceID uint32, p *peer.Peer, tmeta *md.TorrentMetadata) (pie
 			}
 			pdInfo.requested++
 			backlog++
+			ps.requested()
 			continue
 		}
 
@@ -137,6 +257,7 @@ func downloadPiece(pieceID uint32, p *peer.Peer, tmeta *md.TorrentMetadata) (pie
 			if err != nil {
 				return nil, fmt.Errorf("error while sending keep-alive message: %w", err)
 			}
+			continue
 		}
 
 		switch msg.ID {
@@ -147,15 +268,43 @@ func downloadPiece(pieceID uint32, p *peer.Peer, tmeta *md.TorrentMetadata) (pie
 			if err != nil {
 				return nil, fmt.Errorf("cant convert received message to PieceMessage: %w", err)
 			}
+			ps.blockReceived(len(pmsg.Data))
 
 			err = pdInfo.AddBlock(pmsg)
 			if err != nil {
 				return nil, fmt.Errorf("piece %d  constructing error: %w", pdInfo.ID, err)
 			}
-		case m.MsgChoke:
-			p.Choking = true
-		case m.MsgUnchoke:
-			p.Choking = false
+			pdInfo.setSource(pmsg.BlockOffset, p.Addr)
+			if blockHashes != nil && !checkBlock(v2, blockHashes, pmsg.Data, int(pmsg.BlockOffset)) {
+				return nil, &hashFailedError{
+					err:          fmt.Errorf("piece %d block at %d failed integrity check: %w", pieceID, pmsg.BlockOffset, errHashFailed),
+					contributors: []peer.PeerAddr{p.Addr},
+				}
+			}
+		case m.MsgHashes:
+			hMsg, err := m.ToHashesMessage(msg)
+			if err != nil {
+				return nil, fmt.Errorf("cant convert received message to HashesMessage: %w", err)
+			}
+			// answers to earlier requests and hashes not matching the piece are ignored
+			if hashReq == nil || hMsg.HashRequestMessage != *hashReq || len(hMsg.Hashes) != v2.Width ||
+				merkle.Root(hMsg.Hashes, v2.Width, [32]byte{}) != v2.Root {
+				continue
+			}
+			blockHashes = hMsg.Hashes
+			for b, have := range pdInfo.Blocks {
+				offset := b * BlockSize
+				if have && !checkBlock(v2, blockHashes, pdInfo.Data[offset:min(offset+BlockSize, len(pdInfo.Data))], offset) {
+					return nil, &hashFailedError{
+						err:          fmt.Errorf("piece %d block at %d failed integrity check: %w", pieceID, offset, errHashFailed),
+						contributors: []peer.PeerAddr{pdInfo.sources[b]},
+					}
+				}
+			}
+		default:
+			if err := onMessage(msg); err != nil {
+				return nil, fmt.Errorf("message handling error: %w", errNetwork)
+			}
 		}
 
 	}
@@ -163,34 +312,437 @@ func downloadPiece(pieceID uint32, p *peer.Peer, tmeta *md.TorrentMetadata) (pie
 		return nil, fmt.Errorf("piece %d downloading attemp failed: %w", pieceID, errDownloading)
 	}
 	piece = pdInfo.Piece()
-	if !piece.CheckIntegrity(tmeta.PieceHashes[pieceID]) {
-		return nil, fmt.Errorf("piece %d failed integrity check: %w", pieceID, errDownloading)
+	if !tmeta.VerifyPiece(int(pieceID), piece.Data) {
+		return nil, &hashFailedError{
+			err:          fmt.Errorf("piece %d failed integrity check: %w", pieceID, errHashFailed),
+			contributors: pdInfo.contributors(),
+		}
 	}
 
 	return piece, err
 }
 
-func communicateWithPeer(peerAddr peer.PeerAddr, tm *md.TorrentMetadata, reqChan chan uint32, pieceChan chan *Piece) {
-	cTimeout := time.Second * 5
-	p, err := peer.Connect(peerAddr, tm, cTimeout, PeerID)
+// checkBlock verifies the block at offset of a v2 piece against the block
+// hashes. Padding after the end of the file is not hashed.
+func checkBlock(v2 md.V2Piece, hashes [][32]byte, data []byte, offset int) bool {
+	if offset >= v2.Length {
+		return true
+	}
+	return sha256.Sum256(data[:min(len(data), v2.Length-offset)]) == hashes[offset/BlockSize]
+}
+
+func (t *Torrent) communicateWithPeer(r *run, peerAddr peer.PeerAddr) {
+	p, err := t.dialer.Connect(r.ctx, peerAddr, t.metadata, t.peerID)
+	if err != nil {
+		t.pool.failed(peerAddr, time.Now())
+		return
+	}
+	t.pool.connected(peerAddr)
+
+	t.runPeer(r, p, false)
+}
+
+// connectPeers keeps dialing peers from the pool while the connection limits
+// allow it. It signals exhausted when no peer is connected and none is left
+// to dial.
+func (t *Torrent) connectPeers(r *run, exhausted chan<- struct{}) {
+	for {
+		changed := t.pool.limits.Changed()
+		sessionChanged := t.pool.sessionLimits().Changed()
+
+		for {
+			addr, ok := t.pool.next(time.Now())
+			if !ok {
+				break
+			}
+			r.peers.Add(1)
+			go func() {
+				defer r.peers.Done()
+				t.communicateWithPeer(r, addr)
+			}()
+		}
+
+		if exhausted != nil && t.pool.exhausted() {
+			select {
+			case exhausted <- struct{}{}:
+			default:
+			}
+		}
+
+		retry := time.NewTimer(maxRetryBackoff)
+		if wait, ok := t.pool.nextRetry(time.Now()); ok {
+			retry.Reset(wait)
+		}
+
+		select {
+		case <-changed:
+		case <-sessionChanged:
+		case <-retry.C:
+		case <-r.ctx.Done():
+			retry.Stop()
+			return
+		}
+		retry.Stop()
+	}
+}
+
+// acceptPeer takes over an inbound connection with a finished handshake.
+func (t *Torrent) acceptPeer(con net.Conn, h m.Handshake) {
+	t.m.Lock()
+	r := t.active
+	if r != nil {
+		r.peers.Add(1)
+	}
+	t.m.Unlock()
+	if r == nil {
+		con.Close() //nolint:errcheck
+		return
+	}
+	defer r.peers.Done()
+
+	addr, err := peer.ParsePeerAddr(con.RemoteAddr().String())
+	if err != nil || !t.allowed(addr) || !t.pool.accept(addr) {
+		con.Close() //nolint:errcheck
+		return
+	}
+	p, err := peer.Accept(con, addr, t.picker.Bitfield(), 5*time.Second)
 	if err != nil {
+		t.pool.closed(addr, 0, time.Now())
+		con.Close() //nolint:errcheck
 		return
 	}
+	p.ID = h.PeerID
+	p.SupportsV2 = h.SupportsV2() && t.metadata.HasV2()
+
+	t.runPeer(r, p, true)
+}
+
+func (t *Torrent) runPeer(r *run, p *peer.Peer, incoming bool) {
 	defer p.Close()
+	stop := context.AfterFunc(r.ctx, p.Close)
+	defer stop()
+
+	t.pool.identify(p.Addr, p.ID)
+	ps, ok := t.addPeer(p, incoming)
+	if !ok {
+		t.pool.duplicate(p.Addr)
+		return
+	}
+	defer t.removePeer(p)
+
+	if err := p.SendMessage(m.InterestedMessage()); err != nil {
+		return
+	}
+
+	onMessage := func(msg *m.Message) error {
+		return t.handleMessage(p, ps, msg)
+	}
+
+	for r.ctx.Err() == nil {
+		changed := t.picker.Changed()
+		pieceID, ok := t.picker.Pick(p.Bitfield)
+		if !ok {
+			if t.picker.Complete() {
+				return
+			}
+			if err := t.serveUntil(r.ctx, p, ps, changed); err != nil {
+				return
+			}
+			continue
+		}
 
-	for pieceID := range reqChan {
-		piece, err := downloadPiece(pieceID, p, tm)
+		piece, err := downloadPiece(pieceID, p, ps, t.metadata, onMessage)
+		ps.pieceFinished(err == nil)
 		if err != nil {
-			reqChan <- pieceID
+			t.picker.Release(pieceID)
+			var hashErr *hashFailedError
+			if errors.As(err, &hashErr) {
+				t.publish(Event{Type: EventPieceHashFailed, Piece: int(pieceID), Peer: p.Addr})
+				if t.blame(hashErr.contributors, p.Addr.IP) {
+					return
+				}
+			}
 			if errors.Is(err, errNetwork) {
 				return
 			}
-			if errors.Is(err, errDownloading) {
-				continue
+			continue
+		}
+		t.publish(Event{Type: EventPieceVerified, Piece: int(pieceID), Peer: p.Addr})
+
+		select {
+		case r.pieceChan <- piece:
+		case <-r.ctx.Done():
+			t.picker.Release(pieceID)
+			return
+		}
+	}
+}
+
+// blame counts a failed piece against every peer that contributed to it.
+// It reports whether ip got banned.
+func (t *Torrent) blame(contributors []peer.PeerAddr, ip net.IP) bool {
+	ips := []net.IP{}
+	for _, addr := range contributors {
+		t.pool.hashFailed(addr)
+		if !slices.ContainsFunc(ips, addr.IP.Equal) {
+			ips = append(ips, addr.IP)
+		}
+	}
+	banned := t.bans.hashFailed(ips, time.Now())
+	return slices.ContainsFunc(banned, ip.Equal)
+}
+
+// addPeer registers a connected peer. It reports false if a peer with the
+// same ID is already connected, for example over the other IP family.
+func (t *Torrent) addPeer(p *peer.Peer, incoming bool) (*peerState, bool) {
+	ps := newPeerState(t.transfer, incoming)
+	t.m.Lock()
+	if p.ID != [20]byte{} {
+		for other := range t.peers {
+			if other.ID == p.ID {
+				t.m.Unlock()
+				return nil, false
 			}
 		}
+	}
+	ps.uploadLimit = ratelimit.New(t.peerUploadRate, t.uploadLimit)
+	ps.downloadLimit = ratelimit.New(t.peerDownloadRate, t.downloadLimit)
+	p.SetRateLimits(ps.uploadLimit, ps.downloadLimit)
+	t.peers[p] = ps
+	t.m.Unlock()
+	t.picker.AddPeer(p.Bitfield)
+	t.publish(Event{Type: EventPeerConnected, Peer: p.Addr})
+	return ps, true
+}
+
+func (t *Torrent) removePeer(p *peer.Peer) {
+	t.m.Lock()
+	ps := t.peers[p]
+	delete(t.peers, p)
+	t.m.Unlock()
+
+	ps.m.Lock()
+	downloaded := ps.downloaded
+	ps.m.Unlock()
+	t.pool.closed(p.Addr, downloaded, time.Now())
+
+	t.picker.RemovePeer(p.Bitfield)
+	t.publish(Event{Type: EventPeerDisconnected, Peer: p.Addr})
+}
+
+// allowed reports whether connections to the peer are permitted.
+func (t *Torrent) allowed(addr peer.PeerAddr) bool {
+	t.m.Lock()
+	filter := t.filter
+	t.m.Unlock()
+	return !filter.Blocked(addr.IP) && !t.bans.Banned(addr.IP, time.Now())
+}
+
+// kick closes the connections to a banned IP.
+func (t *Torrent) kick(ip net.IP) {
+	t.m.Lock()
+	kicked := []*peer.Peer{}
+	for p := range t.peers {
+		if p.Addr.IP.Equal(ip) {
+			kicked = append(kicked, p)
+		}
+	}
+	t.m.Unlock()
+
+	for _, p := range kicked {
+		p.Close()
+	}
+	t.publish(Event{Type: EventPeerBanned, Peer: peer.PeerAddr{IP: ip}})
+}
+
+// serveUntil handles messages of a peer we have nothing to download from until changed is closed.
+func (t *Torrent) serveUntil(ctx context.Context, p *peer.Peer, ps *peerState, changed <-chan struct{}) error {
+	for {
+		select {
+		case <-changed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := p.Con.SetDeadline(time.Now().Add(time.Second)); err != nil {
+			return err
+		}
+		msg, err := p.ReceiveMessage()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+
+		if err := t.handleMessage(p, ps, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// handleMessage changes the peer under ps.m, so Stats can read it at any time.
+func (t *Torrent) handleMessage(p *peer.Peer, ps *peerState, msg *m.Message) error {
+	switch msg.ID {
+	case m.MsgChoke:
+		ps.m.Lock()
+		p.Choking = true
+		ps.m.Unlock()
+	case m.MsgUnchoke:
+		ps.m.Lock()
+		p.Choking = false
+		ps.m.Unlock()
+	case m.MsgInterested:
+		ps.m.Lock()
+		p.Interested = true
+		ps.m.Unlock()
+		return p.SendMessage(m.UnchokeMessage())
+	case m.MsgNotInterested:
+		ps.m.Lock()
+		p.Interested = false
+		ps.m.Unlock()
+	case m.MsgHave:
+		hMsg, err := m.ToHaveMessage(msg)
+		if err != nil {
+			return err
+		}
+		ps.m.Lock()
+		have := p.Bitfield.HavePiece(int(hMsg.PieceID))
+		if !have {
+			p.Bitfield.SetPiece(int(hMsg.PieceID))
+		}
+		ps.m.Unlock()
+		if !have {
+			t.picker.PeerHave(int(hMsg.PieceID))
+		}
+	case m.MsgRequest:
+		rMsg, err := m.ToRequestMessage(msg)
+		if err != nil {
+			return err
+		}
+		return t.serveRequest(p, ps, rMsg)
+	case m.MsgHashRequest:
+		hMsg, err := m.ToHashRequestMessage(msg)
+		if err != nil {
+			return err
+		}
+		return t.serveHashRequest(p, hMsg)
+	}
+	return nil
+}
+
+const maxRequestLength = 2 * BlockSize
+
+func (t *Torrent) serveRequest(p *peer.Peer, ps *peerState, rMsg *m.RequestMessage) error {
+	if int(rMsg.PieceID) >= t.metadata.PieceCount() || !t.picker.Have(int(rMsg.PieceID)) {
+		return nil
+	}
+	if rMsg.BlockLength > maxRequestLength {
+		return fmt.Errorf("requested block too long")
+	}
+
+	t.m.Lock()
+	r := t.active
+	t.m.Unlock()
+	if r == nil {
+		return nil
+	}
+
+	data, err := r.disk.ReadPiece(rMsg.PieceID)
+	if err != nil {
+		return nil
+	}
+	if int(rMsg.BlockOffset+rMsg.BlockLength) > len(data) {
+		return fmt.Errorf("requested block out of piece bounds")
+	}
+
+	block := data[rMsg.BlockOffset : rMsg.BlockOffset+rMsg.BlockLength]
+	if err := p.SendMessage(m.NewPieceMessage(rMsg.PieceID, rMsg.BlockOffset, block).ToMessage()); err != nil {
+		return err
+	}
+	ps.blockSent(len(block))
+	return nil
+}
+
+// serveHashRequest answers requests for the block hashes of a piece we have
+// and for piece layer hashes, other requests are rejected.
+func (t *Torrent) serveHashRequest(p *peer.Peer, req *m.HashRequestMessage) error {
+	hashes, proof, ok := t.hashes(req)
+	if !ok {
+		return p.SendMessage(req.ToRejectMessage())
+	}
+	return p.SendMessage((&m.HashesMessage{HashRequestMessage: *req, Hashes: slices.Concat(hashes, proof)}).ToMessage())
+}
+
+// hashes returns the requested hashes and their uncle hashes.
+func (t *Torrent) hashes(req *m.HashRequestMessage) (hashes, proof [][32]byte, ok bool) {
+	tmeta := t.metadata
+	file := slices.IndexFunc(tmeta.Files, func(f md.FileInfo) bool {
+		return f.Length > 0 && f.PiecesRoot == req.PiecesRoot
+	})
+	index, length := int(req.Index), int(req.Length)
+	if !tmeta.HasV2() || file < 0 || length == 0 || length&(length-1) != 0 || index%length != 0 {
+		return nil, nil, false
+	}
+	f := tmeta.Files[file]
+	blocksPerPiece := tmeta.PieceLength / BlockSize
+	pieceHeight := merkle.Height(blocksPerPiece)
+
+	// the piece layer tree holds the uncles above the pieces
+	var pieceTree [][][32]byte
+	if layer, ok := tmeta.PieceLayers[f.PiecesRoot]; ok && f.Length > tmeta.PieceLength {
+		pieceTree = merkle.Layers(layer, merkle.Width(len(layer)), merkle.PadHash(pieceHeight))
+	}
+	proofLayers := int(req.ProofLayers)
+
+	switch int(req.BaseLayer) {
+	case 0:
+		pieceID := (f.Offset + index*BlockSize) / tmeta.PieceLength
+		v2, ok := tmeta.V2Piece(pieceID)
+		if !ok || v2.File != file || index*BlockSize != v2.Index*tmeta.PieceLength || length != v2.Width || !t.picker.Have(pieceID) {
+			return nil, nil, false
+		}
+		t.m.Lock()
+		r := t.active
+		t.m.Unlock()
+		if r == nil {
+			return nil, nil, false
+		}
+		data, err := r.disk.ReadPiece(uint32(pieceID))
+		if err != nil || len(data) < v2.Length {
+			return nil, nil, false
+		}
+		hashes = merkle.Layers(merkle.BlockHashes(data[:v2.Length]), length, [32]byte{})[0]
+		if pieceTree != nil {
+			proof = merkle.Proof(pieceTree, v2.Index, proofLayers)
+		}
+		return hashes, proof, true
+	case pieceHeight:
+		if pieceTree == nil || index+length > len(pieceTree[0]) {
+			return nil, nil, false
+		}
+		hashes = pieceTree[0][index : index+length]
+		return hashes, merkle.Proof(pieceTree[merkle.Height(length):], index/length, proofLayers), true
+	default:
+		return nil, nil, false
+	}
+}
 
-		pieceChan <- piece
+func (t *Torrent) broadcastHave(pieceID uint32) {
+	t.m.Lock()
+	peers := make([]*peer.Peer, 0, len(t.peers))
+	for p := range t.peers {
+		peers = append(peers, p)
+	}
+	t.m.Unlock()
+
+	for _, p := range peers {
+		p.SendMessage(m.NewHaveMessage(pieceID).ToMessage()) //nolint:errcheck
 	}
 }
 
@@ -230,9 +782,12 @@ type downloadingInfo struct {
 	TorrentMetadata *md.TorrentMetadata
 	downloaded      int
 	isDone          bool
+	m               sync.Mutex
 }
 
 func (di *downloadingInfo) PieceDownloaded(piece *Piece) {
+	di.m.Lock()
+	defer di.m.Unlock()
 	di.downloaded += len(piece.Data)
 	if di.downloaded == di.TorrentMetadata.Length {
 		di.isDone = true
@@ -240,59 +795,306 @@ func (di *downloadingInfo) PieceDownloaded(piece *Piece) {
 }
 
 func (di *downloadingInfo) Remainded() int {
+	di.m.Lock()
+	defer di.m.Unlock()
 	return di.TorrentMetadata.Length - di.downloaded
 }
 
 func (di *downloadingInfo) Downloaded() int {
+	di.m.Lock()
+	defer di.m.Unlock()
 	return di.downloaded
 }
 
-func (t *Torrent) download() {
-	peers, err := t.tracker.RequestPeers(t.metadata, PeerID)
-	if err != nil {
-		log.Fatal(err)
-		return
+// run holds the state of a running download.
+type run struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	pieceChan chan *Piece
+	disk      *torrentDisk
+	peers     sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+}
+
+// fail stops the run, only the first error is kept.
+func (r *run) fail(err error) {
+	r.errOnce.Do(func() {
+		r.err = err
+	})
+	r.cancel()
+}
+
+const stopAnnounceTimeout = 5 * time.Second
+
+func (t *Torrent) announce(ctx context.Context, event tracker.Event) ([]peer.PeerAddr, error) {
+	t.transfer.m.Lock()
+	uploaded := t.transfer.uploaded
+	t.transfer.m.Unlock()
+	// private trackers track the ratio from these numbers
+	params := tracker.AnnounceParams{
+		Event:      event,
+		Uploaded:   uploaded,
+		Downloaded: t.downloadingInfo.Downloaded(),
+		Left:       t.downloadingInfo.Remainded(),
 	}
+	peers, err := t.tracker.Announce(ctx, t.metadata, t.peerID, params)
+	t.publish(Event{Type: EventTrackerAnnounce, Announce: event, Peers: len(peers), Err: err})
+	return peers, err
+}
 
-	pieceCount := len(t.metadata.PieceHashes)
+// defaultAnnounceInterval is used until the tracker asks for an interval.
+const defaultAnnounceInterval = 30 * time.Minute
 
-	reqChan := make(chan uint32, pieceCount)
-	pieceChan := make(chan *Piece, 100)
-	defer close(reqChan)
+// intervalTracker is a tracker that tells how often to announce.
+type intervalTracker interface {
+	Interval() time.Duration
+}
 
-	for i := range pieceCount {
-		reqChan <- uint32(i)
+func (t *Torrent) announceInterval() time.Duration {
+	if it, ok := t.tracker.(intervalTracker); ok {
+		if interval := it.Interval(); interval > 0 {
+			return interval
+		}
 	}
+	return defaultAnnounceInterval
+}
 
-	outFilePath := filepath.Join(t.outDir, t.metadata.Name)
-	file, err := os.Create(outFilePath)
-	if err != nil {
-		log.Fatal(err)
-		return
+// reannounce announces on the tracker interval for the whole run and adds
+// the returned peers to the pool, so dead peers are replaced. A signal on
+// exhausted announces right away, noPeers is closed when even that leaves
+// no peer to dial.
+func (t *Torrent) reannounce(r *run, exhausted <-chan struct{}, noPeers chan<- struct{}) {
+	for {
+		timer := time.NewTimer(t.announceInterval())
+		select {
+		case <-timer.C:
+		case <-exhausted:
+			timer.Stop()
+		case <-r.ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		peers, _ := t.announce(r.ctx, tracker.EventNone)
+		if r.ctx.Err() != nil {
+			return
+		}
+		t.pool.Add(peers, SourceTracker)
+		if noPeers != nil && t.pool.exhausted() {
+			close(noPeers)
+			noPeers, exhausted = nil, nil
+		}
 	}
-	defer file.Close()
+}
 
-	tdata := TorrentData{
-		File:            file,
-		TorrentMetadata: t.metadata,
+func (t *Torrent) announceStopped() {
+	t.m.Lock()
+	ctx := t.haltCtx
+	t.m.Unlock()
+	if ctx == nil {
+		ctx = context.Background()
 	}
 
-	for _, peer := range peers[:min(len(peers), 50)] {
-		go communicateWithPeer(peer, t.metadata, reqChan, pieceChan)
+	ctx, cancel := context.WithTimeout(ctx, stopAnnounceTimeout)
+	defer cancel()
+	t.announce(ctx, tracker.EventStopped) //nolint:errcheck
+}
+
+func checkMetadata(tmeta *md.TorrentMetadata) error {
+	if err := tmeta.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrMetadataInvalid, err)
 	}
+	if tmeta.HasV2() {
+		for _, f := range tmeta.Files {
+			if _, ok := tmeta.PieceLayers[f.PiecesRoot]; f.Length > tmeta.PieceLength && !ok {
+				return fmt.Errorf("%w: piece layer of %s missing", ErrMetadataInvalid, displayPath(f))
+			}
+		}
+	}
+	return nil
+}
+
+// download runs the torrent until all wanted pieces are stored or ctx is canceled.
+// It reports whether all wanted pieces are downloaded.
+func (t *Torrent) download(ctx context.Context) (bool, error) {
+	if err := checkMetadata(t.metadata); err != nil {
+		return false, err
+	}
+
+	webSeeds := t.webSeeds()
+	peers, err := t.announce(ctx, tracker.EventStarted)
+	if ctx.Err() != nil {
+		return false, nil
+	}
+	// web seeds are enough to download without a tracker
+	if err != nil && len(webSeeds) == 0 {
+		return false, fmt.Errorf("%w: %w", ErrTrackerUnreachable, err)
+	}
+	defer t.announceStopped()
 
-	for piece := range pieceChan {
-		err = tdata.WritePiece(int(piece.ID), piece.Data)
+	storage, err := t.acquireStorage()
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrStorage, err)
+		t.publish(Event{Type: EventStorageError, Err: err})
+		return false, err
+	}
+	defer t.releaseStorage() //nolint:errcheck
+
+	pool := t.diskPool
+	if pool == nil {
+		pool = newDiskPool(defaultDiskWorkers, defaultWriteCacheSize, defaultReadCacheSize)
+		defer pool.Close()
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r := &run{
+		ctx:       runCtx,
+		cancel:    cancel,
+		pieceChan: make(chan *Piece, 8),
+	}
+	r.disk = newTorrentDisk(pool, storage, t.metadata.PieceLength, t.metadata.Length, func(piece *Piece, err error) {
 		if err != nil {
-			log.Fatal("Downloding error: Cant write piece")
+			t.picker.Release(piece.ID)
+			err = fmt.Errorf("%w: piece %d write error: %w", ErrStorage, piece.ID, err)
+			t.publish(Event{Type: EventStorageError, Piece: int(piece.ID), Err: err})
+			r.fail(err)
+			return
+		}
+		t.pieceWritten(piece)
+	})
+
+	t.m.Lock()
+	t.active = r
+	t.m.Unlock()
+
+	t.pool.Add(peers, SourceTracker)
+	// torrents reachable by inbound connections keep waiting for peers
+	var exhausted, noPeers, peersGone chan struct{}
+	if !t.inbound {
+		exhausted = make(chan struct{}, 1)
+		noPeers = make(chan struct{})
+		peersGone = make(chan struct{})
+	}
+	r.peers.Add(2)
+	go func() {
+		defer r.peers.Done()
+		t.connectPeers(r, exhausted)
+	}()
+	go func() {
+		defer r.peers.Done()
+		t.reannounce(r, exhausted, noPeers)
+	}()
+
+	var seeds sync.WaitGroup
+	for _, ws := range webSeeds {
+		seeds.Add(1)
+		r.peers.Add(1)
+		go func() {
+			defer r.peers.Done()
+			defer seeds.Done()
+			t.runWebSeed(r, ws)
+		}()
+	}
+	if peersGone != nil {
+		// no peers are left when the tracker has no new ones and all web seeds gave up
+		r.peers.Add(1)
+		go func() {
+			defer r.peers.Done()
+			select {
+			case <-noPeers:
+			case <-r.ctx.Done():
+				return
+			}
+			seeds.Wait()
+			close(peersGone)
+		}()
+	}
+
+	completed := t.receivePieces(r, peersGone)
+
+	t.m.Lock()
+	t.active = nil
+	t.m.Unlock()
+
+	cancel()
+	r.peers.Wait()
+
+	// keep pieces that were verified before the peers stopped
+	for {
+		select {
+		case piece := <-r.pieceChan:
+			if !t.writePiece(r, piece) {
+				break
+			}
+			continue
+		default:
 		}
-		t.downloadingInfo.PieceDownloaded(piece)
-		t.speedTracker.updateDownloadingSpeed(len(piece.Data))
+		break
+	}
+	r.disk.Flush()
+	// peers could leave right after delivering the last pieces
+	completed = completed || t.picker.Complete()
+
+	switch {
+	case r.err != nil:
+		return false, r.err
+	case ctx.Err() != nil:
+		return false, nil
+	case completed:
+		if err := storage.applyAttributes(); err != nil {
+			err = fmt.Errorf("%w: %w", ErrStorage, err)
+			t.publish(Event{Type: EventStorageError, Err: err})
+			return false, err
+		}
+		t.publish(Event{Type: EventDownloadComplete})
+		t.announce(ctx, tracker.EventCompleted) //nolint:errcheck
+		return true, nil
+	default:
+		return false, fmt.Errorf("%w: all %d known peers failed", ErrNoPeers, t.pool.Len())
+	}
+}
 
-		if t.downloadingInfo.isDone {
-			close(pieceChan)
+// receivePieces passes downloaded pieces to the disk until all wanted pieces
+// are stored, the run is stopped or no peers are left.
+func (t *Torrent) receivePieces(r *run, peersGone <-chan struct{}) bool {
+	for {
+		changed := t.picker.Changed()
+		if t.picker.Complete() {
+			return true
 		}
+
+		select {
+		case piece := <-r.pieceChan:
+			if !t.writePiece(r, piece) {
+				return false
+			}
+		case <-changed:
+		case <-r.ctx.Done():
+			return false
+		case <-peersGone:
+			return false
+		}
+	}
+}
+
+// writePiece queues the piece on the disk. It fails the run when the disk
+// pool is closed, as happens when the session closes under the run.
+func (t *Torrent) writePiece(r *run, piece *Piece) bool {
+	if err := r.disk.WritePiece(piece.ID, piece.Data); err != nil {
+		t.picker.Release(piece.ID)
+		r.fail(fmt.Errorf("%w: piece %d write error: %w", ErrStorage, piece.ID, err))
+		return false
 	}
+	return true
+}
+
+func (t *Torrent) pieceWritten(piece *Piece) {
+	t.downloadingInfo.PieceDownloaded(piece)
+	t.picker.Done(piece.ID)
+	t.broadcastHave(piece.ID)
 }
 
 type trackerRecord struct {
@@ -314,7 +1116,7 @@ func NewSpeedTracker(avgOf int) *speedTracker {
 	}
 }
 
-func (st *speedTracker) updateDownloadingSpeed(bytesDownloaded int) {
+func (st *speedTracker) update(bytesDownloaded int) {
 	st.m.Lock()
 	defer st.m.Unlock()
 
@@ -337,7 +1139,7 @@ func (st *speedTracker) updateDownloadingSpeed(bytesDownloaded int) {
 	st.speedRecordCount++
 }
 
-func (st *speedTracker) DownloadingSpeed() int {
+func (st *speedTracker) Speed() int {
 	st.m.Lock()
 	defer st.m.Unlock()
 	if len(st.history) == 0 {
@@ -359,24 +1161,84 @@ type Torrent struct {
 	downloadingInfo *downloadingInfo
 	startTime       time.Time
 	outDir          string
-	speedTracker    *speedTracker
+	transfer        *transferStats
+	picker          *piecePicker
+	diskPool        *diskPool
+	peerID          [20]byte
+	inbound         bool
+	dialer          peer.Dialer
+	events          *eventBus
+	sessionEvents   *eventBus
+	uploadLimit     *ratelimit.Limiter
+	downloadLimit   *ratelimit.Limiter
+	pool            *peerPool
+	bans            *banList
+
+	m              sync.Mutex
+	filePriorities []Priority
+	storage        *fileStorage
+	storageRefs    int
+	lastReaderID   int
+	peers          map[*peer.Peer]*peerState
+	filter         *ipfilter.Filter
+	httpClient     *http.Client
+	active         *run
+	state          State
+	cancel         context.CancelFunc
+	done           chan struct{}
+	haltState      State
+	haltCtx        context.Context
+	err            error
+
+	// per peer rates, zero means unlimited
+	peerUploadRate   int
+	peerDownloadRate int
 }
 
 func New(torrentFilePath, outDir string) (*Torrent, error) {
 	tmeta, err := md.ParseTorrentFile(torrentFilePath)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrMetadataInvalid, err)
 	}
 
 	tr := tracker.New(tmeta.Announce)
 
-	return &Torrent{
+	return newTorrent(tmeta, tr, outDir), nil
+}
+
+func newTorrent(tmeta *md.TorrentMetadata, tr tracker.TorrentTracker, outDir string) *Torrent {
+	filePriorities := make([]Priority, len(torrentFiles(tmeta)))
+
+	t := &Torrent{
 		metadata:        tmeta,
 		tracker:         tr,
 		downloadingInfo: &downloadingInfo{TorrentMetadata: tmeta},
 		outDir:          outDir,
-		speedTracker:    NewSpeedTracker(30),
-	}, nil
+		transfer:        newTransferStats(),
+		picker:          newPiecePicker(piecePriorities(tmeta, filePriorities)),
+		peerID:          PeerID,
+		dialer:          peer.Dialer{Timeout: connectTimeout},
+		filePriorities:  filePriorities,
+		peers:           map[*peer.Peer]*peerState{},
+		bans:            newBanList(defaultBanThreshold, defaultBanDuration),
+		events:          newEventBus(),
+		uploadLimit:     ratelimit.New(0, nil),
+		downloadLimit:   ratelimit.New(0, nil),
+	}
+	t.pool = newPeerPool(t.allowed)
+	t.pool.private = tmeta.Private
+	t.bans.setOnBan(t.kick)
+	return t
+}
+
+func (t *Torrent) InfoHash() [20]byte {
+	return t.metadata.InfoHash
+}
+
+// Private reports whether the torrent is private (BEP 27). Its peers only
+// come from its trackers and incoming connections.
+func (t *Torrent) Private() bool {
+	return t.metadata.Private
 }
 
 func (t *Torrent) Name() string {
@@ -387,20 +1249,245 @@ func (t *Torrent) Length() int {
 	return t.metadata.Length
 }
 
+// Start runs the download in the background. It does nothing if the torrent is already running.
 func (t *Torrent) Start() {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
 	t.startTime = time.Now()
-	go t.download()
+	t.err = nil
+	t.setState(StateDownloading)
+	t.cancel = cancel
+	t.done = done
+
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		completed, err := t.download(ctx)
+
+		t.m.Lock()
+		defer t.m.Unlock()
+		t.cancel = nil
+		t.haltCtx = nil
+		switch {
+		case err != nil:
+			t.err = err
+			t.setState(StateError)
+		case ctx.Err() != nil:
+			t.setState(t.haltState)
+		case completed:
+			t.setState(StateCompleted)
+		default:
+			t.setState(StateStopped)
+		}
+	}()
 }
 
+// setState must be called with t.m held.
+func (t *Torrent) setState(state State) {
+	if t.state == state {
+		return
+	}
+	t.state = state
+	e := Event{Type: EventStateChanged, State: state}
+	if state == StateError {
+		e.Err = t.err
+	}
+	t.publish(e)
+}
+
+// Download runs the download and waits until it is finished or stopped.
 func (t *Torrent) Download() {
-	t.startTime = time.Now()
-	t.download()
+	t.Start()
+
+	t.m.Lock()
+	done := t.done
+	t.m.Unlock()
+	<-done
+}
+
+// Pause disconnects all peers and keeps the download state so it can be resumed.
+func (t *Torrent) Pause() {
+	t.halt(context.Background(), StatePaused) //nolint:errcheck
+}
+
+// Resume continues a paused download.
+func (t *Torrent) Resume() {
+	t.m.Lock()
+	paused := t.state == StatePaused
+	t.m.Unlock()
+
+	if paused {
+		t.Start()
+	}
+}
+
+// Stop disconnects all peers, flushes the storage and sends the stopped event
+// to the tracker. It returns ctx error if that does not finish in time.
+// A stopped torrent can be started again.
+func (t *Torrent) Stop(ctx context.Context) error {
+	return t.halt(ctx, StateStopped)
+}
+
+func (t *Torrent) halt(ctx context.Context, state State) error {
+	t.m.Lock()
+	if t.cancel == nil {
+		if state == StateStopped && t.state != StateError {
+			t.setState(StateStopped)
+		}
+		t.m.Unlock()
+		return nil
+	}
+	t.haltState = state
+	t.haltCtx = ctx
+	cancel, done := t.cancel, t.done
+	t.m.Unlock()
+
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Torrent) State() State {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.state
+}
+
+// Err returns the error that stopped the torrent in StateError or nil.
+func (t *Torrent) Err() error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.err
 }
 
 func (t *Torrent) DownloadingSpeed() int {
-	return t.speedTracker.DownloadingSpeed()
+	return t.transfer.downSpeed.Speed()
 }
 
 func (t *Torrent) Downloaded() int {
 	return t.downloadingInfo.Downloaded()
 }
+
+// Files returns the torrent files with their priorities and download progress.
+func (t *Torrent) Files() []File {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	tfiles := torrentFiles(t.metadata)
+	files := make([]File, len(tfiles))
+	for i, f := range tfiles {
+		files[i] = File{
+			Path:     displayPath(f),
+			Length:   f.Length,
+			Offset:   f.Offset,
+			Priority: t.filePriorities[i],
+			Pad:      f.IsPad(),
+		}
+		if f.Length == 0 {
+			continue
+		}
+
+		first := f.Offset / t.metadata.PieceLength
+		last := (f.Offset + f.Length - 1) / t.metadata.PieceLength
+		for p := first; p <= last; p++ {
+			if !t.picker.Have(p) {
+				continue
+			}
+			begin, end := calcPieceBoundaries(uint32(p), t.metadata)
+			files[i].Downloaded += min(end, f.Offset+f.Length) - max(begin, f.Offset)
+		}
+	}
+	return files
+}
+
+// SetFilePriority changes the priority of the file with the given index.
+// It can be called before or during the download.
+func (t *Torrent) SetFilePriority(index int, prio Priority) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if index < 0 || index >= len(t.filePriorities) {
+		return fmt.Errorf("file index %d out of range", index)
+	}
+	if prio < PrioritySkip || prio > PriorityHigh {
+		return fmt.Errorf("unknown priority %d", prio)
+	}
+
+	if t.storage != nil {
+		if err := t.storage.SetPriority(index, prio); err != nil {
+			return err
+		}
+	}
+
+	t.filePriorities[index] = prio
+	t.picker.SetPriorities(piecePriorities(t.metadata, t.filePriorities))
+	return nil
+}
+
+// SetSequential enables downloading pieces strictly in order. Only lookahead
+// pieces after the first missing one are downloaded at the same time,
+// lookahead <= 0 selects the default window.
+func (t *Torrent) SetSequential(enabled bool, lookahead int) {
+	t.picker.SetSequential(enabled, lookahead)
+}
+
+// SetRateLimits limits the upload and download rate of the torrent in bytes
+// per second. Zero means unlimited. It can be changed at any time.
+func (t *Torrent) SetRateLimits(upload, download int) {
+	t.uploadLimit.SetRate(upload)
+	t.downloadLimit.SetRate(download)
+}
+
+// SetPeerRateLimits limits the rates of every connected peer in bytes per
+// second. Zero means unlimited.
+func (t *Torrent) SetPeerRateLimits(upload, download int) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.peerUploadRate = upload
+	t.peerDownloadRate = download
+	for _, ps := range t.peers {
+		ps.uploadLimit.SetRate(upload)
+		ps.downloadLimit.SetRate(download)
+	}
+}
+
+// SetConnectionLimits limits the number of peer connections and of
+// connections being established at the same time.
+func (t *Torrent) SetConnectionLimits(maxConns, maxHalfOpen int) {
+	t.pool.limits.setLimits(maxConns, maxHalfOpen)
+}
+
+// KnownPeers returns the peer pool of the torrent.
+func (t *Torrent) KnownPeers() []KnownPeer {
+	return t.pool.KnownPeers()
+}
+
+// Ban closes the connections to the IP and refuses new ones for d, zero d
+// bans permanently. Torrents of a session share the ban list.
+func (t *Torrent) Ban(ip net.IP, d time.Duration) {
+	t.bans.Ban(ip, d, time.Now())
+}
+
+func (t *Torrent) Unban(ip net.IP) {
+	t.bans.Unban(ip)
+}
+
+// SetIPFilter sets the blocklist checked before dialing and accepting peers.
+// Torrents of a session use the filter of the session config.
+func (t *Torrent) SetIPFilter(filter *ipfilter.Filter) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.filter = filter
+}
@@ -2,18 +2,29 @@ package torrent
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"net"
 	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/lksndrttm/torrent/bitfield"
+	"github.com/lksndrttm/torrent/merkle"
 	m "github.com/lksndrttm/torrent/messages"
 	md "github.com/lksndrttm/torrent/metadata"
+	"github.com/lksndrttm/torrent/mse"
 	"github.com/lksndrttm/torrent/peer"
+	"github.com/lksndrttm/torrent/proxy"
+	"github.com/lksndrttm/torrent/proxy/proxytest"
 	"github.com/lksndrttm/torrent/tracker"
+	"github.com/lksndrttm/torrent/utp"
 	"github.com/stretchr/testify/require"
 )
 
@@ -50,6 +61,18 @@ func TestPieceDownloadInfoCompleted(t *testing.T) {
 	require.True(t, piece.Completed())
 }
 
+func TestPieceDownloadInfoShortPiece(t *testing.T) {
+	t.Parallel()
+	piece := NewPieceDownloadInfo(1, BlockSize+10)
+	require.Len(t, piece.Blocks, 2)
+
+	require.NoError(t, piece.AddBlock(m.NewPieceMessage(1, 0, make([]byte, BlockSize))))
+	require.False(t, piece.Completed())
+	require.NoError(t, piece.AddBlock(m.NewPieceMessage(1, BlockSize, make([]byte, 10))))
+	require.True(t, piece.Completed())
+	require.Len(t, piece.Piece().Data, BlockSize+10)
+}
+
 func TestTorrentDataPiece(t *testing.T) {
 	t.Parallel()
 	f, err := os.CreateTemp("", "*")
@@ -191,14 +214,33 @@ func TestDownload(t *testing.T) {
 	}
 }
 
+func TestDownloadShortLastPiece(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// pieces of 3 blocks, the last one has a single short block
+	data := generateTestTorrentData(7, 1, BlockSize, BlockSize/2)
+	tmeta, err := md.GenerateTorrent(bytes.NewReader(data), "test", "test", 3*BlockSize)
+	require.NoError(err)
+
+	addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bitfield.Bitfield{255}, tmeta, data, BlockSize))
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	outDir := t.TempDir()
+	testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, outDir)
+	testTorrent.Download()
+	require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+
+	resData, err := os.ReadFile(filepath.Join(outDir, tmeta.Name))
+	require.NoError(err)
+	require.True(bytes.Equal(data, resData))
+}
+
 func newTestTorrent(tmeta *md.TorrentMetadata, tr tracker.TorrentTracker, outDir string) *Torrent {
-	return &Torrent{
-		metadata:        tmeta,
-		tracker:         tr,
-		downloadingInfo: &downloadingInfo{TorrentMetadata: tmeta},
-		outDir:          outDir,
-		speedTracker:    NewSpeedTracker(30),
-	}
+	return newTorrent(tmeta, tr, outDir)
 }
 
 func generateTestTorrent(pieceCount, blocksInPiece, blockSize, lastBlockSize int) (*md.TorrentMetadata, []byte, error) {
@@ -238,7 +280,7 @@ type mockTracker struct {
 	peers []peer.PeerAddr
 }
 
-func (mt mockTracker) RequestPeers(tmeta *md.TorrentMetadata, peerID [20]byte) ([]peer.PeerAddr, error) {
+func (mt mockTracker) Announce(ctx context.Context, tmeta *md.TorrentMetadata, peerID [20]byte, params tracker.AnnounceParams) ([]peer.PeerAddr, error) {
 	return mt.peers, nil
 }
 
@@ -249,12 +291,16 @@ func startMockTCPPeer(handlerFunc func(net.Conn)) (addr string, cleanup func(),
 	}
 
 	go func() {
-		con, err := ln.Accept()
-		if err != nil {
-			return
+		for {
+			con, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer con.Close() //nolint:errcheck
+				handlerFunc(con)
+			}()
 		}
-		defer con.Close() //nolint:errcheck
-		handlerFunc(con)
 	}()
 
 	return ln.Addr().String(), func() { ln.Close() }, nil //nolint:errcheck
@@ -290,15 +336,16 @@ func newMockPeerHandler(mockBitfield bitfield.Bitfield, tmeta *md.TorrentMetadat
 		go func() {
 			defer close(sendQueue)
 			// Receive requests
-			for range blocksInPiece * len(tmeta.PieceHashes) {
+			for received := 0; received < blocksInPiece*len(tmeta.PieceHashes); {
 				msg, err := peer.ReceiveMessage(con)
 				if err != nil {
 					return
 				}
 				rmsg, err := m.ToRequestMessage(msg)
 				if err != nil {
-					return
+					continue
 				}
+				received++
 				if !mockBitfield.HavePiece(int(rmsg.PieceID)) {
 					continue
 				}
@@ -325,3 +372,522 @@ func newMockPeerHandler(mockBitfield bitfield.Bitfield, tmeta *md.TorrentMetadat
 		}
 	}
 }
+
+type recordingTracker struct {
+	peers  []peer.PeerAddr
+	m      sync.Mutex
+	events []tracker.Event
+}
+
+func (rt *recordingTracker) Announce(ctx context.Context, tmeta *md.TorrentMetadata, peerID [20]byte, params tracker.AnnounceParams) ([]peer.PeerAddr, error) {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+	rt.events = append(rt.events, params.Event)
+	return rt.peers, nil
+}
+
+func (rt *recordingTracker) Events() []tracker.Event {
+	rt.m.Lock()
+	defer rt.m.Unlock()
+	return slices.Clone(rt.events)
+}
+
+func TestPauseResume(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, tdata, err := generateTestTorrent(3, 2, BlockSize, BlockSize)
+	require.NoError(err)
+
+	gate := make(chan struct{})
+	handler := newMockPeerHandler(bitfield.Bitfield{255}, tmeta, tdata, BlockSize)
+	addr, cleanup, err := startMockTCPPeer(func(con net.Conn) {
+		<-gate
+		handler(con)
+	})
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	tr := &recordingTracker{peers: []peer.PeerAddr{peerAddr}}
+	outDir := t.TempDir()
+	testTorrent := newTestTorrent(tmeta, tr, outDir)
+	require.Equal(StateStopped, testTorrent.State())
+
+	testTorrent.Start()
+	require.Equal(StateDownloading, testTorrent.State())
+	require.Eventually(func() bool { return len(tr.Events()) == 1 }, time.Second, time.Millisecond)
+
+	testTorrent.Pause()
+	require.Equal(StatePaused, testTorrent.State())
+	require.Equal([]tracker.Event{tracker.EventStarted, tracker.EventStopped}, tr.Events())
+
+	close(gate)
+	testTorrent.Resume()
+	require.Eventually(func() bool { return testTorrent.State() != StateDownloading }, 5*time.Second, time.Millisecond)
+	require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+
+	require.Equal([]tracker.Event{
+		tracker.EventStarted, tracker.EventStopped,
+		tracker.EventStarted, tracker.EventCompleted, tracker.EventStopped,
+	}, tr.Events())
+
+	resData, err := os.ReadFile(filepath.Join(outDir, tmeta.Name))
+	require.NoError(err)
+	require.True(bytes.Equal(resData, tdata))
+}
+
+func TestStop(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, _, err := generateTestTorrent(1, 1, BlockSize, BlockSize)
+	require.NoError(err)
+
+	gate := make(chan struct{})
+	defer close(gate)
+	addr, cleanup, err := startMockTCPPeer(func(net.Conn) { <-gate })
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	tr := &recordingTracker{peers: []peer.PeerAddr{peerAddr}}
+	testTorrent := newTestTorrent(tmeta, tr, t.TempDir())
+	testTorrent.Start()
+	require.Eventually(func() bool { return len(tr.Events()) == 1 }, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(testTorrent.Stop(ctx))
+	require.Equal(StateStopped, testTorrent.State())
+	require.Equal([]tracker.Event{tracker.EventStarted, tracker.EventStopped}, tr.Events())
+
+	testTorrent.Resume()
+	require.Equal(StateStopped, testTorrent.State(), "only paused torrents are resumed")
+}
+
+type failingTracker struct{}
+
+func (failingTracker) Announce(ctx context.Context, tmeta *md.TorrentMetadata, peerID [20]byte, params tracker.AnnounceParams) ([]peer.PeerAddr, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestDownloadErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		tracker  tracker.TorrentTracker
+		prepare  func(tmeta *md.TorrentMetadata, outDir string) string
+		expected error
+	}{
+		{
+			name:     "Tracker unreachable",
+			tracker:  failingTracker{},
+			expected: ErrTrackerUnreachable,
+		},
+		{
+			name:     "No peers",
+			tracker:  mockTracker{},
+			expected: ErrNoPeers,
+		},
+		{
+			name:    "Storage failure",
+			tracker: mockTracker{},
+			prepare: func(tmeta *md.TorrentMetadata, outDir string) string {
+				path := filepath.Join(outDir, "file")
+				os.WriteFile(path, nil, 0o644) //nolint:errcheck
+				return path
+			},
+			expected: ErrStorage,
+		},
+		{
+			name:    "Metadata invalid",
+			tracker: mockTracker{},
+			prepare: func(tmeta *md.TorrentMetadata, outDir string) string {
+				tmeta.PieceHashes = tmeta.PieceHashes[:1]
+				return outDir
+			},
+			expected: ErrMetadataInvalid,
+		},
+	}
+
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			tmeta, _, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+			require.NoError(err)
+			outDir := t.TempDir()
+			if tst.prepare != nil {
+				outDir = tst.prepare(tmeta, outDir)
+			}
+
+			testTorrent := newTestTorrent(tmeta, tst.tracker, outDir)
+			testTorrent.Download()
+
+			require.Equal(StateError, testTorrent.State())
+			require.ErrorIs(testTorrent.Err(), tst.expected)
+		})
+	}
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, tdata, err := generateTestTorrent(3, 2, BlockSize, BlockSize)
+	require.NoError(err)
+	addr, cleanup, err := startMockTCPPeer(newMockPeerHandler(bitfield.Bitfield{255}, tmeta, tdata, BlockSize))
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, t.TempDir())
+	// one second of data is allowed at once, the rest takes half a second
+	testTorrent.SetRateLimits(0, 4*BlockSize)
+
+	start := time.Now()
+	testTorrent.Download()
+	require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+	require.GreaterOrEqual(time.Since(start), 400*time.Millisecond)
+}
+
+func TestDownloadIPv6(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available")
+	}
+	defer ln.Close() //nolint:errcheck
+
+	tmeta, tdata, err := generateTestTorrent(2, 2, BlockSize, BlockSize)
+	require.NoError(err)
+	handler := newMockPeerHandler(bitfield.Bitfield{255}, tmeta, tdata, BlockSize)
+	go func() {
+		con, err := ln.Accept()
+		if err == nil {
+			handler(con)
+		}
+	}()
+
+	peerAddr, err := peer.ParsePeerAddr(ln.Addr().String())
+	require.NoError(err)
+	require.True(peerAddr.IsIPv6())
+
+	outDir := t.TempDir()
+	testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, outDir)
+	testTorrent.Download()
+	require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+
+	resData, err := os.ReadFile(filepath.Join(outDir, tmeta.Name))
+	require.NoError(err)
+	require.Equal(tdata, resData)
+}
+
+func TestDownloadEncryptionFallback(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, tdata, err := generateTestTorrent(2, 1, BlockSize, BlockSize)
+	require.NoError(err)
+	handler := newMockPeerHandler(bitfield.Bitfield{255}, tmeta, tdata, BlockSize)
+	var attempts atomic.Int32
+	addr, cleanup, err := startMockTCPPeer(func(con net.Conn) {
+		attempts.Add(1)
+		handler(con)
+	})
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	// the plaintext peer drops the encrypted handshake, the retry is plaintext
+	testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, t.TempDir())
+	testTorrent.dialer.Encryption = mse.Prefer
+	testTorrent.Download()
+	require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+	require.Equal(int32(2), attempts.Load())
+}
+
+func TestDownloadUTP(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	seeder, err := utp.Listen("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer seeder.Close() //nolint:errcheck
+
+	tmeta, tdata, err := generateTestTorrent(3, 2, BlockSize, BlockSize/2)
+	require.NoError(err)
+	handler := newMockPeerHandler(bitfield.Bitfield{255}, tmeta, tdata, BlockSize)
+	go func() {
+		con, err := seeder.Accept()
+		if err == nil {
+			handler(con)
+		}
+	}()
+
+	peerAddr, err := peer.ParsePeerAddr(seeder.Addr().String())
+	require.NoError(err)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	client := utp.NewSocket(pc, false)
+	defer client.Close() //nolint:errcheck
+
+	outDir := t.TempDir()
+	testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, outDir)
+	testTorrent.dialer.Transport = peer.TransportUTP
+	testTorrent.dialer.UTP = client
+	testTorrent.Download()
+	require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+
+	resData, err := os.ReadFile(filepath.Join(outDir, tmeta.Name))
+	require.NoError(err)
+	require.Equal(tdata, resData)
+}
+
+func TestDownloadProxy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		useUTP bool
+	}{
+		{name: "tcp"},
+		{name: "utp over udp associate", useUTP: true},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			server, err := proxytest.NewSOCKS5("user", "pass")
+			require.NoError(err)
+			defer server.Close() //nolint:errcheck
+			d := &proxy.Dialer{Type: proxy.SOCKS5, Addr: server.Addr(), Username: "user", Password: "pass"}
+
+			tmeta, tdata, err := generateTestTorrent(3, 2, BlockSize, BlockSize/2)
+			require.NoError(err)
+			handler := newMockPeerHandler(bitfield.Bitfield{255}, tmeta, tdata, BlockSize)
+
+			var addr string
+			if tst.useUTP {
+				seeder, err := utp.Listen("udp", "127.0.0.1:0")
+				require.NoError(err)
+				defer seeder.Close() //nolint:errcheck
+				go func() {
+					con, err := seeder.Accept()
+					if err == nil {
+						handler(con)
+					}
+				}()
+				addr = seeder.Addr().String()
+			} else {
+				var cleanup func()
+				addr, cleanup, err = startMockTCPPeer(handler)
+				require.NoError(err)
+				defer cleanup()
+			}
+			peerAddr, err := peer.ParsePeerAddr(addr)
+			require.NoError(err)
+
+			outDir := t.TempDir()
+			testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, outDir)
+			testTorrent.dialer.Proxy = d
+			if tst.useUTP {
+				pc, err := d.ListenPacket(context.Background())
+				require.NoError(err)
+				client := utp.NewSocket(pc, false)
+				defer client.Close() //nolint:errcheck
+				testTorrent.dialer.Transport = peer.TransportUTP
+				testTorrent.dialer.UTP = client
+			}
+			testTorrent.Download()
+			require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+
+			resData, err := os.ReadFile(filepath.Join(outDir, tmeta.Name))
+			require.NoError(err)
+			require.Equal(tdata, resData)
+			require.EqualValues(1, server.Requests.Load())
+		})
+	}
+}
+
+// generateV2Torrent builds a pure v2 torrent of the files. The returned
+// stream holds the files at piece aligned offsets.
+func generateV2Torrent(pieceLength int, files ...[]byte) (*md.TorrentMetadata, []byte) {
+	tmeta := &md.TorrentMetadata{Name: "v2", PieceLength: pieceLength, PieceLayers: map[[32]byte][][32]byte{}}
+	blocksPerPiece := pieceLength / BlockSize
+	stream := []byte{}
+	for i, data := range files {
+		stream = append(stream, make([]byte, (len(stream)+pieceLength-1)/pieceLength*pieceLength-len(stream))...)
+		f := md.FileInfo{Path: []string{"v2", strconv.Itoa(i)}, Length: len(data), Offset: len(stream)}
+		if len(data) <= pieceLength {
+			f.PiecesRoot = merkle.Root(merkle.BlockHashes(data), merkle.Width((len(data)+BlockSize-1)/BlockSize), [32]byte{})
+		} else {
+			var layer [][32]byte
+			for b := 0; b < len(data); b += pieceLength {
+				layer = append(layer, merkle.Root(merkle.BlockHashes(data[b:min(b+pieceLength, len(data))]), blocksPerPiece, [32]byte{}))
+			}
+			f.PiecesRoot = merkle.Root(layer, merkle.Width(len(layer)), merkle.PadHash(merkle.Height(blocksPerPiece)))
+			tmeta.PieceLayers[f.PiecesRoot] = layer
+		}
+		stream = append(stream, data...)
+		tmeta.Files = append(tmeta.Files, f)
+	}
+	tmeta.Length = len(stream)
+	tmeta.InfoHashV2 = sha256.Sum256(stream)
+	tmeta.InfoHash = [20]byte(tmeta.InfoHashV2[:20])
+	return tmeta, stream
+}
+
+// newV2MockPeerHandler serves blocks and block hashes of the stream. Hash
+// requests are rejected without hashes, block corrupt is sent damaged.
+func newV2MockPeerHandler(tmeta *md.TorrentMetadata, stream []byte, hashes bool, corrupt int, hashRequests *atomic.Int32) func(net.Conn) {
+	return func(con net.Conn) {
+		con.SetDeadline(time.Now().Add(time.Second * 5)) //nolint:errcheck
+		h, err := m.ReadHandshake(con)
+		if err != nil {
+			return
+		}
+		if _, err = con.Write(h.Serialize()); err != nil {
+			return
+		}
+		bf := bitfield.New(tmeta.PieceCount())
+		for i := range tmeta.PieceCount() {
+			bf.SetPiece(i)
+		}
+		if peer.SendMessage(con, m.NewBitfieldMessage(bf).ToMessage()) != nil || peer.SendMessage(con, m.UnchokeMessage()) != nil {
+			return
+		}
+
+		for {
+			msg, err := peer.ReceiveMessage(con)
+			if err != nil {
+				return
+			}
+			var reply *m.Message
+			if rMsg, err := m.ToRequestMessage(msg); err == nil {
+				begin := int(rMsg.PieceID)*tmeta.PieceLength + int(rMsg.BlockOffset)
+				block := bytes.Clone(stream[begin : begin+int(rMsg.BlockLength)])
+				if begin == corrupt {
+					block[0] ^= 1
+				}
+				reply = m.NewPieceMessage(rMsg.PieceID, rMsg.BlockOffset, block).ToMessage()
+			}
+			if req, err := m.ToHashRequestMessage(msg); err == nil {
+				hashRequests.Add(1)
+				reply = req.ToRejectMessage()
+				i := slices.IndexFunc(tmeta.Files, func(f md.FileInfo) bool { return f.PiecesRoot == req.PiecesRoot })
+				if hashes && i >= 0 {
+					f := tmeta.Files[i]
+					leaves := merkle.BlockHashes(stream[f.Offset : f.Offset+f.Length])
+					layer := merkle.Layers(leaves, merkle.Width(len(leaves)+int(req.Length)), [32]byte{})[0]
+					reply = (&m.HashesMessage{HashRequestMessage: *req, Hashes: layer[req.Index : req.Index+req.Length]}).ToMessage()
+				}
+			}
+			if reply != nil && peer.SendMessage(con, reply) != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestDownloadV2(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		hashes bool
+	}{
+		{name: "block hashes", hashes: true},
+		{name: "hash reject", hashes: false},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			a := generateTestTorrentData(5, 1, BlockSize, BlockSize/3)
+			b := generateTestTorrentData(2, 1, BlockSize, 100)
+			tmeta, stream := generateV2Torrent(2*BlockSize, a, b)
+			require.Equal(4, tmeta.PieceCount())
+
+			var hashRequests atomic.Int32
+			addr, cleanup, err := startMockTCPPeer(newV2MockPeerHandler(tmeta, stream, tst.hashes, -1, &hashRequests))
+			defer cleanup()
+			require.NoError(err)
+			peerAddr, err := peer.ParsePeerAddr(addr)
+			require.NoError(err)
+
+			outDir := t.TempDir()
+			testTorrent := newTestTorrent(tmeta, mockTracker{peers: []peer.PeerAddr{peerAddr}}, outDir)
+			testTorrent.Download()
+			require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+
+			for i, data := range [][]byte{a, b} {
+				content, err := os.ReadFile(filepath.Join(outDir, "v2", strconv.Itoa(i)))
+				require.NoError(err)
+				require.Equal(data, content)
+			}
+			// every piece spans two leaves, padding included
+			require.EqualValues(4, hashRequests.Load())
+		})
+	}
+}
+
+func TestDownloadPieceV2BadBlock(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, stream := generateV2Torrent(4*BlockSize, generateTestTorrentData(8, 1, BlockSize, BlockSize))
+	var hashRequests atomic.Int32
+	serve := newV2MockPeerHandler(tmeta, stream, true, 0, &hashRequests)
+	addr, cleanup, err := startMockTCPPeer(serve)
+	defer cleanup()
+	require.NoError(err)
+	peerAddr, err := peer.ParsePeerAddr(addr)
+	require.NoError(err)
+
+	p, err := peer.Connect(peerAddr, tmeta, time.Second, [20]byte{})
+	require.NoError(err)
+	defer p.Close()
+	require.True(p.SupportsV2)
+	p.Choking = false
+
+	_, err = downloadPiece(0, p, newPeerState(newTransferStats(), false), tmeta, func(*m.Message) error { return nil })
+	require.ErrorIs(err, errHashFailed)
+	require.ErrorContains(err, "block at 0")
+}
+
+func TestServePieceLayerHashes(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, _ := generateV2Torrent(2*BlockSize, generateTestTorrentData(7, 1, BlockSize, BlockSize))
+	testTorrent := newTestTorrent(tmeta, mockTracker{}, t.TempDir())
+	f := tmeta.Files[0]
+	layer := tmeta.PieceLayers[f.PiecesRoot]
+
+	// two piece hashes with the uncle of their subtree
+	hashes, proof, ok := testTorrent.hashes(&m.HashRequestMessage{PiecesRoot: f.PiecesRoot, BaseLayer: 1, Index: 2, Length: 2, ProofLayers: 5})
+	require.True(ok)
+	require.Equal(layer[2:4], hashes)
+	require.Len(proof, 1)
+	subtree := merkle.Root(hashes, 2, merkle.PadHash(1))
+	require.True(merkle.VerifyProof(f.PiecesRoot, subtree, 1, proof))
+
+	_, _, ok = testTorrent.hashes(&m.HashRequestMessage{PiecesRoot: f.PiecesRoot, BaseLayer: 1, Index: 1, Length: 2})
+	require.False(ok, "unaligned index")
+	_, _, ok = testTorrent.hashes(&m.HashRequestMessage{PiecesRoot: f.PiecesRoot, BaseLayer: 0, Index: 0, Length: 2})
+	require.False(ok, "pieces we do not have")
+	_, _, ok = testTorrent.hashes(&m.HashRequestMessage{PiecesRoot: [32]byte{1}, BaseLayer: 1, Index: 0, Length: 2})
+	require.False(ok, "unknown file")
+}
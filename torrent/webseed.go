@@ -0,0 +1,200 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lksndrttm/torrent/bitfield"
+	md "github.com/lksndrttm/torrent/metadata"
+	"github.com/lksndrttm/torrent/ratelimit"
+)
+
+const (
+	webSeedBackoff     = time.Second
+	maxWebSeedBackoff  = time.Minute
+	maxWebSeedFailures = 5
+)
+
+var errWebSeed = errors.New("web seed error")
+
+// webSeed downloads pieces from an HTTP server holding the torrent files
+// (BEP 19). It has all pieces and takes part in piece picking like a peer.
+type webSeed struct {
+	url    string
+	client *http.Client
+	tmeta  *md.TorrentMetadata
+	ps     *peerState
+}
+
+// fileURL returns the URL of a torrent file. A multi-file torrent, or a
+// single file URL ending with a slash, is a directory holding the files.
+func (ws *webSeed) fileURL(f md.FileInfo) string {
+	if len(f.Path) == 1 && !strings.HasSuffix(ws.url, "/") {
+		return ws.url
+	}
+	parts := make([]string, len(f.Path))
+	for i, p := range f.Path {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.TrimSuffix(ws.url, "/") + "/" + strings.Join(parts, "/")
+}
+
+// fetchPiece downloads the piece with Range requests to all files it spans.
+func (ws *webSeed) fetchPiece(ctx context.Context, pieceID uint32) ([]byte, error) {
+	begin, end := calcPieceBoundaries(pieceID, ws.tmeta)
+	data := make([]byte, 0, end-begin)
+	for _, f := range torrentFiles(ws.tmeta) {
+		from, to := max(begin, f.Offset), min(end, f.Offset+f.Length)
+		if from >= to || !stored(f) {
+			continue
+		}
+		// pad files and gaps before piece aligned v2 files are zeros
+		data = append(data, make([]byte, from-begin-len(data))...)
+		var err error
+		data, err = ws.fetchRange(ctx, f, from-f.Offset, to-f.Offset, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(data, make([]byte, end-begin-len(data))...), nil
+}
+
+// fetchRange appends the bytes [from, to) of the file to data.
+func (ws *webSeed) fetchRange(ctx context.Context, f md.FileInfo, from, to int, data []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ws.fileURL(f), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errWebSeed, err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to-1))
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errWebSeed, err)
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	body := io.Reader(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK:
+		// the server ignored the range and sends the whole file
+		if _, err := io.CopyN(io.Discard, body, int64(from)); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", errWebSeed, req.URL, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s: %s", errWebSeed, req.URL, resp.Status)
+	}
+
+	for n := to - from; n > 0; {
+		chunk := min(n, BlockSize)
+		if err := ws.ps.downloadLimit.WaitN(ctx, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, make([]byte, chunk)...)
+		if _, err := io.ReadFull(body, data[len(data)-chunk:]); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", errWebSeed, req.URL, err)
+		}
+		ws.ps.blockReceived(chunk)
+		n -= chunk
+	}
+	return data, nil
+}
+
+// webSeedRetry returns the backoff after failures errors in a row. It
+// reports false when the web seed is given up.
+func webSeedRetry(failures int) (time.Duration, bool) {
+	if failures >= maxWebSeedFailures {
+		return 0, false
+	}
+	return min(webSeedBackoff<<(failures-1), maxWebSeedBackoff), true
+}
+
+// webSeeds returns the web seeds of the torrent.
+func (t *Torrent) webSeeds() []*webSeed {
+	t.m.Lock()
+	defer t.m.Unlock()
+	client := t.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	seeds := make([]*webSeed, 0, len(t.metadata.URLList))
+	for _, u := range t.metadata.URLList {
+		ps := newPeerState(t.transfer, false)
+		ps.downloadLimit = ratelimit.New(t.peerDownloadRate, t.downloadLimit)
+		seeds = append(seeds, &webSeed{url: u, client: client, tmeta: t.metadata, ps: ps})
+	}
+	return seeds
+}
+
+// runWebSeed downloads pieces from the web seed until the torrent is
+// complete, the run is stopped or the web seed is given up.
+func (t *Torrent) runWebSeed(r *run, ws *webSeed) {
+	have := bitfield.New(t.metadata.PieceCount())
+	for i := range t.metadata.PieceCount() {
+		have.SetPiece(i)
+	}
+	t.picker.AddPeer(have)
+	defer t.picker.RemovePeer(have)
+
+	failures := 0
+	for r.ctx.Err() == nil {
+		changed := t.picker.Changed()
+		pieceID, ok := t.picker.Pick(have)
+		if !ok {
+			if t.picker.Complete() {
+				return
+			}
+			select {
+			case <-changed:
+			case <-r.ctx.Done():
+			}
+			continue
+		}
+
+		var piece *Piece
+		data, err := ws.fetchPiece(r.ctx, pieceID)
+		if err == nil {
+			piece = &Piece{ID: pieceID, Data: data}
+			if !t.metadata.VerifyPiece(int(pieceID), data) {
+				err = fmt.Errorf("piece %d failed integrity check: %w", pieceID, errHashFailed)
+				t.publish(Event{Type: EventPieceHashFailed, Piece: int(pieceID), WebSeed: ws.url})
+			}
+		}
+		ws.ps.pieceFinished(err == nil)
+		if err != nil {
+			t.picker.Release(pieceID)
+			if r.ctx.Err() != nil {
+				return
+			}
+			t.publish(Event{Type: EventWebSeedError, WebSeed: ws.url, Err: err})
+			failures++
+			wait, ok := webSeedRetry(failures)
+			if !ok {
+				return
+			}
+			backoff := time.NewTimer(wait)
+			select {
+			case <-backoff.C:
+			case <-r.ctx.Done():
+				backoff.Stop()
+				return
+			}
+			continue
+		}
+		failures = 0
+		t.publish(Event{Type: EventPieceVerified, Piece: int(pieceID), WebSeed: ws.url})
+
+		select {
+		case r.pieceChan <- piece:
+		case <-r.ctx.Done():
+			t.picker.Release(pieceID)
+			return
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package torrent
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	md "github.com/lksndrttm/torrent/metadata"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSeedFileURL(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		url  string
+		path []string
+		want string
+	}{
+		{name: "single file", url: "http://host/files/test.iso", path: []string{"test.iso"}, want: "http://host/files/test.iso"},
+		{name: "single file directory", url: "http://host/files/", path: []string{"test.iso"}, want: "http://host/files/test.iso"},
+		{name: "multi file", url: "http://host/files", path: []string{"multi", "dir", "a b"}, want: "http://host/files/multi/dir/a%20b"},
+	}
+	for _, tst := range tests {
+		t.Run(tst.name, func(t *testing.T) {
+			t.Parallel()
+			ws := &webSeed{url: tst.url}
+			require.Equal(t, tst.want, ws.fileURL(md.FileInfo{Path: tst.path}))
+		})
+	}
+}
+
+// serveFiles serves the torrent files under their paths with Range support.
+func serveFiles(tmeta *md.TorrentMetadata, data []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, f := range torrentFiles(tmeta) {
+			if r.URL.Path == "/"+strings.Join(f.Path, "/") {
+				content := bytes.NewReader(data[f.Offset : f.Offset+f.Length])
+				http.ServeContent(w, r, f.Path[len(f.Path)-1], time.Time{}, content)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+}
+
+func TestDownloadWebSeed(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// pieces span file boundaries
+	data := generateTestTorrentData(4, 2, BlockSize, BlockSize)
+	tmeta := multiFileTestMetadata(data, 2*BlockSize, BlockSize/2, 3*BlockSize, len(data)-BlockSize/2-3*BlockSize)
+	server := httptest.NewServer(serveFiles(tmeta, data))
+	defer server.Close()
+	tmeta.URLList = []string{server.URL + "/"}
+
+	outDir := t.TempDir()
+	testTorrent := newTestTorrent(tmeta, failingTracker{}, outDir)
+	testTorrent.Download()
+	require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+	require.Equal(len(data), testTorrent.Stats().Downloaded)
+
+	for _, f := range tmeta.Files {
+		content, err := os.ReadFile(filepath.Join(append([]string{outDir}, f.Path...)...))
+		require.NoError(err)
+		require.Equal(data[f.Offset:f.Offset+f.Length], content)
+	}
+}
+
+func TestDownloadWebSeedBackoff(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tmeta, data, err := generateTestTorrent(2, 2, BlockSize, BlockSize)
+	require.NoError(err)
+	files := serveFiles(tmeta, data)
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	tmeta.URLList = []string{server.URL + "/" + tmeta.Name}
+
+	outDir := t.TempDir()
+	testTorrent := newTestTorrent(tmeta, mockTracker{}, outDir)
+	events, unsubscribe := testTorrent.Subscribe()
+	defer unsubscribe()
+	testTorrent.Download()
+	require.Equal(StateCompleted, testTorrent.State(), testTorrent.Err())
+
+	resData, err := os.ReadFile(filepath.Join(outDir, tmeta.Name))
+	require.NoError(err)
+	require.Equal(data, resData)
+	require.EqualValues(3, requests.Load())
+
+	for e := range events {
+		if e.Type == EventWebSeedError {
+			require.Equal(tmeta.URLList[0], e.WebSeed)
+			require.ErrorContains(e.Err, "503")
+			return
+		}
+	}
+}
+
+func TestWebSeedRetry(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	for failures := 1; failures < maxWebSeedFailures; failures++ {
+		wait, ok := webSeedRetry(failures)
+		require.True(ok)
+		require.Equal(webSeedBackoff<<(failures-1), wait)
+	}
+	_, ok := webSeedRetry(maxWebSeedFailures)
+	require.False(ok, "the web seed is given up")
+}
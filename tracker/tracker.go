@@ -1,12 +1,16 @@
 package tracker
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
+	"fmt"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/lksndrttm/bencode"
 	"github.com/lksndrttm/torrent/metadata"
@@ -14,46 +18,116 @@ import (
 )
 
 type trackerResponse struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	Interval  int    `bencode:"interval"`
+	Peers     string `bencode:"peers"`
+	Peers6    string `bencode:"peers6"`
+	TrackerID string `bencode:"tracker id"`
 }
 
+// parsePeers returns the IPv6 peers first, so they are preferred when a peer has both.
 func (tr *trackerResponse) parsePeers() ([]peer.PeerAddr, error) {
-	peersBin := []byte(tr.Peers)
-	peerSize := 6
-	if len(peersBin)%peerSize != 0 {
+	peers6, err := peer.ParseCompactPeers([]byte(tr.Peers6), peer.CompactIPv6Len)
+	if err != nil {
+		return []peer.PeerAddr{}, errors.New("malformed peers6")
+	}
+	peers, err := peer.ParseCompactPeers([]byte(tr.Peers), peer.CompactIPv4Len)
+	if err != nil {
 		return []peer.PeerAddr{}, errors.New("malformed peers")
 	}
+	return append(peers6, peers...), nil
+}
 
-	numPeers := len(peersBin) / peerSize
-	peers := make([]peer.PeerAddr, numPeers)
+// minInterval bounds the interval a tracker may ask for, so a misbehaving
+// tracker can not make us announce in a tight loop.
+const minInterval = time.Minute
 
-	for i := range numPeers {
-		offset := i * peerSize
-		peers[i].IP = net.IP(peersBin[offset : offset+4])
-		peers[i].Port = binary.BigEndian.Uint16([]byte(peersBin[offset+4 : offset+6]))
-	}
-	return peers, nil
+type Event string
+
+const (
+	EventNone      Event = ""
+	EventStarted   Event = "started"
+	EventStopped   Event = "stopped"
+	EventCompleted Event = "completed"
+)
+
+// AnnounceParams describe the torrent state reported to the tracker.
+type AnnounceParams struct {
+	Event      Event
+	Uploaded   int
+	Downloaded int
+	Left       int
 }
 
 type TorrentTracker interface {
-	RequestPeers(tmeta *metadata.TorrentMetadata, peerID [20]byte) ([]peer.PeerAddr, error)
+	Announce(ctx context.Context, tmeta *metadata.TorrentMetadata, peerID [20]byte, params AnnounceParams) ([]peer.PeerAddr, error)
 }
 
 type Tracker struct {
 	URL string
+	// Port is where peers reach us. Zero announces that nothing listens,
+	// the tracker then hands out peers but does not list us.
+	Port uint16
+	// IPv6 is announced as the ipv6 parameter, so a tracker contacted over
+	// IPv4 can hand out our IPv6 address too.
+	IPv6 net.IP
+	// Client sends the announces, nil means http.DefaultClient.
+	Client *http.Client
+	// Key identifies us across IP changes, private trackers rely on it. It
+	// is sent when not zero.
+	Key uint32
+
+	m sync.Mutex
+	// trackerID is the tracker id of the last response, it is sent back on
+	// the following announces
+	trackerID string
+	interval  time.Duration
 }
 
 func New(URL string) *Tracker {
-	return &Tracker{URL: URL}
+	return &Tracker{URL: URL, Key: rand.Uint32()}
+}
+
+// sessionValues returns the key and tracker id parameters.
+func (t *Tracker) sessionValues() url.Values {
+	values := url.Values{}
+	if t.Key != 0 {
+		values.Set("key", fmt.Sprintf("%08x", t.Key))
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.trackerID != "" {
+		values.Set("trackerid", t.trackerID)
+	}
+	return values
 }
 
+// Interval returns how long the tracker wants us to wait between announces,
+// zero before the first response with an interval.
+func (t *Tracker) Interval() time.Duration {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.interval
+}
+
+// RequestPeers announces that nothing is downloaded yet and returns the peers from the tracker response.
 func (t *Tracker) RequestPeers(tmeta *metadata.TorrentMetadata, peerID [20]byte) ([]peer.PeerAddr, error) {
-	requestURL, err := buildTrackerURL(tmeta, peerID, 6881)
+	return t.Announce(context.Background(), tmeta, peerID, AnnounceParams{Left: tmeta.Length})
+}
+
+func (t *Tracker) Announce(ctx context.Context, tmeta *metadata.TorrentMetadata, peerID [20]byte, params AnnounceParams) ([]peer.PeerAddr, error) {
+	requestURL, err := buildTrackerURL(tmeta, peerID, t.Port, t.IPv6, params, t.sessionValues())
 	if err != nil {
 		return []peer.PeerAddr{}, err
 	}
-	resp, err := http.Get(requestURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return []peer.PeerAddr{}, err
+	}
+	client := t.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return []peer.PeerAddr{}, err
 	}
@@ -65,25 +139,44 @@ func (t *Tracker) RequestPeers(tmeta *metadata.TorrentMetadata, peerID [20]byte)
 		return []peer.PeerAddr{}, err
 	}
 
+	t.m.Lock()
+	if trackerResp.TrackerID != "" {
+		t.trackerID = trackerResp.TrackerID
+	}
+	if trackerResp.Interval > 0 {
+		t.interval = max(time.Duration(trackerResp.Interval)*time.Second, minInterval)
+	}
+	t.m.Unlock()
+
 	peers, err := trackerResp.parsePeers()
 
 	return peers, err
 }
 
-func buildTrackerURL(t *metadata.TorrentMetadata, peerID [20]byte, port uint16) (string, error) {
+// buildTrackerURL adds the announce parameters and extra to the query of the
+// announce URL, which often holds the passkey of a private tracker.
+func buildTrackerURL(t *metadata.TorrentMetadata, peerID [20]byte, port uint16, ipv6 net.IP, params AnnounceParams, extra url.Values) (string, error) {
 	base, err := url.Parse(t.Announce)
 	if err != nil {
 		return "", err
 	}
-	params := url.Values{
-		"info_hash":  []string{string(t.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.Length)},
+	values := base.Query()
+	for k, v := range extra {
+		values[k] = v
+	}
+	values.Set("info_hash", string(t.InfoHash[:]))
+	values.Set("peer_id", string(peerID[:]))
+	values.Set("port", strconv.Itoa(int(port)))
+	values.Set("uploaded", strconv.Itoa(params.Uploaded))
+	values.Set("downloaded", strconv.Itoa(params.Downloaded))
+	values.Set("compact", "1")
+	values.Set("left", strconv.Itoa(params.Left))
+	if params.Event != EventNone {
+		values.Set("event", string(params.Event))
+	}
+	if ipv6.To4() == nil && ipv6.To16() != nil {
+		values.Set("ipv6", ipv6.String())
 	}
-	base.RawQuery = params.Encode()
+	base.RawQuery = values.Encode()
 	return base.String(), nil
 }
@@ -1,12 +1,16 @@
 package tracker
 
 import (
+	"context"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/lksndrttm/torrent/metadata"
 
@@ -65,11 +69,13 @@ func TestTrackerRequestPeers(t *testing.T) {
 	expectedIP2 := net.IP{0, 0, 0, 1}
 
 	tracker := New(server.URL)
+	require.Zero(tracker.Interval())
 
 	var peerID [20]byte
 	peers, err := tracker.RequestPeers(tMeta, peerID)
 	require.NoError(err)
 	require.Equal(len(peers), 2, "expected number of peers: 2")
+	require.Equal(900*time.Second, tracker.Interval())
 
 	if !peers[0].IP.Equal(expectedIP1) || peers[0].Port != expectedPort1 {
 		t.Fatalf("%v:%d != %v:%d", peers[0].IP, peers[0].Port, expectedIP1, expectedPort1)
@@ -79,3 +85,104 @@ func TestTrackerRequestPeers(t *testing.T) {
 		t.Fatalf("%v:%d != %v:%d", peers[1].IP, peers[1].Port, expectedIP2, expectedPort2)
 	}
 }
+
+func TestBuildTrackerURLParams(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tMeta, err := metadata.GenerateTorrent(strings.NewReader("1111"), "http://tracker/announce", "test", 4)
+	require.NoError(err)
+
+	params := AnnounceParams{Event: EventStopped, Uploaded: 1, Downloaded: 2, Left: 3}
+	rawURL, err := buildTrackerURL(tMeta, [20]byte{}, 6881, nil, params, nil)
+	require.NoError(err)
+
+	u, err := url.Parse(rawURL)
+	require.NoError(err)
+	values := u.Query()
+	require.Equal("stopped", values.Get("event"))
+	require.Equal("1", values.Get("uploaded"))
+	require.Equal("2", values.Get("downloaded"))
+	require.Equal("3", values.Get("left"))
+
+	rawURL, err = buildTrackerURL(tMeta, [20]byte{}, 6881, net.ParseIP("2001:db8::1"), AnnounceParams{}, nil)
+	require.NoError(err)
+	require.NotContains(rawURL, "event=")
+
+	u, err = url.Parse(rawURL)
+	require.NoError(err)
+	require.Equal("2001:db8::1", u.Query().Get("ipv6"))
+}
+
+func TestTrackerSessionValues(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tMeta, err := metadata.GenerateTorrent(strings.NewReader("1111"), "", "test", 4)
+	require.NoError(err)
+
+	var queries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		w.Write([]byte("d8:intervali900e5:peers0:10:tracker id3:abce")) //nolint:errcheck
+	}))
+	defer server.Close()
+	// private trackers put the passkey into the announce URL
+	tMeta.Announce = server.URL + "/announce?passkey=secret"
+
+	tracker := New(tMeta.Announce)
+	for range 2 {
+		_, err := tracker.Announce(context.Background(), tMeta, [20]byte{}, AnnounceParams{})
+		require.NoError(err)
+	}
+
+	require.Len(queries, 2)
+	for _, q := range queries {
+		require.Equal("secret", q.Get("passkey"))
+		require.Equal(fmt.Sprintf("%08x", tracker.Key), q.Get("key"))
+		// nothing listens without a port
+		require.Equal("0", q.Get("port"))
+	}
+	require.Empty(queries[0].Get("trackerid"))
+	require.Equal("abc", queries[1].Get("trackerid"))
+}
+
+func TestTrackerMinInterval(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	tMeta, err := metadata.GenerateTorrent(strings.NewReader("1111"), "test", "test", 4)
+	require.NoError(err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1e5:peers0:e")) //nolint:errcheck
+	}))
+	defer server.Close()
+	tMeta.Announce = server.URL
+
+	tracker := New(tMeta.Announce)
+	_, err = tracker.Announce(context.Background(), tMeta, [20]byte{}, AnnounceParams{})
+	require.NoError(err)
+	require.Equal(minInterval, tracker.Interval())
+}
+
+func TestTrackerResponsePeers6(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	ip6 := net.ParseIP("2001:db8::1")
+	resp := trackerResponse{
+		Peers:  string([]byte{10, 0, 0, 1, 0x1a, 0xe1}),
+		Peers6: string(append([]byte(ip6), 0x1a, 0xe2)),
+	}
+	peers, err := resp.parsePeers()
+	require.NoError(err)
+	require.Len(peers, 2)
+	require.True(peers[0].IP.Equal(ip6))
+	require.Equal(uint16(6882), peers[0].Port)
+	require.Equal("[2001:db8::1]:6882", peers[0].String())
+	require.Equal("10.0.0.1:6881", peers[1].String())
+
+	resp.Peers6 = resp.Peers6[1:]
+	_, err = resp.parsePeers()
+	require.Error(err)
+}
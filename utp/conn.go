@@ -0,0 +1,478 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// mss is the payload size of data packets, small enough to avoid IP fragmentation
+	mss         = 1200
+	recvWindow  = 1 << 20
+	initialCwnd = 4 * mss
+	minCwnd     = mss
+	maxCwnd     = 1 << 22
+	// LEDBAT keeps the queuing delay it adds around targetDelay and grows
+	// the window by at most maxCwndIncrease bytes per round trip
+	targetDelay     = 100 * time.Millisecond
+	maxCwndIncrease = 3000
+	baseDelayWindow = 2 * time.Minute
+
+	initialRTO     = time.Second
+	minRTO         = 500 * time.Millisecond
+	maxRTO         = 8 * time.Second
+	maxRetransmits = 6
+	lingerTimeout  = 10 * time.Second
+	// out of order packets further ahead are dropped
+	maxReorder = 1024
+)
+
+var (
+	ErrReset   = errors.New("utp: connection reset")
+	ErrTimeout = errors.New("utp: connection timed out")
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+)
+
+type outPacket struct {
+	typ           int
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	sacked        bool
+}
+
+type inPacket struct {
+	payload []byte
+	fin     bool
+}
+
+// Conn is a uTP connection. It implements net.Conn.
+type Conn struct {
+	s      *Socket
+	remote net.Addr
+	recvID uint16
+	sendID uint16
+
+	m       sync.Mutex
+	changed chan struct{}
+	state   connState
+	err     error
+	closed  bool
+	linger  time.Time
+
+	// sending side
+	seqNr    uint16
+	outbuf   []*outPacket
+	inflight int
+	cwnd     float64
+	peerWnd  int
+	lastAck  uint16
+	dupAcks  int
+	rtt      time.Duration
+	rttVar   time.Duration
+	rto      time.Duration
+	// baseDelay is the lowest one-way delay seen, the rest of a delay is queuing
+	baseDelay      uint32
+	baseDelayReset time.Time
+
+	// receiving side
+	ackNr      uint16
+	reorder    map[uint16]inPacket
+	readBuf    []byte
+	eof        bool
+	replyMicro uint32
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, remote net.Addr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		s:       s,
+		remote:  remote,
+		recvID:  recvID,
+		sendID:  sendID,
+		changed: make(chan struct{}),
+		cwnd:    initialCwnd,
+		peerWnd: recvWindow,
+		rto:     initialRTO,
+		reorder: map[uint16]inPacket{},
+	}
+}
+
+// notify wakes up waiting readers and writers, it must be called with c.m held.
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait releases c.m until the connection changes or the deadline passes.
+func (c *Conn) wait(deadline time.Time, done <-chan struct{}) error {
+	changed := c.changed
+	c.m.Unlock()
+	defer c.m.Lock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-done:
+		return nil
+	}
+}
+
+// sendPacket must be called with c.m held.
+func (c *Conn) sendPacket(typ int, seq uint16, payload []byte) {
+	h := header{
+		typ:    typ,
+		connID: c.sendID,
+		ts:     nowMicro(),
+		tsDiff: c.replyMicro,
+		wnd:    uint32(max(recvWindow-len(c.readBuf), 0)),
+		seq:    seq,
+		ack:    c.ackNr,
+		sack:   c.sackMask(),
+	}
+	if typ == stSyn {
+		h.connID = c.recvID
+	}
+	c.s.send(h.marshal(payload), c.remote)
+}
+
+func (c *Conn) sendAck() {
+	c.sendPacket(stState, c.seqNr, nil)
+}
+
+// queue sends a packet that has to be acknowledged.
+func (c *Conn) queue(typ int, payload []byte) {
+	p := &outPacket{typ: typ, seq: c.seqNr, payload: payload, sentAt: time.Now(), transmissions: 1}
+	c.seqNr++
+	c.outbuf = append(c.outbuf, p)
+	c.inflight += len(payload)
+	c.sendPacket(typ, p.seq, payload)
+}
+
+func (c *Conn) resend(p *outPacket) {
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.sendPacket(p.typ, p.seq, p.payload)
+}
+
+func (c *Conn) sackMask() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+	mask := make([]byte, 4)
+	for seq := range c.reorder {
+		if i := int(seq - c.ackNr - 2); i >= 0 && i < len(mask)*8 {
+			mask[i/8] |= 1 << (i % 8)
+		}
+	}
+	return mask
+}
+
+// fail ends the connection with err, it must be called with c.m held.
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.notify()
+}
+
+// handle processes a packet for the connection.
+func (c *Conn) handle(h header, payload []byte) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.replyMicro = nowMicro() - h.ts
+	c.peerWnd = int(h.wnd)
+
+	switch h.typ {
+	case stReset:
+		c.fail(ErrReset)
+		return
+	case stSyn:
+		// our state packet was lost
+		c.sendAck()
+		return
+	case stState:
+		if c.state == stateSynSent {
+			c.state = stateConnected
+			c.ackNr = h.seq - 1
+		}
+	}
+	if c.state == stateSynSent {
+		return
+	}
+
+	c.processAck(h)
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h.seq, payload, h.typ == stFin)
+		c.sendAck()
+	}
+	c.notify()
+}
+
+func (c *Conn) processAck(h header) {
+	now := time.Now()
+	acked := 0
+	// the round trip is only measured when no retransmitted packet held
+	// back the acknowledgement
+	var sample *outPacket
+	resent := false
+	for len(c.outbuf) > 0 && !seqLess(h.ack, c.outbuf[0].seq) {
+		p := c.outbuf[0]
+		c.outbuf = c.outbuf[1:]
+		if !p.sacked {
+			acked += len(p.payload)
+			c.inflight -= len(p.payload)
+		}
+		resent = resent || p.transmissions > 1
+		sample = p
+	}
+	if sample != nil && sample.seq == h.ack && !resent {
+		c.updateRTT(now.Sub(sample.sentAt))
+	}
+
+	sackedAfter := 0
+	for i := 0; i < len(h.sack)*8; i++ {
+		if h.sack[i/8]&(1<<(i%8)) == 0 {
+			continue
+		}
+		seq := h.ack + 2 + uint16(i)
+		for _, p := range c.outbuf {
+			if p.seq == seq && !p.sacked {
+				p.sacked = true
+				acked += len(p.payload)
+				c.inflight -= len(p.payload)
+			}
+		}
+		sackedAfter++
+	}
+
+	switch {
+	case acked > 0 && h.ack != c.lastAck:
+		c.dupAcks = 0
+	case h.typ == stState && h.ack == c.lastAck && len(c.outbuf) > 0:
+		c.dupAcks++
+	}
+	c.lastAck = h.ack
+
+	// three duplicate or selective acks mean the oldest packet is lost
+	if len(c.outbuf) > 0 && !c.outbuf[0].sacked && (c.dupAcks == 3 || sackedAfter >= 3 && c.outbuf[0].transmissions == 1) {
+		c.cwnd = max(c.cwnd/2, minCwnd)
+		c.resend(c.outbuf[0])
+	}
+
+	if acked > 0 {
+		c.updateCwnd(h.tsDiff, acked, now)
+	}
+}
+
+// updateCwnd applies LEDBAT: the window grows while the queuing delay is
+// below the target and shrinks above it.
+func (c *Conn) updateCwnd(delay uint32, acked int, now time.Time) {
+	if delay == 0 {
+		return
+	}
+	if c.baseDelay == 0 || int32(delay-c.baseDelay) < 0 || now.After(c.baseDelayReset) {
+		c.baseDelay = delay
+		c.baseDelayReset = now.Add(baseDelayWindow)
+	}
+	queuing := time.Duration(delay-c.baseDelay) * time.Microsecond
+	offTarget := float64(targetDelay-queuing) / float64(targetDelay)
+	c.cwnd += maxCwndIncrease * offTarget * float64(acked) / c.cwnd
+	c.cwnd = min(max(c.cwnd, minCwnd), maxCwnd)
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = min(max(c.rtt+4*c.rttVar, minRTO), maxRTO)
+}
+
+func (c *Conn) receive(seq uint16, payload []byte, fin bool) {
+	if c.eof || !seqLess(c.ackNr, seq) || seq-c.ackNr > maxReorder {
+		return
+	}
+	c.reorder[seq] = inPacket{payload: payload, fin: fin}
+	for {
+		p, ok := c.reorder[c.ackNr+1]
+		if !ok {
+			return
+		}
+		delete(c.reorder, c.ackNr+1)
+		c.ackNr++
+		if p.fin {
+			c.eof = true
+			clear(c.reorder)
+			return
+		}
+		c.readBuf = append(c.readBuf, p.payload...)
+	}
+}
+
+// tick retransmits timed out packets. It reports false when the connection
+// can be forgotten.
+func (c *Conn) tick(now time.Time) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed && (len(c.outbuf) == 0 || c.err != nil || now.After(c.linger)) {
+		return false
+	}
+	if c.err != nil {
+		return true
+	}
+
+	for _, p := range c.outbuf {
+		if p.sacked {
+			continue
+		}
+		if now.Sub(p.sentAt) >= c.rto {
+			if p.transmissions > maxRetransmits {
+				c.fail(ErrTimeout)
+				return !c.closed
+			}
+			c.cwnd = minCwnd
+			c.rto = min(c.rto*2, maxRTO)
+			c.resend(p)
+		}
+		break
+	}
+	return true
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for {
+		if len(c.readBuf) > 0 {
+			full := len(c.readBuf) > recvWindow/2
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if full {
+				// announce the opened window
+				c.sendAck()
+			}
+			return n, nil
+		}
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		}
+		if err := c.wait(c.readDeadline, nil); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	written := 0
+	for written < len(b) {
+		switch {
+		case c.closed:
+			return written, net.ErrClosed
+		case c.err != nil:
+			return written, c.err
+		}
+
+		n := min(len(b)-written, mss)
+		window := min(int(c.cwnd), c.peerWnd)
+		if c.inflight > 0 && c.inflight+n > window {
+			if err := c.wait(c.writeDeadline, nil); err != nil {
+				return written, err
+			}
+			continue
+		}
+		c.queue(stData, append([]byte{}, b[written:written+n]...))
+		written += n
+	}
+	return written, nil
+}
+
+// Close sends a FIN after the queued data. The connection stays known to
+// the socket until the FIN is acknowledged.
+func (c *Conn) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.linger = time.Now().Add(lingerTimeout)
+	if c.state == stateConnected && c.err == nil {
+		c.queue(stFin, nil)
+	}
+	if c.state == stateSynSent || c.err != nil {
+		c.s.remove(c)
+	}
+	c.notify()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
@@ -0,0 +1,96 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// packet types
+const (
+	stData = iota
+	stFin
+	stState
+	stReset
+	stSyn
+)
+
+const (
+	version   = 1
+	headerLen = 20
+	extNone   = 0
+	extSACK   = 1
+)
+
+var errMalformedPacket = errors.New("malformed utp packet")
+
+type header struct {
+	typ    int
+	connID uint16
+	// ts is the send time in microseconds, tsDiff the delay the sender
+	// measured for the last packet it received from us
+	ts     uint32
+	tsDiff uint32
+	wnd    uint32
+	seq    uint16
+	ack    uint16
+	// sack is the selective ACK bitmask, bit i acknowledges ack+2+i
+	sack []byte
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	buf := make([]byte, headerLen, headerLen+len(h.sack)+2+len(payload))
+	buf[0] = byte(h.typ<<4 | version)
+	if len(h.sack) > 0 {
+		buf[1] = extSACK
+	}
+	binary.BigEndian.PutUint16(buf[2:], h.connID)
+	binary.BigEndian.PutUint32(buf[4:], h.ts)
+	binary.BigEndian.PutUint32(buf[8:], h.tsDiff)
+	binary.BigEndian.PutUint32(buf[12:], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:], h.seq)
+	binary.BigEndian.PutUint16(buf[18:], h.ack)
+	if len(h.sack) > 0 {
+		buf = append(buf, extNone, byte(len(h.sack)))
+		buf = append(buf, h.sack...)
+	}
+	return append(buf, payload...)
+}
+
+func parsePacket(b []byte) (header, []byte, error) {
+	if len(b) < headerLen || b[0]&0x0f != version || b[0]>>4 > stSyn {
+		return header{}, nil, errMalformedPacket
+	}
+	h := header{
+		typ:    int(b[0] >> 4),
+		connID: binary.BigEndian.Uint16(b[2:]),
+		ts:     binary.BigEndian.Uint32(b[4:]),
+		tsDiff: binary.BigEndian.Uint32(b[8:]),
+		wnd:    binary.BigEndian.Uint32(b[12:]),
+		seq:    binary.BigEndian.Uint16(b[16:]),
+		ack:    binary.BigEndian.Uint16(b[18:]),
+	}
+
+	ext := b[1]
+	b = b[headerLen:]
+	for ext != extNone {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return header{}, nil, errMalformedPacket
+		}
+		next, data := b[0], b[2:2+int(b[1])]
+		if ext == extSACK {
+			h.sack = data
+		}
+		ext, b = next, b[2+len(data):]
+	}
+	return h, b, nil
+}
+
+// seqLess compares sequence numbers that wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func nowMicro() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
@@ -0,0 +1,262 @@
+// Package utp implements the Micro Transport Protocol (BEP 29), a reliable
+// stream over UDP with LEDBAT congestion control. It backs off when other
+// traffic builds up queues, so transfers stay in the background.
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tickInterval = 50 * time.Millisecond
+	acceptQueue  = 32
+	maxPacketLen = 64 * 1024
+)
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes uTP connections over one UDP socket. It implements
+// net.Listener when created with accept.
+type Socket struct {
+	pc      net.PacketConn
+	accept  bool
+	backlog chan *Conn
+
+	m     sync.Mutex
+	conns map[connKey]*Conn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Listen opens a socket that accepts connections.
+func Listen(network, addr string) (*Socket, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc, true), nil
+}
+
+// NewSocket runs uTP on pc. Without accept, incoming connections are reset
+// and the socket is only used to dial.
+func NewSocket(pc net.PacketConn, accept bool) *Socket {
+	s := &Socket{
+		pc:      pc,
+		accept:  accept,
+		backlog: make(chan *Conn, acceptQueue),
+		conns:   map[connKey]*Conn{},
+		closed:  make(chan struct{}),
+	}
+	s.wg.Add(2)
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Accept waits for the next inbound connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the UDP socket, open connections fail.
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+		s.wg.Wait()
+
+		s.m.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		clear(s.conns)
+		s.m.Unlock()
+		for _, c := range conns {
+			c.m.Lock()
+			c.fail(net.ErrClosed)
+			c.m.Unlock()
+		}
+	})
+	return err
+}
+
+// DialContext connects to a uTP peer at addr.
+func (s *Socket) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	var c *Conn
+	for {
+		id := uint16(rand.IntN(1 << 16))
+		if _, ok := s.conns[connKey{raddr.String(), id}]; !ok {
+			c = newConn(s, raddr, id, id+1)
+			s.conns[connKey{raddr.String(), id}] = c
+			break
+		}
+	}
+	s.m.Unlock()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.seqNr = 1
+	c.queue(stSyn, nil)
+	for c.state == stateSynSent && c.err == nil && ctx.Err() == nil {
+		c.wait(time.Time{}, ctx.Done()) //nolint:errcheck
+	}
+	if c.state == stateConnected && c.err == nil {
+		return c, nil
+	}
+
+	s.remove(c)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return nil, ctx.Err()
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	key := connKey{c.remote.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) send(b []byte, addr net.Addr) {
+	s.pc.WriteTo(b, addr) //nolint:errcheck
+}
+
+func (s *Socket) readLoop() {
+	defer s.wg.Done()
+	buf := make([]byte, maxPacketLen)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		s.dispatch(h, append([]byte{}, payload...), addr)
+	}
+}
+
+func (s *Socket) dispatch(h header, payload []byte, addr net.Addr) {
+	s.m.Lock()
+	c := s.conns[connKey{addr.String(), h.connID}]
+	switch {
+	case c != nil:
+	case h.typ == stSyn:
+		c = s.conns[connKey{addr.String(), h.connID + 1}]
+		if c == nil {
+			s.m.Unlock()
+			s.acceptSyn(h, addr)
+			return
+		}
+	case h.typ == stReset:
+		// a reset carries the ID we send with
+		for _, other := range s.conns {
+			if other.sendID == h.connID && other.remote.String() == addr.String() {
+				c = other
+			}
+		}
+	}
+	s.m.Unlock()
+
+	if c == nil {
+		if h.typ != stReset {
+			s.reset(h, addr)
+		}
+		return
+	}
+	c.handle(h, payload)
+}
+
+func (s *Socket) reset(h header, addr net.Addr) {
+	r := header{typ: stReset, connID: h.connID, ts: nowMicro(), seq: uint16(rand.IntN(1 << 16)), ack: h.seq}
+	s.send(r.marshal(nil), addr)
+}
+
+func (s *Socket) acceptSyn(h header, addr net.Addr) {
+	if !s.accept {
+		s.reset(h, addr)
+		return
+	}
+	c := newConn(s, addr, h.connID+1, h.connID)
+	c.state = stateConnected
+	c.seqNr = uint16(rand.IntN(1 << 16))
+	c.ackNr = h.seq
+	c.replyMicro = nowMicro() - h.ts
+
+	s.m.Lock()
+	s.conns[connKey{addr.String(), c.recvID}] = c
+	s.m.Unlock()
+
+	select {
+	case s.backlog <- c:
+	default:
+		s.remove(c)
+		s.reset(h, addr)
+		return
+	}
+
+	c.m.Lock()
+	c.sendAck()
+	c.m.Unlock()
+}
+
+func (s *Socket) tickLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+
+		s.m.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.m.Unlock()
+
+		now := time.Now()
+		for _, c := range conns {
+			if !c.tick(now) {
+				s.remove(c)
+			}
+		}
+	}
+}
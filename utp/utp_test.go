@@ -0,0 +1,153 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lossyConn drops every n-th outgoing packet.
+type lossyConn struct {
+	net.PacketConn
+	n     int64
+	count atomic.Int64
+}
+
+func (lc *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if lc.count.Add(1)%lc.n == 0 {
+		return len(b), nil
+	}
+	return lc.PacketConn.WriteTo(b, addr)
+}
+
+func newTestSocket(t *testing.T, accept bool, dropEvery int64) *Socket {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if dropEvery > 0 {
+		pc = &lossyConn{PacketConn: pc, n: dropEvery}
+	}
+	s := NewSocket(pc, accept)
+	t.Cleanup(func() { s.Close() }) //nolint:errcheck
+	return s
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	h := header{typ: stData, connID: 7, ts: 1, tsDiff: 2, wnd: 3, seq: 65535, ack: 4, sack: []byte{1, 0, 0, 0x80}}
+	parsed, payload, err := parsePacket(h.marshal([]byte("data")))
+	require.NoError(err)
+	require.Equal(h, parsed)
+	require.Equal([]byte("data"), payload)
+
+	_, _, err = parsePacket([]byte{0x01, 0})
+	require.ErrorIs(err, errMalformedPacket)
+
+	require.True(seqLess(65535, 0), "sequence numbers wrap")
+	require.False(seqLess(0, 65535))
+}
+
+func transfer(t *testing.T, server, client *Socket, size int) {
+	require := require.New(t)
+	data := make([]byte, size)
+	_, err := rand.Read(data)
+	require.NoError(err)
+
+	received := make(chan []byte, 1)
+	go func() {
+		con, err := server.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer con.Close()                                 //nolint:errcheck
+		con.SetDeadline(time.Now().Add(20 * time.Second)) //nolint:errcheck
+		buf, _ := io.ReadAll(con)
+		received <- buf
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	con, err := client.DialContext(ctx, server.Addr().String())
+	require.NoError(err)
+	require.NoError(con.SetDeadline(time.Now().Add(20 * time.Second)))
+
+	// Close sends a FIN, the reader gets EOF after all data
+	n, err := con.Write(data)
+	require.NoError(err)
+	require.Equal(size, n)
+	require.NoError(con.Close())
+
+	require.True(bytes.Equal(data, <-received))
+}
+
+func TestTransfer(t *testing.T) {
+	t.Parallel()
+	transfer(t, newTestSocket(t, true, 0), newTestSocket(t, false, 0), 1<<20)
+}
+
+func TestTransferWithLoss(t *testing.T) {
+	t.Parallel()
+	transfer(t, newTestSocket(t, true, 13), newTestSocket(t, false, 11), 256*1024)
+}
+
+func TestEcho(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	server := newTestSocket(t, true, 0)
+	client := newTestSocket(t, false, 0)
+
+	go func() {
+		con, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer con.Close() //nolint:errcheck
+		io.Copy(con, con) //nolint:errcheck
+	}()
+
+	con, err := client.DialContext(context.Background(), server.Addr().String())
+	require.NoError(err)
+	defer con.Close() //nolint:errcheck
+	require.NoError(con.SetDeadline(time.Now().Add(5 * time.Second)))
+
+	for _, msg := range []string{"ping", "pong"} {
+		_, err := con.Write([]byte(msg))
+		require.NoError(err)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(con, buf)
+		require.NoError(err)
+		require.Equal(msg, string(buf))
+	}
+
+	require.NoError(con.SetReadDeadline(time.Now().Add(10 * time.Millisecond)))
+	_, err = con.Read(make([]byte, 1))
+	var netErr net.Error
+	require.ErrorAs(err, &netErr)
+	require.True(netErr.Timeout())
+}
+
+func TestDialRefused(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+	// a socket that does not accept resets the connection
+	server := newTestSocket(t, false, 0)
+	client := newTestSocket(t, false, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.DialContext(ctx, server.Addr().String())
+	require.ErrorIs(err, ErrReset)
+
+	client.m.Lock()
+	defer client.m.Unlock()
+	require.Empty(client.conns)
+}